@@ -1,12 +1,24 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"math/big"
 	"os"
 	"regexp"
+	"runtime"
+	"runtime/pprof"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 "path/filepath"
 	"os/exec"
 )
@@ -15,73 +27,630 @@ import (
 // Lexer
 // -------------------------------
 
+// Pos is a 1-based line/column location in the source.
+type Pos struct {
+	Line int
+	Col  int
+}
+
+func (p Pos) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Col)
+}
+
 type Token struct {
-	Kind  string
+	Kind  TokenKind
 	Value string
+	Pos   Pos
+}
+
+// TokenKind classifies a Token. Keywords each have their own kind; every
+// other kind is a tokenSpec rule.
+type TokenKind int
+
+const (
+	KindEOF TokenKind = iota
+	KindReal
+	KindNumber
+	KindStr
+	KindCharLit
+	KindID
+	KindDoc
+	KindComment
+	KindOp
+	KindQuestion
+	KindColon
+	KindLParen
+	KindRParen
+	KindLBrace
+	KindRBrace
+	KindLBracket
+	KindRBracket
+	KindSemi
+	KindComma
+	KindSkip
+	KindMismatch
+
+	KindInt
+	KindInt8
+	KindInt16
+	KindInt32
+	KindInt64
+	KindUint
+	KindUint8
+	KindUint16
+	KindUint32
+	KindUint64
+	KindChar
+	KindString
+	KindFloat
+	KindDouble
+	KindReturn
+	KindExtern
+	KindIf
+	KindElse
+	KindWhile
+	KindBreak
+	KindContinue
+	KindTypedef
+	KindStaticAssert
+	KindAssert
+	KindConst
+)
+
+// kindNames spells the kinds that are not keywords, as in --emit=tokens.
+var kindNames = map[TokenKind]string{
+	KindEOF:      "EOF",
+	KindReal:     "REAL",
+	KindNumber:   "NUMBER",
+	KindStr:      "STR",
+	KindCharLit:  "CHARLIT",
+	KindID:       "ID",
+	KindDoc:      "DOC",
+	KindComment:  "COMMENT",
+	KindOp:       "OP",
+	KindQuestion: "QUESTION",
+	KindColon:    "COLON",
+	KindLParen:   "LPAREN",
+	KindRParen:   "RPAREN",
+	KindLBrace:   "LBRACE",
+	KindRBrace:   "RBRACE",
+	KindLBracket: "LBRACKET",
+	KindRBracket: "RBRACKET",
+	KindSemi:     "SEMI",
+	KindComma:    "COMMA",
+	KindSkip:     "SKIP",
+	KindMismatch: "MISMATCH",
+}
+
+// String returns the kind's name: a keyword's in upper case, such as
+// RETURN, or else the tokenSpec rule's.
+func (k TokenKind) String() string {
+	if name, ok := kindNames[k]; ok {
+		return name
+	}
+	for word, kind := range keywords {
+		if kind == k {
+			return strings.ToUpper(word)
+		}
+	}
+	return fmt.Sprintf("TokenKind(%d)", int(k))
 }
 
 var tokenSpec = []struct {
-	Name    string
+	Kind    TokenKind
 	Pattern string
 }{
-	{"NUMBER", `\d+`},
-	{"ID", `[A-Za-z_]\w*`},
-	{"OP", `[+\-*/=]`},
-	{"LPAREN", `\(`},
-	{"RPAREN", `\)`},
-	{"LBRACE", `\{`},
-	{"RBRACE", `\}`},
-	{"SEMI", `;`},
-	{"SKIP", `[ \t\n]+`},
-	{"MISMATCH", `.`},
+	{KindReal, `\d+\.\d+(?:[eE][+-]?\d+)?|\d+[eE][+-]?\d+`},
+	{KindNumber, `(?:0[xX][0-9A-Fa-f]+|0[bB][01]+|\d+)(?:[uU][lL]?|[lL][uU]?)?`},
+	{KindStr, `"(?:[^"\\\n]|\\.)*"`},
+	{KindCharLit, `'(?:[^'\\\n]|\\.)*'`},
+	{KindID, `[\p{L}_][\p{L}0-9_]*`},
+	{KindDoc, `///[^\n]*`},
+	{KindComment, `//[^\n]*`},
+	{KindOp, `==|!=|<=|>=|<<|>>|&&|\|\||\*\*|[+\-*/=<>~]`},
+	{KindQuestion, `\?`},
+	{KindColon, `:`},
+	{KindLParen, `\(`},
+	{KindRParen, `\)`},
+	{KindLBrace, `\{`},
+	{KindRBrace, `\}`},
+	{KindLBracket, `\[`},
+	{KindRBracket, `\]`},
+	{KindSemi, `;`},
+	{KindComma, `,`},
+	// A backslash ending a line continues it, as in C, and is skipped
+	// like any other whitespace.
+	{KindSkip, `(?:[ \t\n]|\\\n)+`},
+	{KindMismatch, `.`},
 }
 
-var keywords = map[string]bool{
-	"int":    true,
-	"return": true,
+var keywords = map[string]TokenKind{
+	"int":    KindInt,
+	"int8":   KindInt8,
+	"int16":  KindInt16,
+	"int32":  KindInt32,
+	"int64":  KindInt64,
+	"uint":   KindUint,
+	"uint8":  KindUint8,
+	"uint16": KindUint16,
+	"uint32": KindUint32,
+	"uint64": KindUint64,
+	"char":   KindChar,
+	"string": KindString,
+	"float":  KindFloat,
+	"double": KindDouble,
+	"return": KindReturn,
+	"extern": KindExtern,
+	"if":     KindIf,
+	"else":   KindElse,
+	"while":  KindWhile,
+
+	"break":    KindBreak,
+	"continue": KindContinue,
+
+	"typedef": KindTypedef,
+
+	"static_assert": KindStaticAssert,
+	"assert":        KindAssert,
+	"const":         KindConst,
 }
 
 type Lexer struct {
-	code   string
-	tokens []Token
+	// UseScanner selects the hand-written scanner instead of the regular
+	// expression built from tokenSpec. Both produce the same tokens.
+	UseScanner bool
+
+	// TabWidth is the distance between tab stops used when computing
+	// columns. Zero counts a tab as a single column.
+	TabWidth int
+
+	// Pragmas collects the `// lang:nowarn` comments read so far.
+	Pragmas []Pragma
+
+	// Comments collects every // and /// comment read so far, for the
+	// formatter.
+	Comments []Token
+
+	code string
+	off  int
+	pos  Pos
+	// lastLine is the line of the last token returned, and pending holds
+	// the pragmas waiting for the line of the next one.
+	lastLine int
+	pending  []int
+	// checked records that code has been validated as UTF-8.
+	checked bool
+	// err is the error Next failed with, if any.
+	err error
+}
+
+// Pragma is a `// lang:nowarn [category,...]` comment. It silences
+// warnings of the listed categories, or of every category if none are
+// listed, on Line: the line of the code it follows on the same line, or
+// else the line the next statement starts on.
+type Pragma struct {
+	Pos        Pos
+	Line       int
+	Categories []string
+}
+
+// parsePragma recognises a lang:nowarn comment.
+func parsePragma(comment string, pos Pos) (Pragma, bool) {
+	text := strings.TrimSpace(strings.TrimPrefix(comment, "//"))
+	if text != "lang:nowarn" && !strings.HasPrefix(text, "lang:nowarn ") {
+		return Pragma{}, false
+	}
+	categories := strings.FieldsFunc(strings.TrimPrefix(text, "lang:nowarn"), func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+	return Pragma{Pos: pos, Categories: categories}, true
+}
+
+// silences reports whether p suppresses d. Errors are never suppressed.
+func (p Pragma) silences(d Diagnostic) bool {
+	if d.Category == "" || d.Pos.Line != p.Line {
+		return false
+	}
+	for _, category := range p.Categories {
+		if category == d.Category {
+			return true
+		}
+	}
+	return len(p.Categories) == 0
 }
 
 func NewLexer(code string) *Lexer {
-	return &Lexer{code: code}
+	return &Lexer{code: code, pos: Pos{Line: 1, Col: 1}}
 }
 
-func (l *Lexer) Tokenize() ([]Token, error) {
+// tokenRegexp matches a single token of any kind. Its subexpressions are
+// exactly the tokenSpec entries, in order, so group i is tokenSpec[i-1].
+var tokenRegexp = compileTokenSpec()
+
+func compileTokenSpec() *regexp.Regexp {
 	regexParts := ""
 	for _, spec := range tokenSpec {
-		regexParts += fmt.Sprintf("(?P<%s>%s)|", spec.Name, spec.Pattern)
+		regexParts += fmt.Sprintf("(?P<%s>%s)|", spec.Kind, spec.Pattern)
 	}
 	regexParts = regexParts[:len(regexParts)-1] // trim last |
+	return regexp.MustCompile(regexParts)
+}
 
-	re := regexp.MustCompile(regexParts)
-	matches := re.FindAllStringSubmatchIndex(l.code, -1)
+// Tokenize lexes the remaining input in one go.
+func (l *Lexer) Tokenize() ([]Token, error) {
+	var tokens []Token
+	for {
+		tok, err := l.Next()
+		if err != nil {
+			return nil, err
+		}
+		if tok.Kind == KindEOF {
+			return tokens, nil
+		}
+		tokens = append(tokens, tok)
+	}
+}
 
-	for _, loc := range matches {
-		for i, name := range re.SubexpNames() {
-			if i == 0 || loc[2*i] < 0 {
-				continue
+// Next returns the next token, or an EOF token once the input is exhausted.
+func (l *Lexer) Next() (Token, error) {
+	if !l.checked {
+		l.checked = true
+		if n := invalidUTF8(l.code); n >= 0 {
+			pos := advance(Pos{Line: 1, Col: 1}, l.code[:n], l.TabWidth)
+			return Token{}, l.fail(&ParseError{Pos: pos, Msg: fmt.Sprintf("invalid UTF-8 at byte %d", n)})
+		}
+	}
+	for l.off < len(l.code) {
+		kind, n := l.match(l.code[l.off:])
+		value := l.code[l.off : l.off+n]
+		start := l.pos
+		l.pos = advance(l.pos, value, l.TabWidth)
+		l.off += n
+		if kind == KindNumber {
+			// keep as string, parse later
+		} else if keyword, ok := keywords[value]; ok && kind == KindID {
+			kind = keyword
+		} else if kind == KindComment {
+			l.Comments = append(l.Comments, Token{Kind: kind, Value: value, Pos: start})
+			if pragma, ok := parsePragma(value, start); ok {
+				if start.Line == l.lastLine {
+					pragma.Line = start.Line
+				} else {
+					l.pending = append(l.pending, len(l.Pragmas))
+				}
+				l.Pragmas = append(l.Pragmas, pragma)
+			}
+			continue
+		} else if kind == KindSkip {
+			continue
+		} else if kind == KindDoc {
+			l.Comments = append(l.Comments, Token{Kind: kind, Value: value, Pos: start})
+		} else if kind == KindCharLit {
+			if _, err := decodeChar(value, start); err != nil {
+				return Token{}, l.fail(err)
+			}
+		} else if kind == KindMismatch {
+			return Token{}, l.fail(&ParseError{Pos: start, Msg: "unexpected character: " + value})
+		}
+		for _, i := range l.pending {
+			l.Pragmas[i].Line = start.Line
+		}
+		l.pending, l.lastLine = nil, start.Line
+		return Token{Kind: kind, Value: value, Pos: start}, nil
+	}
+	return Token{Kind: KindEOF, Pos: l.pos}, nil
+}
+
+func (l *Lexer) fail(err error) error {
+	l.err = err
+	return err
+}
+
+// Err returns the error Next failed with, or nil. It tells a malformed
+// token apart from a syntax error once Parse has failed.
+func (l *Lexer) Err() error {
+	return l.err
+}
+
+// invalidUTF8 returns the offset of the first byte of code that is not
+// part of a valid UTF-8 sequence, or -1 if there is none.
+func invalidUTF8(code string) int {
+	for off, r := range code {
+		if r == utf8.RuneError {
+			if _, n := utf8.DecodeRuneInString(code[off:]); n == 1 {
+				return off
+			}
+		}
+	}
+	return -1
+}
+
+// match returns the kind and length of the token at the start of code.
+func (l *Lexer) match(code string) (TokenKind, int) {
+	if l.UseScanner {
+		return scanToken(code)
+	}
+	loc := tokenRegexp.FindStringSubmatchIndex(code)
+	// The alternation matches exactly one group; find which.
+	i := 1
+	for loc[2*i] < 0 {
+		i++
+	}
+	return tokenSpec[i-1].Kind, loc[1]
+}
+
+// intSuffixEnd returns the end of the U, L, UL or LU suffix, in either
+// case, that may follow the digits of an integer literal ending at n.
+func intSuffixEnd(code string, n int) int {
+	isU := func(i int) bool { return i < len(code) && (code[i] == 'u' || code[i] == 'U') }
+	isL := func(i int) bool { return i < len(code) && (code[i] == 'l' || code[i] == 'L') }
+	switch {
+	case isU(n) && isL(n+1), isL(n) && isU(n+1):
+		return n + 2
+	case isU(n), isL(n):
+		return n + 1
+	}
+	return n
+}
+
+// isSpace returns the length of the whitespace character or line
+// continuation at code[i], or 0 if there is none.
+func isSpace(code string, i int) int {
+	switch {
+	case i >= len(code):
+		return 0
+	case code[i] == ' ' || code[i] == '\t' || code[i] == '\n':
+		return 1
+	case code[i] == '\\' && i+1 < len(code) && code[i+1] == '\n':
+		return 2
+	}
+	return 0
+}
+
+// scanToken recognises the token at the start of code, returning its kind
+// and length in bytes. It follows tokenSpec rule for rule, including its
+// first-match ordering.
+func scanToken(code string) (TokenKind, int) {
+	c := code[0]
+	switch {
+	case c == '0' && len(code) > 2 && (code[1] == 'x' || code[1] == 'X') && isHexDigit(code[2]):
+		n := 3
+		for n < len(code) && isHexDigit(code[n]) {
+			n++
+		}
+		return KindNumber, intSuffixEnd(code, n)
+	case c == '0' && len(code) > 2 && (code[1] == 'b' || code[1] == 'B') && (code[2] == '0' || code[2] == '1'):
+		n := 3
+		for n < len(code) && (code[n] == '0' || code[n] == '1') {
+			n++
+		}
+		return KindNumber, intSuffixEnd(code, n)
+	case isDigit(c):
+		n := digits(code, 0)
+		kind := KindNumber
+		if n+1 < len(code) && code[n] == '.' && isDigit(code[n+1]) {
+			n = digits(code, n+1)
+			kind = KindReal
+		}
+		if n < len(code) && (code[n] == 'e' || code[n] == 'E') {
+			exp := n + 1
+			if exp < len(code) && (code[exp] == '+' || code[exp] == '-') {
+				exp++
 			}
-			value := l.code[loc[2*i]:loc[2*i+1]]
-			kind := name
-			if kind == "NUMBER" {
-				// keep as string, parse later
-			} else if kind == "ID" && keywords[value] {
-				kind = strings.ToUpper(value)
-			} else if kind == "SKIP" {
-				kind = ""
-			} else if kind == "MISMATCH" {
-				return nil, fmt.Errorf("unexpected character: %s", value)
+			if exp < len(code) && isDigit(code[exp]) {
+				n = digits(code, exp)
+				kind = KindReal
 			}
-			if kind != "" {
-				l.tokens = append(l.tokens, Token{Kind: kind, Value: value})
+		}
+		if kind == KindNumber {
+			n = intSuffixEnd(code, n)
+		}
+		return kind, n
+	case c == '"':
+		if n := scanQuoted(code); n > 0 {
+			return KindStr, n
+		}
+	case c == '\'':
+		if n := scanQuoted(code); n > 0 {
+			return KindCharLit, n
+		}
+	case isLetter(rune(c)) || c >= utf8.RuneSelf:
+		if n := scanIdent(code); n > 0 {
+			return KindID, n
+		}
+	case isSpace(code, 0) > 0:
+		n := 0
+		for w := isSpace(code, n); w > 0; w = isSpace(code, n) {
+			n += w
+		}
+		return KindSkip, n
+	}
+	if strings.HasPrefix(code, "//") {
+		n := strings.IndexByte(code, '\n')
+		if n < 0 {
+			n = len(code)
+		}
+		if strings.HasPrefix(code, "///") {
+			return KindDoc, n
+		}
+		return KindComment, n
+	}
+	if len(code) > 1 && twoCharOps[code[:2]] {
+		return KindOp, 2
+	}
+	switch c {
+	case '+', '-', '*', '/', '=', '<', '>', '~':
+		return KindOp, 1
+	case '(':
+		return KindLParen, 1
+	case ')':
+		return KindRParen, 1
+	case '{':
+		return KindLBrace, 1
+	case '}':
+		return KindRBrace, 1
+	case '[':
+		return KindLBracket, 1
+	case ']':
+		return KindRBracket, 1
+	case '?':
+		return KindQuestion, 1
+	case ':':
+		return KindColon, 1
+	case ';':
+		return KindSemi, 1
+	case ',':
+		return KindComma, 1
+	}
+	_, n := utf8.DecodeRuneInString(code)
+	return KindMismatch, n
+}
+
+// scanQuoted returns the length of the string or char literal at the start
+// of code, delimited by code[0], or 0 if it is not closed on the same line.
+func scanQuoted(code string) int {
+	for n := 1; n < len(code) && code[n] != '\n'; n++ {
+		if code[n] == code[0] {
+			return n + 1
+		}
+		if code[n] == '\\' {
+			if n+1 == len(code) || code[n+1] == '\n' {
+				break
 			}
+			n++
+		}
+	}
+	return 0
+}
+
+// charEscapes maps the simple escape letters to their values.
+var charEscapes = map[byte]int{
+	'a': 7, 'b': 8, 'f': 12, 'n': 10, 'r': 13, 't': 9, 'v': 11,
+	'\\': '\\', '\'': '\'', '"': '"', '?': '?',
+}
+
+// decodeChar returns the value of a char literal token starting at pos, as
+// C sees it with a signed char. Errors point at the offending character.
+func decodeChar(lit string, pos Pos) (int, error) {
+	body := lit[1 : len(lit)-1]
+	at := func(i int, format string, args ...interface{}) error {
+		return &ParseError{Pos: Pos{pos.Line, pos.Col + 1 + i}, Msg: fmt.Sprintf(format, args...)}
+	}
+	if body == "" {
+		return 0, &ParseError{Pos: pos, Msg: "empty character literal"}
+	}
+	var v, n int
+	switch {
+	case body[0] != '\\':
+		r, size := utf8.DecodeRuneInString(body)
+		if r > 0x7f {
+			return 0, at(0, "character U+%04X does not fit in a char", r)
 		}
+		v, n = int(r), size
+	case len(body) > 1 && body[1] == 'x':
+		n = 2
+		for n < len(body) && strings.IndexByte("0123456789abcdefABCDEF", body[n]) >= 0 {
+			n++
+		}
+		if n == 2 {
+			return 0, at(0, "\\x used with no following hex digits")
+		}
+		x, _ := strconv.ParseUint(body[2:n], 16, 64)
+		if x > 0xff {
+			return 0, at(0, "hex escape sequence out of range for char")
+		}
+		v = int(x)
+	case len(body) > 1 && body[1] == 'u':
+		if len(body) < 6 {
+			return 0, at(0, "\\u must be followed by 4 hex digits")
+		}
+		x, err := strconv.ParseUint(body[2:6], 16, 32)
+		if err != nil {
+			return 0, at(0, "\\u must be followed by 4 hex digits")
+		}
+		if x > 0x7f {
+			return 0, at(0, "character U+%04X does not fit in a char", x)
+		}
+		v, n = int(x), 6
+	case len(body) > 1 && '0' <= body[1] && body[1] <= '7':
+		n = 2
+		for n < len(body) && n < 4 && '0' <= body[n] && body[n] <= '7' {
+			n++
+		}
+		x, _ := strconv.ParseUint(body[1:n], 8, 64)
+		if x > 0xff {
+			return 0, at(0, "octal escape sequence out of range for char")
+		}
+		v = int(x)
+	default:
+		e, ok := charEscapes[body[1]]
+		if !ok {
+			return 0, at(0, "unknown escape sequence '\\%c'", body[1])
+		}
+		v, n = e, 2
+	}
+	if n < len(body) {
+		return 0, at(n, "character literal contains more than one character")
+	}
+	if v > 0x7f {
+		v -= 0x100
+	}
+	return v, nil
+}
+
+var twoCharOps = map[string]bool{"==": true, "!=": true, "<=": true, ">=": true, "<<": true, ">>": true, "&&": true, "||": true, "**": true}
+
+// digits returns the offset of the first non-digit in code at or after i.
+func digits(code string, i int) int {
+	for i < len(code) && isDigit(code[i]) {
+		i++
 	}
-	return l.tokens, nil
+	return i
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// isLetter reports whether r may start an identifier. Letters from any
+// script are allowed; digits must be ASCII.
+func isLetter(r rune) bool {
+	return r == '_' || unicode.IsLetter(r)
+}
+
+// scanIdent returns the length in bytes of the identifier at the start of
+// code, or 0 if there is none.
+func scanIdent(code string) int {
+	n := 0
+	for n < len(code) {
+		r, size := utf8.DecodeRuneInString(code[n:])
+		if !isLetter(r) && (n == 0 || !isDigit(code[n])) {
+			break
+		}
+		n += size
+	}
+	return n
+}
+
+// advance returns the position just past text when it starts at pos. Tabs
+// move to the next multiple of tabWidth when it is positive.
+func advance(pos Pos, text string, tabWidth int) Pos {
+	for _, r := range text {
+		switch {
+		case r == '\n':
+			pos.Line++
+			pos.Col = 1
+		case r == '\t' && tabWidth > 0:
+			pos.Col += tabWidth - (pos.Col-1)%tabWidth
+		default:
+			pos.Col++
+		}
+	}
+	return pos
 }
 
 // -------------------------------
@@ -90,218 +659,5692 @@ func (l *Lexer) Tokenize() ([]Token, error) {
 
 type Node interface{}
 
-type Function struct {
+type Program struct {
+	Decls []Node
+}
+
+// Param is a single entry of a parameter list. Name may be empty in
+// prototypes such as `extern int abs(int);`.
+type Param struct {
+	Type string
 	Name string
-	Body []Node
+	Pos  Pos
+}
+
+// ExternDecl declares a function defined outside the program, typically in
+// libc, so that it can be called.
+type ExternDecl struct {
+	Name   string
+	Ret    string
+	Params []Param
+	Pos    Pos
+}
+
+type Function struct {
+	Name   string
+	Ret    string
+	Params []Param
+	Body   []Node
+	// Doc holds the text of the /// comment lines preceding the function.
+	Doc []string
+	Pos Pos
+	// End is the position of the closing brace.
+	End Pos
 }
 
 type Return struct {
 	Expr Node
+	Pos  Pos
 }
 
 type VarDecl struct {
+	Type string
 	Name string
 	Expr Node
+	Pos  Pos
+	// Array marks `Type Name[Len]`. Len is 0 when the size is left to the
+	// initializer, an ArrayLit.
+	Array bool
+	Len   int
 }
 
+// Assign stores Expr in Target, and is itself an expression with the
+// stored value, as in C. The checker requires Target to be a variable or
+// an element of an array.
 type Assign struct {
+	Target Node
+	Expr   Node
+	Pos    Pos
+}
+
+// Block is a braced statement list that opens a new scope. End is the
+// position of the closing brace, or the zero Pos when the parser made the
+// Block to hold a lone statement.
+type Block struct {
+	Body []Node
+	Pos  Pos
+	End  Pos
+}
+
+// TypeAlias is a top-level `typedef <type> Name;`.
+type TypeAlias struct {
 	Name string
+	Type string
+	Pos  Pos
+}
+
+// If runs Then when Cond is non-zero and Else, which may be nil, otherwise.
+// Then is always a Block; Else is a Block or, for `else if`, an If.
+type If struct {
+	Cond Node
+	Then Node
+	Else Node
+	Pos  Pos
+}
+
+// While runs Body, always a Block, for as long as Cond is non-zero. Label
+// names the loop for labeled break and continue, a language extension.
+type While struct {
+	Cond  Node
+	Body  Node
+	Pos   Pos
+	Label string
+}
+
+// Break leaves the innermost loop, or the enclosing loop named Label.
+type Break struct {
+	Label string
+	Pos   Pos
+}
+
+// Continue starts the next iteration of the innermost loop, or of the
+// enclosing loop named Label.
+type Continue struct {
+	Label string
+	Pos   Pos
+}
+
+// ExprStmt evaluates an expression for its side effects, e.g. `foo();`.
+type ExprStmt struct {
 	Expr Node
+	Pos  Pos
 }
 
-type BinOp struct {
-	Op    string
-	Left  Node
-	Right Node
+// Ternary is a conditional expression, `Cond ? Then : Else`. Its Pos is that
+// of the '?' and Type, like BinOp's, is set by the checker.
+type Ternary struct {
+	Cond Node
+	Then Node
+	Else Node
+	Pos  Pos
+	Type string
 }
 
-// -------------------------------
-// Parser
-// -------------------------------
+// Comma evaluates Exprs left to right and yields the last, as C's comma
+// operator does.
+type Comma struct {
+	Exprs []Node
+	Pos   Pos
+}
 
-type Parser struct {
-	tokens []Token
-	pos    int
+// StaticAssert is a compile-time check, `static_assert(expr, "msg");`.
+type StaticAssert struct {
+	Expr Node
+	Msg  *StringLit
+	Pos  Pos
 }
 
-func NewParser(tokens []Token) *Parser {
-	return &Parser{tokens: tokens}
+// Assert is a runtime check, `assert(expr);`, aborting the program when
+// expr is zero unless assertions are compiled out.
+type Assert struct {
+	Expr Node
+	Pos  Pos
 }
 
-func (p *Parser) peek() Token {
-	if p.pos < len(p.tokens) {
-		return p.tokens[p.pos]
-	}
-	return Token{Kind: "EOF"}
+// EmptyStmt is a lone `;`.
+type EmptyStmt struct {
+	Pos Pos
 }
 
-func (p *Parser) consume(expected string) Token {
-	tok := p.peek()
-	if expected != "" && tok.Kind != expected {
-		panic(fmt.Sprintf("expected %s, got %v", expected, tok))
+// nodePos returns the source position recorded on a node, or the zero Pos
+// for nodes that do not carry one.
+func nodePos(n Node) Pos {
+	switch n := n.(type) {
+	case *Function:
+		return n.Pos
+	case *ExternDecl:
+		return n.Pos
+	case *TypeAlias:
+		return n.Pos
+	case *Return:
+		return n.Pos
+	case *VarDecl:
+		return n.Pos
+	case *Assign:
+		return n.Pos
+	case *ExprStmt:
+		return n.Pos
+	case *Block:
+		return n.Pos
+	case *EmptyStmt:
+		return n.Pos
+	case *Break:
+		return n.Pos
+	case *Continue:
+		return n.Pos
+	case *If:
+		return n.Pos
+	case *While:
+		return n.Pos
+	case *StaticAssert:
+		return n.Pos
+	case *Assert:
+		return n.Pos
+	case *Number:
+		return n.Pos
+	case *FloatLit:
+		return n.Pos
+	case *Ident:
+		return n.Pos
+	case *Call:
+		return n.Pos
+	case *StringLit:
+		return n.Pos
+	case *CharLit:
+		return n.Pos
+	case *ArrayLit:
+		return n.Pos
+	case *Index:
+		return n.Pos
+	case *BinOp:
+		return n.Pos
+	case *Unary:
+		return n.Pos
+	case *Comma:
+		return n.Pos
+	case *Ternary:
+		return n.Pos
 	}
-	p.pos++
-	return tok
+	return Pos{}
 }
 
-func (p *Parser) ParseFunction() *Function {
-	p.consume("INT")
-	name := p.consume("ID").Value
-	p.consume("LPAREN")
-	p.consume("RPAREN")
-	p.consume("LBRACE")
-	var stmts []Node
-	for p.peek().Kind != "RBRACE" {
-		stmts = append(stmts, p.ParseStatement())
-	}
-	p.consume("RBRACE")
-	return &Function{Name: name, Body: stmts}
+// Number is an integer literal. Base is 16, 8 or 2 for a literal written
+// with a 0x, 0 or 0b prefix, with Raw its source text less any suffix;
+// literals written in decimal or made by folding leave both unset. Suffix
+// is "U", "L" or "UL" for a literal written with one, in any case or
+// order, and gives it the type intSuffixTypes names.
+type Number struct {
+	Value  int
+	Pos    Pos
+	Base   int
+	Raw    string
+	Suffix string
+	// Type is set by the checker to "float" or "double" when the literal
+	// initializes a floating-point value, and is otherwise empty.
+	Type string
 }
 
-func (p *Parser) ParseStatement() Node {
-	tok := p.peek()
-	switch tok.Kind {
-	case "RETURN":
-		p.consume("RETURN")
-		expr := p.ParseExpression()
-		p.consume("SEMI")
-		return &Return{Expr: expr}
-	case "INT":
-		p.consume("INT")
-		name := p.consume("ID").Value
-		var expr Node
-		if p.peek().Kind == "OP" && p.peek().Value == "=" {
-			p.consume("OP")
-			expr = p.ParseExpression()
-		}
-		p.consume("SEMI")
-		return &VarDecl{Name: name, Expr: expr}
-	case "ID":
-		name := p.consume("ID").Value
-		p.consume("OP") // must be '='
-		expr := p.ParseExpression()
-		p.consume("SEMI")
-		return &Assign{Name: name, Expr: expr}
-	default:
-		panic(fmt.Sprintf("unknown statement starting with %v", tok))
-	}
+// FloatLit is a floating-point literal. Like Number, its Type is set to
+// "float" when it initializes a float, and is otherwise empty.
+type FloatLit struct {
+	Value float64
+	Pos   Pos
+	Type  string
 }
 
-func (p *Parser) ParseExpression() Node {
-	var left Node
-	if p.peek().Kind == "NUMBER" {
-		val := p.consume("NUMBER").Value
-		num, _ := strconv.Atoi(val)
-		left = num
-	} else {
-		left = p.consume("ID").Value
-	}
-	for p.peek().Kind == "OP" && strings.Contains("+-*/", p.peek().Value) {
-		op := p.consume("OP").Value
-		var right Node
-		if p.peek().Kind == "NUMBER" {
-			val := p.consume("NUMBER").Value
-			num, _ := strconv.Atoi(val)
-			right = num
-		} else {
-			right = p.consume("ID").Value
-		}
-		left = &BinOp{Op: op, Left: left, Right: right}
-	}
-	return left
+// Ident is a reference to a variable.
+type Ident struct {
+	Name string
+	Pos  Pos
 }
 
-// -------------------------------
-// C99 Generator
-// -------------------------------
+type Call struct {
+	Name string
+	Args []Node
+	Pos  Pos
+}
 
-type C99Generator struct{}
+// StringLit holds the literal's source text between the quotes, with any
+// escape sequences left as written.
+type StringLit struct {
+	Value string
+	Pos   Pos
+}
 
-func (g *C99Generator) Generate(ast Node) string {
-	switch n := ast.(type) {
-	case int:
-		return strconv.Itoa(n)
-	case string:
-		return n
+// ArrayLit is a brace-enclosed array initializer, `{1, 2, 3}`.
+type ArrayLit struct {
+	Elems []Node
+	Pos   Pos
+}
+
+// Index is a subscript expression, `Array[Index]`.
+type Index struct {
+	Array Node
+	Index Node
+	Pos   Pos
+}
+
+// CharLit is a character literal. Value is what C gives it: an int in the
+// range of a signed char.
+type CharLit struct {
+	Value int
+	Pos   Pos
+}
+
+// BinOp's Pos is that of its operator token.
+type BinOp struct {
+	Op    string
+	Left  Node
+	Right Node
+	Pos   Pos
+	// Type is the result type, filled in by the Checker. For >> it also
+	// decides the kind of shift: logical when unsigned, arithmetic otherwise.
+	Type string
+}
+
+// Unary is a prefix operator applied to Expr; `~` is the only one.
+type Unary struct {
+	Op   string
+	Expr Node
+	Pos  Pos
+	// Type is the promoted type of the operand, filled in by the Checker.
+	Type string
+}
+
+// Children returns the nodes directly below n, in source order.
+func Children(n Node) []Node {
+	switch n := n.(type) {
+	case *Program:
+		return n.Decls
 	case *Function:
-		body := ""
-		for _, stmt := range n.Body {
-			body += "    " + g.Generate(stmt) + "\n"
-		}
-		return fmt.Sprintf("int %s(void) {\n%s}\n", n.Name, body)
+		return n.Body
+	case *Block:
+		return n.Body
 	case *Return:
-		return "return " + g.Generate(n.Expr) + ";"
+		return []Node{n.Expr}
 	case *VarDecl:
-		if n.Expr == nil {
-			return fmt.Sprintf("int %s;", n.Name)
+		if n.Expr != nil {
+			return []Node{n.Expr}
 		}
-		return fmt.Sprintf("int %s = %s;", n.Name, g.Generate(n.Expr))
 	case *Assign:
-		return fmt.Sprintf("%s = %s;", n.Name, g.Generate(n.Expr))
+		return []Node{n.Target, n.Expr}
+	case *ExprStmt:
+		return []Node{n.Expr}
+	case *If:
+		if n.Else != nil {
+			return []Node{n.Cond, n.Then, n.Else}
+		}
+		return []Node{n.Cond, n.Then}
+	case *While:
+		return []Node{n.Cond, n.Body}
+	case *StaticAssert:
+		return []Node{n.Expr, n.Msg}
+	case *Assert:
+		return []Node{n.Expr}
+	case *Call:
+		return n.Args
 	case *BinOp:
-		return fmt.Sprintf("%s %s %s", g.maybeParen(n.Left), n.Op, g.maybeParen(n.Right))
-	default:
-		panic(fmt.Sprintf("unknown AST node: %T", n))
+		return []Node{n.Left, n.Right}
+	case *Unary:
+		return []Node{n.Expr}
+	case *Comma:
+		return n.Exprs
+	case *Ternary:
+		return []Node{n.Cond, n.Then, n.Else}
+	case *ArrayLit:
+		return n.Elems
+	case *Index:
+		return []Node{n.Array, n.Index}
 	}
+	return nil
 }
 
-func (g *C99Generator) maybeParen(expr Node) string {
-	if bin, ok := expr.(*BinOp); ok {
-		return "(" + g.Generate(bin) + ")"
+// Visitor is called by Walk on every node of a tree. Enter is called on
+// the way down and returns false to skip the node's children; Leave is
+// called on the way back up, once the children are done.
+type Visitor interface {
+	Enter(n Node) bool
+	Leave(n Node)
+}
+
+// Walk traverses the tree rooted at n depth-first in source order. Leave
+// is not called for a node whose Enter returned false.
+func Walk(n Node, v Visitor) {
+	if n == nil || !v.Enter(n) {
+		return
 	}
-	return g.Generate(expr)
+	for _, child := range Children(n) {
+		Walk(child, v)
+	}
+	v.Leave(n)
 }
 
-func main() {
-    if len(os.Args) < 2 {
-        fmt.Println("Usage: go run main.go <file> [ast|lex]")
-        return
-    }
-    inputFile := os.Args[1]
-    codeBytes, _ := ioutil.ReadFile(inputFile)
-    code := string(codeBytes)
+// -------------------------------
+// Parser
+// -------------------------------
 
-    lexer := NewLexer(code)
-    tokens, err := lexer.Tokenize()
-    if err != nil {
-        panic(err)
-    }
-    parser := NewParser(tokens)
-    ast := parser.ParseFunction()
-    gen := &C99Generator{}
-    output := gen.Generate(ast)
+// ParseError is a syntax error found while lexing or parsing.
+type ParseError struct {
+	Pos Pos
+	Msg string
+	// Token is the offending token when the error is about one in
+	// particular; it is the zero Token for lexical errors.
+	Token Token
+}
 
-    if len(os.Args) > 2 && os.Args[2] == "ast" {
-        fmt.Printf("%#v\n", ast)
-        return
-    } else if len(os.Args) > 2 && os.Args[2] == "lex" {
-        fmt.Printf("%#v\n", tokens)
-        return
-    }
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Pos, e.Msg)
+}
 
-    // write generated C code to a temporary .c file
-    tmpFile, err := os.CreateTemp("", "out-*.c")
-    if err != nil {
-        panic(err)
-    }
-    defer os.Remove(tmpFile.Name())
+// ErrorList holds the syntax errors of a parse that recovered from some.
+type ErrorList []*ParseError
 
-    _, err = tmpFile.WriteString(output)
-    if err != nil {
-        panic(err)
-    }
-    tmpFile.Close()
+func (l ErrorList) Error() string {
+	var msgs []string
+	for _, e := range l {
+		msgs = append(msgs, e.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
 
-    // derive output executable name from input file name
-    base := filepath.Base(inputFile)           // e.g. "sample.lang"
-    name := strings.TrimSuffix(base, filepath.Ext(base)) // "sample"
-    exeFile := filepath.Join(".", name)        // "./sample"
+// Parse parses a complete program from l. The parser reports syntax errors
+// by panicking with a *ParseError; Parse turns those back into an error,
+// an ErrorList when the parser recovered from earlier ones.
+func Parse(l *Lexer) (prog *Program, err error) {
+	p := NewStreamParser(l)
+	defer func() {
+		if r := recover(); r != nil {
+			perr, ok := r.(*ParseError)
+			if !ok {
+				panic(r)
+			}
+			p.errs = append(p.errs, perr)
+		}
+		switch len(p.errs) {
+		case 0:
+		case 1:
+			prog, err = nil, p.errs[0]
+		default:
+			prog, err = nil, p.errs
+		}
+	}()
+	return p.ParseProgram(), nil
+}
 
-    // compile with gcc into current working dir
-    cmd := exec.Command("gcc", tmpFile.Name(), "-o", exeFile)
-    out, err := cmd.CombinedOutput()
-    if err != nil {
-        fmt.Printf("%s\n", string(out))
-        panic(err)
+type Parser struct {
+	// buf holds the tokens not yet consumed. When reading from a lexer it
+	// only ever holds the current lookahead.
+	buf   []Token
+	lexer *Lexer
+	// aliases holds the typedef names seen so far, which begin a type
+	// just as the built-in type keywords do.
+	aliases map[string]bool
+	// errs holds the errors the parser has recovered from.
+	errs ErrorList
+}
+
+func NewParser(tokens []Token) *Parser {
+	return &Parser{buf: tokens}
+}
+
+// NewStreamParser pulls tokens from l as they are needed instead of
+// requiring the whole input to be tokenized up front.
+func NewStreamParser(l *Lexer) *Parser {
+	return &Parser{lexer: l}
+}
+
+func (p *Parser) peek() Token {
+	return p.peekAt(0)
+}
+
+// peekAt returns the token n places ahead without consuming anything.
+func (p *Parser) peekAt(n int) Token {
+	for len(p.buf) <= n && p.lexer != nil {
+		tok, err := p.lexer.Next()
+		if err != nil {
+			panic(err)
+		}
+		p.buf = append(p.buf, tok)
+	}
+	if n < len(p.buf) {
+		return p.buf[n]
+	}
+	return Token{Kind: KindEOF}
+}
+
+// consume takes the next token, which must be of the expected kind.
+func (p *Parser) consume(expected TokenKind) Token {
+	if tok := p.peek(); tok.Kind != expected {
+		p.errorf(tok.Pos, "expected %s, got %s", kindName(expected), describe(tok))
+	}
+	return p.next()
+}
+
+// next takes the next token, whatever its kind.
+func (p *Parser) next() Token {
+	tok := p.peek()
+	if len(p.buf) > 0 {
+		p.buf = p.buf[1:]
+	}
+	return tok
+}
+
+// describe renders a token for use in error messages.
+func describe(tok Token) string {
+	if tok.Kind == KindEOF {
+		return "end of file"
+	}
+	return "'" + tok.Value + "'"
+}
+
+// kindName renders a token kind for use in error messages: the spelling
+// of a keyword or punctuation token, or else what the token is.
+func kindName(kind TokenKind) string {
+	switch kind {
+	case KindID:
+		return "identifier"
+	case KindNumber:
+		return "integer literal"
+	case KindStr:
+		return "string literal"
+	case KindCharLit:
+		return "character literal"
+	}
+	for word, k := range keywords {
+		if k == kind {
+			return "'" + word + "'"
+		}
+	}
+	for _, spec := range tokenSpec {
+		if punct := strings.TrimPrefix(spec.Pattern, `\`); spec.Kind == kind && len(punct) == 1 {
+			return "'" + punct + "'"
+		}
+	}
+	return kind.String()
+}
+
+// expectOp consumes an OP token that must be exactly op.
+func (p *Parser) expectOp(op string) Token {
+	tok := p.peek()
+	if tok.Kind != KindOp || tok.Value != op {
+		p.errorf(tok.Pos, "expected '%s', got %s", op, describe(tok))
+	}
+	return p.consume(KindOp)
+}
+
+func (p *Parser) errorf(pos Pos, format string, args ...interface{}) {
+	panic(&ParseError{Pos: pos, Msg: fmt.Sprintf(format, args...)})
+}
+
+func (p *Parser) ParseProgram() *Program {
+	prog := &Program{}
+	for p.peek().Kind != KindEOF {
+		doc := p.parseDoc()
+		switch p.peek().Kind {
+		case KindExtern:
+			prog.Decls = append(prog.Decls, p.ParseExtern())
+		case KindTypedef:
+			prog.Decls = append(prog.Decls, p.ParseTypedef())
+		default:
+			if fn := p.ParseFunction(); fn != nil {
+				fn.Doc = doc
+				prog.Decls = append(prog.Decls, fn)
+			}
+		}
+	}
+	return prog
+}
+
+// typeKinds lists the token kinds that begin a type.
+var typeKinds = map[TokenKind]bool{
+	KindInt:    true,
+	KindInt8:   true,
+	KindInt16:  true,
+	KindInt32:  true,
+	KindInt64:  true,
+	KindUint:   true,
+	KindUint8:  true,
+	KindUint16: true,
+	KindUint32: true,
+	KindUint64: true,
+	KindChar:   true,
+	KindString: true,
+	KindFloat:  true,
+	KindDouble: true,
+}
+
+// parseDoc consumes consecutive /// comments and returns their text.
+func (p *Parser) parseDoc() []string {
+	var doc []string
+	for p.peek().Kind == KindDoc {
+		text := strings.TrimPrefix(p.consume(KindDoc).Value, "///")
+		doc = append(doc, strings.TrimPrefix(text, " "))
+	}
+	return doc
+}
+
+// isType reports whether tok begins a type.
+func (p *Parser) isType(tok Token) bool {
+	return p.isBaseType(tok) || tok.Kind == KindConst
+}
+
+// isBaseType reports whether tok names a type on its own, without
+// qualifiers.
+func (p *Parser) isBaseType(tok Token) bool {
+	return typeKinds[tok.Kind] || tok.Kind == KindID && p.aliases[tok.Value]
+}
+
+// ParseType parses a type: a base type, optionally const, and any number
+// of pointer levels, each optionally const. As in C, `const int *p`
+// points to a const int, and `int *const p` is a pointer that is itself
+// const. The type is spelled "const int*" and "int*const" respectively.
+func (p *Parser) ParseType() string {
+	typ := ""
+	if p.peek().Kind == KindConst {
+		p.next()
+		typ = "const "
+	}
+	tok := p.peek()
+	if !p.isBaseType(tok) {
+		p.errorf(tok.Pos, "expected type, got %s", describe(tok))
+	}
+	typ += p.next().Value
+	for isStars(p.peek()) {
+		typ += p.consume(KindOp).Value
+		if p.peek().Kind == KindConst {
+			p.next()
+			typ += "const"
+		}
+	}
+	return typ
+}
+
+// isStars reports whether tok is a '*' of a pointer type. The lexer reads
+// the ** of char** as the power operator, which in a type is two '*'.
+func isStars(tok Token) bool {
+	return tok.Kind == KindOp && (tok.Value == "*" || tok.Value == "**")
+}
+
+func (p *Parser) ParseExtern() *ExternDecl {
+	pos := p.consume(KindExtern).Pos
+	ret := p.ParseType()
+	name := p.consume(KindID).Value
+	params := p.parseParams(false)
+	p.consume(KindSemi)
+	return &ExternDecl{Name: name, Ret: ret, Params: params, Pos: pos}
+}
+
+// ParseTypedef parses `typedef <type> name;` and makes name usable as a
+// type in the rest of the file.
+func (p *Parser) ParseTypedef() *TypeAlias {
+	pos := p.consume(KindTypedef).Pos
+	typ := p.ParseType()
+	name := p.consume(KindID).Value
+	p.consume(KindSemi)
+	if p.aliases == nil {
+		p.aliases = map[string]bool{}
+	}
+	p.aliases[name] = true
+	return &TypeAlias{Name: name, Type: typ, Pos: pos}
+}
+
+// parseParams parses a parenthesized parameter list. Names are optional
+// unless named is set.
+func (p *Parser) parseParams(named bool) []Param {
+	p.consume(KindLParen)
+	var params []Param
+	// A trailing comma before the closing paren is allowed.
+	for p.peek().Kind != KindRParen {
+		param := Param{Pos: p.peek().Pos, Type: p.ParseType()}
+		if named || p.peek().Kind == KindID {
+			param.Name = p.consume(KindID).Value
+		}
+		params = append(params, param)
+		if p.peek().Kind != KindComma {
+			break
+		}
+		p.consume(KindComma)
+	}
+	p.consume(KindRParen)
+	return params
+}
+
+// ParseFunction parses a function definition. An error in the header is
+// recorded as a malformed signature and the parser skips past the function,
+// returning nil, so that the functions after it are still parsed.
+func (p *Parser) ParseFunction() *Function {
+	fn := &Function{Pos: p.peek().Pos}
+	if !p.tryParse(func() {
+		fn.Ret = p.ParseType()
+		fn.Name = p.consume(KindID).Value
+		fn.Params = p.parseParams(true)
+	}) {
+		p.skipToDecl()
+		return nil
+	}
+	fn.Body, fn.End = p.parseBlockBody("function")
+	return fn
+}
+
+// tryParse runs parse, recording a syntax error in it as a malformed
+// function signature and reporting whether it succeeded.
+func (p *Parser) tryParse(parse func()) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			perr, isParseErr := r.(*ParseError)
+			if !isParseErr {
+				panic(r)
+			}
+			p.errs = append(p.errs, &ParseError{
+				Pos:   perr.Pos,
+				Msg:   "malformed function signature: " + perr.Msg,
+				Token: perr.Token,
+			})
+			ok = false
+		}
+	}()
+	parse()
+	return true
+}
+
+// skipToDecl resynchronizes after a malformed header: it skips to the end
+// of the function's braced body, or stops early at the start of the next
+// top-level declaration.
+func (p *Parser) skipToDecl() {
+	for depth := 0; ; {
+		tok := p.peek()
+		switch {
+		case tok.Kind == KindEOF:
+			return
+		case depth == 0 && (tok.Kind == KindExtern || tok.Kind == KindTypedef || p.atFuncStart()):
+			return
+		case tok.Kind == KindLBrace:
+			depth++
+		case tok.Kind == KindRBrace && depth > 0:
+			depth--
+			if depth == 0 {
+				p.consume(KindRBrace)
+				return
+			}
+		}
+		p.next()
+	}
+}
+
+// atFuncStart reports whether the next tokens look like the start of a
+// function definition: a type, a name and '('. No statement starts so.
+func (p *Parser) atFuncStart() bool {
+	i := 0
+	if p.peek().Kind == KindConst {
+		i++
+	}
+	if !p.isBaseType(p.peekAt(i)) {
+		return false
+	}
+	i++
+	for tok := p.peekAt(i); isStars(tok) || tok.Kind == KindConst; tok = p.peekAt(i) {
+		i++
+	}
+	return p.peekAt(i).Kind == KindID && p.peekAt(i+1).Kind == KindLParen
+}
+
+// parseBlockBody parses `{ stmt* }` and returns the statements and the
+// position of the closing brace. what names the construct it belongs to
+// for the error reported when the closing brace is missing.
+func (p *Parser) parseBlockBody(what string) ([]Node, Pos) {
+	start := p.consume(KindLBrace).Pos
+	var stmts []Node
+	for p.peek().Kind != KindRBrace {
+		// A missing '}' runs into the end of the file or the next
+		// function. Record it and let the caller carry on from there;
+		// enclosing blocks hit the same spot and need not report it again.
+		if tok := p.peek(); tok.Kind == KindEOF || p.atFuncStart() {
+			if n := len(p.errs); n == 0 || p.errs[n-1].Pos != tok.Pos {
+				p.errs = append(p.errs, &ParseError{
+					Pos:   tok.Pos,
+					Msg:   fmt.Sprintf("unbalanced braces: expected '}' to close %s starting at %s", what, start),
+					Token: tok,
+				})
+			}
+			return stmts, tok.Pos
+		}
+		// Doc comments only document functions; elsewhere they are plain
+		// comments.
+		if p.peek().Kind == KindDoc {
+			p.consume(KindDoc)
+			continue
+		}
+		stmts = append(stmts, p.ParseStatement())
+	}
+	return stmts, p.consume(KindRBrace).Pos
+}
+
+func (p *Parser) ParseStatement() Node {
+	tok := p.peek()
+	if p.isType(tok) {
+		decl := &VarDecl{Type: p.ParseType(), Name: p.consume(KindID).Value, Pos: tok.Pos}
+		if p.peek().Kind == KindLBracket {
+			p.consume(KindLBracket)
+			decl.Array = true
+			if p.peek().Kind != KindRBracket {
+				size := p.consume(KindNumber)
+				// Sizes are spelled like any integer literal: 0x10, 8U.
+				text, _ := splitIntSuffix(size.Value)
+				n, err := strconv.ParseInt(text, 0, 64)
+				if err != nil || n == 0 {
+					p.errorf(size.Pos, "array size must be a positive integer, got %s", size.Value)
+				}
+				decl.Len = int(n)
+			}
+			p.consume(KindRBracket)
+		}
+		if p.peek().Kind == KindOp && p.peek().Value == "=" {
+			p.consume(KindOp)
+			if decl.Array && p.peek().Kind == KindLBrace {
+				decl.Expr = p.parseArrayLit()
+			} else {
+				decl.Expr = p.parseAssign()
+			}
+		}
+		p.consume(KindSemi)
+		return decl
+	}
+	switch tok.Kind {
+	case KindSemi:
+		p.consume(KindSemi)
+		return &EmptyStmt{Pos: tok.Pos}
+	case KindLBrace:
+		body, end := p.parseBlockBody("block")
+		return &Block{Body: body, Pos: tok.Pos, End: end}
+	case KindReturn:
+		p.consume(KindReturn)
+		expr := p.ParseExpression()
+		p.consume(KindSemi)
+		return &Return{Expr: expr, Pos: tok.Pos}
+	case KindIf:
+		p.consume(KindIf)
+		stmt := &If{Cond: p.parseCond(), Then: p.parseBody(), Pos: tok.Pos}
+		if p.peek().Kind == KindElse {
+			p.consume(KindElse)
+			if p.peek().Kind == KindIf {
+				stmt.Else = p.ParseStatement()
+			} else {
+				stmt.Else = p.parseBody()
+			}
+		}
+		return stmt
+	case KindWhile:
+		p.consume(KindWhile)
+		return &While{Cond: p.parseCond(), Body: p.parseBody(), Pos: tok.Pos}
+	case KindStaticAssert:
+		p.consume(KindStaticAssert)
+		p.consume(KindLParen)
+		expr := p.parseTernary()
+		p.consume(KindComma)
+		if p.peek().Kind != KindStr {
+			p.errorf(p.peek().Pos, "static_assert message must be a string literal, got %s", describe(p.peek()))
+		}
+		msg := p.parsePrimary().(*StringLit)
+		p.consume(KindRParen)
+		p.consume(KindSemi)
+		return &StaticAssert{Expr: expr, Msg: msg, Pos: tok.Pos}
+	case KindAssert:
+		p.consume(KindAssert)
+		p.consume(KindLParen)
+		expr := p.parseAssign()
+		p.consume(KindRParen)
+		p.consume(KindSemi)
+		return &Assert{Expr: expr, Pos: tok.Pos}
+	case KindBreak, KindContinue:
+		p.consume(tok.Kind)
+		var label string
+		if p.peek().Kind == KindID {
+			label = p.consume(KindID).Value
+		}
+		p.consume(KindSemi)
+		if tok.Kind == KindBreak {
+			return &Break{Label: label, Pos: tok.Pos}
+		}
+		return &Continue{Label: label, Pos: tok.Pos}
+	case KindID:
+		if p.peekAt(1).Kind == KindColon {
+			p.consume(KindID)
+			p.consume(KindColon)
+			if p.peek().Kind != KindWhile {
+				p.errorf(p.peek().Pos, "label '%s' must be followed by a loop, got %s", tok.Value, describe(p.peek()))
+			}
+			loop := p.ParseStatement().(*While)
+			loop.Label = tok.Value
+			return loop
+		}
+		expr := p.ParseExpression()
+		p.consume(KindSemi)
+		return &ExprStmt{Expr: expr, Pos: tok.Pos}
+	default:
+		panic(&ParseError{
+			Pos:   tok.Pos,
+			Msg:   fmt.Sprintf("unexpected token %s at start of statement", describe(tok)),
+			Token: tok,
+		})
+	}
+}
+
+// binaryPrec gives the binding strength of each binary operator; higher
+// binds tighter. All of them but ** are left-associative.
+var binaryPrec = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"==": 3,
+	"!=": 3,
+	"<":  4,
+	">":  4,
+	"<=": 4,
+	">=": 4,
+	"<<": 5,
+	">>": 5,
+	"+":  6,
+	"-":  6,
+	"*":  7,
+	"/":  7,
+	"**": 8,
+}
+
+// parseCond parses the parenthesized condition of an if or while.
+func (p *Parser) parseCond() Node {
+	p.consume(KindLParen)
+	cond := p.ParseExpression()
+	p.consume(KindRParen)
+	return cond
+}
+
+// parseBody parses the body of an if, else or while. A lone statement is
+// wrapped in a Block so that it gets its own scope, as it will in C.
+func (p *Parser) parseBody() Node {
+	stmt := p.ParseStatement()
+	if _, ok := stmt.(*Block); ok {
+		return stmt
+	}
+	return &Block{Body: []Node{stmt}, Pos: nodePos(stmt)}
+}
+
+// ParseExpression parses a full expression, including the comma operator.
+// Contexts where a comma separates items, such as call arguments, use
+// parseTernary instead.
+func (p *Parser) ParseExpression() Node {
+	expr := p.parseAssign()
+	if p.peek().Kind != KindComma {
+		return expr
+	}
+	comma := &Comma{Exprs: []Node{expr}, Pos: p.peek().Pos}
+	for p.peek().Kind == KindComma {
+		p.consume(KindComma)
+		comma.Exprs = append(comma.Exprs, p.parseAssign())
+	}
+	return comma
+}
+
+// parseAssign parses an assignment, `target = value`, which binds more
+// loosely than anything but the comma operator and groups to the right.
+func (p *Parser) parseAssign() Node {
+	target := p.parseTernary()
+	if tok := p.peek(); tok.Kind == KindOp && tok.Value == "=" {
+		p.consume(KindOp)
+		return &Assign{Target: target, Expr: p.parseAssign(), Pos: nodePos(target)}
+	}
+	return target
+}
+
+// parseTernary parses a conditional expression, `cond ? a : b`, which binds
+// more loosely than any binary operator and groups to the right.
+func (p *Parser) parseTernary() Node {
+	cond := p.parseBinary(1)
+	if p.peek().Kind != KindQuestion {
+		return cond
+	}
+	pos := p.consume(KindQuestion).Pos
+	then := p.ParseExpression()
+	p.consume(KindColon)
+	return &Ternary{Cond: cond, Then: then, Else: p.parseTernary(), Pos: pos}
+}
+
+// parseBinary parses a chain of binary operators binding at least as tightly
+// as minPrec, using precedence climbing. ** groups to the right, so that
+// 2 ** 3 ** 2 is 2 ** (3 ** 2).
+func (p *Parser) parseBinary(minPrec int) Node {
+	left := p.parseUnary()
+	for {
+		tok := p.peek()
+		prec, ok := binaryPrec[tok.Value]
+		if tok.Kind != KindOp || !ok || prec < minPrec {
+			return left
+		}
+		op := p.consume(KindOp)
+		next := prec + 1
+		if op.Value == "**" {
+			next = prec
+		}
+		right := p.parseBinary(next)
+		left = &BinOp{Op: op.Value, Left: left, Right: right, Pos: op.Pos}
+	}
+}
+
+// parseUnary parses an operand with any number of prefix operators, which
+// bind more tightly than binary ones but less than subscripts.
+func (p *Parser) parseUnary() Node {
+	if tok := p.peek(); tok.Kind == KindOp && tok.Value == "~" {
+		p.consume(KindOp)
+		return &Unary{Op: tok.Value, Expr: p.parseUnary(), Pos: tok.Pos}
+	}
+	return p.parsePostfix()
+}
+
+// parsePostfix parses an operand followed by any number of subscripts.
+func (p *Parser) parsePostfix() Node {
+	expr := p.parsePrimary()
+	for p.peek().Kind == KindLBracket {
+		pos := p.consume(KindLBracket).Pos
+		index := p.ParseExpression()
+		p.consume(KindRBracket)
+		expr = &Index{Array: expr, Index: index, Pos: pos}
+	}
+	return expr
+}
+
+func (p *Parser) parsePrimary() Node {
+	switch p.peek().Kind {
+	case KindLParen:
+		p.consume(KindLParen)
+		expr := p.ParseExpression()
+		p.consume(KindRParen)
+		return expr
+	case KindNumber:
+		tok := p.consume(KindNumber)
+		text, suffix := splitIntSuffix(tok.Value)
+		// Base 0 follows the prefix: 0x, 0b, or 0 for octal.
+		num, err := strconv.ParseInt(text, 0, 64)
+		if errors.Is(err, strconv.ErrRange) {
+			p.errorf(tok.Pos, "integer literal %s is too large", tok.Value)
+		} else if err != nil {
+			p.errorf(tok.Pos, "invalid digit in octal literal %s", tok.Value)
+		}
+		lit := &Number{Value: int(num), Pos: tok.Pos, Suffix: suffix}
+		if base := literalBase(text); base != 10 {
+			lit.Base, lit.Raw = base, text
+		}
+		return lit
+	case KindReal:
+		tok := p.consume(KindReal)
+		v, err := strconv.ParseFloat(tok.Value, 64)
+		if err != nil {
+			p.errorf(tok.Pos, "floating-point literal %s is out of range", tok.Value)
+		}
+		return &FloatLit{Value: v, Pos: tok.Pos}
+	case KindCharLit:
+		tok := p.consume(KindCharLit)
+		// The lexer has already rejected malformed literals.
+		v, _ := decodeChar(tok.Value, tok.Pos)
+		return &CharLit{Value: v, Pos: tok.Pos}
+	case KindStr:
+		tok := p.consume(KindStr)
+		lit := &StringLit{Value: tok.Value[1 : len(tok.Value)-1], Pos: tok.Pos}
+		// Adjacent literals are concatenated, as in C.
+		for p.peek().Kind == KindStr {
+			val := p.consume(KindStr).Value
+			lit.Value = joinStringLits(lit.Value, val[1:len(val)-1])
+		}
+		return lit
+	}
+	tok := p.peek()
+	if tok.Kind != KindID {
+		p.errorf(tok.Pos, "expected expression, got %s", describe(tok))
+	}
+	p.consume(KindID)
+	if p.peek().Kind == KindLParen {
+		return p.parseCall(tok)
+	}
+	return &Ident{Name: tok.Value, Pos: tok.Pos}
+}
+
+// intSuffixTypes maps each integer literal suffix to the literal's type.
+var intSuffixTypes = map[string]string{"": "int", "U": "uint", "L": "int64", "UL": "uint64"}
+
+// splitIntSuffix splits an integer literal into its digits and its
+// suffix, spelled as intSuffixTypes does.
+func splitIntSuffix(lit string) (string, string) {
+	end := len(lit)
+	for end > 0 && strings.ContainsRune("uUlL", rune(lit[end-1])) {
+		end--
+	}
+	suffix := strings.ToUpper(lit[end:])
+	if suffix == "LU" {
+		suffix = "UL"
+	}
+	return lit[:end], suffix
+}
+
+// literalBase returns the base an integer literal is written in.
+func literalBase(lit string) int {
+	switch {
+	case len(lit) > 1 && (lit[1] == 'x' || lit[1] == 'X'):
+		return 16
+	case len(lit) > 1 && (lit[1] == 'b' || lit[1] == 'B'):
+		return 2
+	case len(lit) > 1 && lit[0] == '0':
+		return 8
+	}
+	return 10
+}
+
+// openEscape matches a hex or octal escape at the end of a literal that a
+// following digit would extend.
+var openEscape = regexp.MustCompile(`(^|[^\\])(\\\\)*\\(x[0-9A-Fa-f]*|[0-7]{1,2})$`)
+
+// parseArrayLit parses a brace-enclosed initializer list. A trailing comma
+// before the closing brace is allowed.
+func (p *Parser) parseArrayLit() *ArrayLit {
+	lit := &ArrayLit{Pos: p.consume(KindLBrace).Pos}
+	for p.peek().Kind != KindRBrace {
+		lit.Elems = append(lit.Elems, p.parseAssign())
+		if p.peek().Kind != KindComma {
+			break
+		}
+		p.consume(KindComma)
+	}
+	p.consume(KindRBrace)
+	return lit
+}
+
+// joinStringLits concatenates the source text of two string literals. If a
+// trailing escape in a would swallow leading digits of b, the pieces stay
+// separate C literals ("a""b") so the compiler still splits them.
+func joinStringLits(a, b string) string {
+	if b != "" && strings.ContainsRune("0123456789abcdefABCDEF", rune(b[0])) && openEscape.MatchString(a) {
+		return a + `""` + b
+	}
+	return a + b
+}
+
+func (p *Parser) parseCall(name Token) *Call {
+	p.consume(KindLParen)
+	var args []Node
+	// A trailing comma before the closing paren is allowed.
+	for p.peek().Kind != KindRParen {
+		args = append(args, p.parseAssign())
+		if p.peek().Kind != KindComma {
+			break
+		}
+		p.consume(KindComma)
+	}
+	p.consume(KindRParen)
+	return &Call{Name: name.Value, Args: args, Pos: name.Pos}
+}
+
+// -------------------------------
+// AST Dump
+// -------------------------------
+
+// DumpAST renders n as an indented tree with one node per line. With hex
+// set, integer literals are shown in hexadecimal next to their decimal value.
+func DumpAST(n Node, hex bool) string {
+	var sb strings.Builder
+	dumpNode(&sb, n, 0, hex)
+	return sb.String()
+}
+
+func dumpNode(sb *strings.Builder, n Node, depth int, hex bool) {
+	label, children := describeNode(n, hex)
+	sb.WriteString(strings.Repeat("  ", depth) + label + "\n")
+	for _, child := range children {
+		dumpNode(sb, child, depth+1, hex)
+	}
+}
+
+// describeNode returns the one-line label for n used by the AST dumps, and
+// its children.
+func describeNode(n Node, hex bool) (label string, children []Node) {
+	switch n := n.(type) {
+	case *Number:
+		switch {
+		case hex:
+			label = fmt.Sprintf("Number %d (%#x)", n.Value, n.Value)
+		case n.Raw != "" || n.Suffix != "":
+			raw := n.Raw
+			if raw == "" {
+				raw = strconv.Itoa(n.Value)
+			}
+			label = fmt.Sprintf("Number %d (%s)", n.Value, raw+n.Suffix)
+		default:
+			label = fmt.Sprintf("Number %d", n.Value)
+		}
+	case *Ident:
+		label = fmt.Sprintf("Ident %s", n.Name)
+	case *StringLit:
+		label = fmt.Sprintf("String \"%s\"", n.Value)
+	case *CharLit:
+		label = fmt.Sprintf("Char %s (%d)", cCharLit(n.Value), n.Value)
+	case *FloatLit:
+		label = fmt.Sprintf("Float %g", n.Value)
+	case *Program:
+		label = "Program"
+	case *ExternDecl:
+		var params []string
+		for _, param := range n.Params {
+			params = append(params, strings.TrimSpace(param.Type+" "+param.Name))
+		}
+		label = fmt.Sprintf("Extern %s(%s) -> %s", n.Name, strings.Join(params, ", "), n.Ret)
+	case *TypeAlias:
+		label = fmt.Sprintf("TypeAlias %s = %s", n.Name, n.Type)
+	case *Function:
+		var params []string
+		for _, param := range n.Params {
+			params = append(params, param.Type+" "+param.Name)
+		}
+		label = fmt.Sprintf("Function %s(%s) -> %s", n.Name, strings.Join(params, ", "), n.Ret)
+	case *Return:
+		label = "Return"
+	case *VarDecl:
+		switch {
+		case n.Array && n.Len > 0:
+			label = fmt.Sprintf("VarDecl %s %s[%d]", n.Type, n.Name, n.Len)
+		case n.Array:
+			label = fmt.Sprintf("VarDecl %s %s[]", n.Type, n.Name)
+		default:
+			label = fmt.Sprintf("VarDecl %s %s", n.Type, n.Name)
+		}
+	case *Assign:
+		// A variable target is shown in the label rather than as a child.
+		if target, ok := n.Target.(*Ident); ok {
+			return fmt.Sprintf("Assign %s", target.Name), []Node{n.Expr}
+		}
+		label = "Assign"
+	case *ExprStmt:
+		label = "ExprStmt"
+	case *Block:
+		label = "Block"
+	case *EmptyStmt:
+		label = "EmptyStmt"
+	case *If:
+		label = "If"
+	case *While:
+		label = strings.TrimSpace("While " + n.Label)
+	case *Break:
+		label = strings.TrimSpace("Break " + n.Label)
+	case *Continue:
+		label = strings.TrimSpace("Continue " + n.Label)
+	case *StaticAssert:
+		label = "StaticAssert"
+	case *Assert:
+		label = "Assert"
+	case *Call:
+		label = fmt.Sprintf("Call %s", n.Name)
+	case *BinOp:
+		label = fmt.Sprintf("BinOp(%s)", n.Op)
+		if n.Op == "/" && n.Type != "" {
+			// Whether a division truncates depends on its type.
+			label += " " + n.Type
+		}
+	case *Unary:
+		label = fmt.Sprintf("Unary(%s)", n.Op)
+	case *Comma:
+		label = "Comma"
+	case *Ternary:
+		label = "Ternary"
+	case *ArrayLit:
+		label = "ArrayLit"
+	case *Index:
+		label = "Index"
+	default:
+		label = fmt.Sprintf("%T", n)
+	}
+	return label, Children(n)
+}
+
+// -------------------------------
+// Semantic Checks
+// -------------------------------
+
+type Severity int
+
+const (
+	Warning Severity = iota
+	Error
+)
+
+func (s Severity) String() string {
+	if s == Error {
+		return "error"
+	}
+	return "warning"
+}
+
+type Diagnostic struct {
+	Pos      Pos
+	Severity Severity
+	Message  string
+	// Category names the kind of warning, one of warningCategories or
+	// lintChecks, so that --werror can select it. Errors have none.
+	Category string
+	// Code names the kind of error, one of errorCodes, for --explain.
+	Code string
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s: %s: %s%s", d.Pos, d.Severity, d.Message, d.categorySuffix())
+}
+
+func (d Diagnostic) categorySuffix() string {
+	if d.Code != "" {
+		return " [" + d.Code + "]"
+	}
+	if d.Category == "" {
+		return ""
+	}
+	return " [" + d.Category + "]"
+}
+
+// suppress returns diags without those that one of pragmas silences.
+func suppress(diags []Diagnostic, pragmas []Pragma) []Diagnostic {
+	var kept []Diagnostic
+next:
+	for _, d := range diags {
+		for _, p := range pragmas {
+			if p.silences(d) {
+				continue next
+			}
+		}
+		kept = append(kept, d)
+	}
+	return kept
+}
+
+// sortDiagnostics orders diags by position, errors before warnings at
+// the same spot, so output does not depend on which phase found what.
+func sortDiagnostics(diags []Diagnostic) {
+	sort.SliceStable(diags, func(i, j int) bool {
+		a, b := diags[i], diags[j]
+		if a.Pos.Line != b.Pos.Line {
+			return a.Pos.Line < b.Pos.Line
+		}
+		if a.Pos.Col != b.Pos.Col {
+			return a.Pos.Col < b.Pos.Col
+		}
+		return a.Severity > b.Severity
+	})
+}
+
+// pragmaDiagnostics warns about categories in pragmas that do not exist.
+func pragmaDiagnostics(pragmas []Pragma) []Diagnostic {
+	var diags []Diagnostic
+	for _, p := range pragmas {
+		for _, category := range p.Categories {
+			_, warning := warningCategories[category]
+			_, check := lintChecks[category]
+			if !warning && !check {
+				diags = append(diags, Diagnostic{Pos: p.Pos, Severity: Warning, Message: "unknown warning category in lang:nowarn: " + category})
+			}
+		}
+	}
+	return diags
+}
+
+// warningCategories describes the warnings the checker and the C backend
+// report. The lint checks are categories too.
+var warningCategories = map[string]string{
+	"sign-compare": "comparisons of signed with unsigned integers",
+	"self-assign":  "assignments of a variable to itself",
+	"shadow":       "declarations hiding an outer one",
+	"ident-length": "identifiers longer than --max-ident-len",
+	"overflow":     "constant expressions overflowing their type",
+	"line-length":  "generated C lines longer than --max-c-line",
+}
+
+// errorCodes describes the errors, which keep their codes across
+// releases so that --explain and searches for them stay valid.
+var errorCodes = map[string]string{
+	"E0001": "syntax errors",
+	"E0002": "redeclarations",
+	"E0003": "calls to undeclared functions",
+	"E0004": "calls with the wrong number of arguments",
+	"E0005": "operands and values of the wrong type",
+	"E0006": "conversions that discard const",
+	"E0007": "assignments to something that cannot be assigned",
+	"E0008": "misplaced break, continue and loop labels",
+	"E0009": "failed static assertions",
+	"E0010": "main with the wrong parameters",
+	"E0011": "badly sized or initialized arrays",
+	"E0012": "bad print formats",
+	"E0013": "constants out of range for their type",
+}
+
+// explanations holds the text `lang --explain` prints for each error
+// code, warning category and lint check: what it catches, an example and
+// the fix.
+var explanations = map[string]string{
+	"E0001": `The source does not lex or parse: a character that starts no token,
+or tokens in an order the grammar does not allow.
+
+    return 1 +;
+
+Fix the code at the position reported; the message says what was
+expected there.`,
+	"E0002": `A name is declared twice in the same scope, or a type is defined twice.
+
+    int x = 1;
+    int x = 2;
+
+Rename one of them, or assign to the existing variable instead of
+declaring it again. An inner block may reuse a name, which is only
+warned about as shadow.`,
+	"E0003": `A function is called without being defined or declared first.
+
+    int main() { return f(); }
+
+Define the function above the call, or declare it with extern when it
+lives in another file or library.`,
+	"E0004": `A function is called with more or fewer arguments than it takes.
+
+    int add(int a, int b) { return a + b; }
+    int main() { return add(1); }
+
+Pass one argument for each parameter.`,
+	"E0005": `A value has a type its use does not allow: returning a string from a
+function returning int, shifting a double, or indexing with something
+other than an integer.
+
+    int f() { return "one"; }
+
+Convert the value, or change the declared type to match.`,
+	"E0006": `A pointer to const is stored in, passed as, or assigned to a pointer
+to non-const, which would allow writing through it.
+
+    const char* name = "lang";
+    char* p = name;
+
+Declare the target as a pointer to const too.`,
+	"E0007": `The target of an assignment cannot be assigned: a const variable, a
+whole array, an element of a string or const array, or something that
+is not a variable at all.
+
+    const int limit = 10;
+    limit = 20;
+
+Assign to a non-const variable or element instead, or drop the const.`,
+	"E0008": `A break or continue is outside any loop, names a label no enclosing
+loop has, or a label is used twice. Labeled loops also need
+--enable-labeled-loops.
+
+    int main() { break; }
+
+Move the statement into the loop it is meant for, and check the label.`,
+	"E0009": `A static_assert condition is false, or is not a constant the checker
+can evaluate.
+
+    static_assert(2 + 2 == 5, "arithmetic");
+
+Fix the code the assertion guards, or the assertion itself.`,
+	"E0010": `main takes parameters other than none or (int argc, char** argv),
+which is all the C runtime passes it.
+
+    int main(int n) { return n; }
+
+Use one of the two allowed forms.`,
+	"E0011": `An array has no size and no initializer list, a size of zero, more
+initializers than its size, or an initializer that is not a list.
+
+    int a[2] = {1, 2, 3};
+
+Make the size and the initializer list agree.`,
+	"E0012": `A print format is missing, is not a string literal, contains a
+conversion lang does not know, or does not match the number of
+arguments.
+
+    print("%d %d\n", x);
+
+Pass one argument for each conversion in a literal format string.`,
+	"E0013": `An integer literal does not fit in the type it is given.
+
+    int8 small = 300;
+
+Use a wider type, or a value within the range the message gives.`,
+	"sign-compare": `A comparison mixes a signed and an unsigned integer. C converts the
+signed operand to unsigned first, so a negative value compares as a
+huge positive one.
+
+    int x = 0 - 1;
+    if (x < 5U) { ... }    // false: x becomes 4294967295
+
+Make both operands the same signedness, or check for a negative value
+before comparing.`,
+	"self-assign": `A variable is assigned to itself, which does nothing. Usually another
+variable was meant on one side.
+
+    width = width;
+
+Assign the value that was intended, or remove the statement.`,
+	"shadow": `A declaration reuses the name of one in an enclosing scope, hiding it
+for the rest of the block. Reads and writes that look like they reach
+the outer variable reach the inner one instead.
+
+    int total = 0;
+    while (i < n) {
+        int total = i;    // a new total, gone after the loop
+    }
+
+Rename the inner variable, or assign to the outer one without
+declaring a new one.`,
+	"ident-length": `An identifier is longer than the limit set with --max-ident-len. Some
+C toolchains and style guides cap identifier length.
+
+Choose a shorter name, or raise or drop --max-ident-len.`,
+	"overflow": `A constant expression does not fit in its type. Signed overflow is
+undefined in C, so the result cannot be relied on.
+
+    int big = 2147483647 + 1;
+
+Use a wider type, such as int64 with an L suffix (2147483647L + 1), or
+smaller values.`,
+	"line-length": `A line of the generated C is longer than the limit set with
+--max-c-line, usually because of a long expression.
+
+Split the expression across statements, or raise or drop --max-c-line.`,
+	"unused": `A variable is declared but its value is never read. It may be left
+over from an edit, or another variable may be read by mistake.
+
+    int count = 0;
+    return 1;
+
+Use the variable or remove it. Parameters are never reported.`,
+	"unreachable": `A statement follows a return in the same block, so it never runs.
+
+    return x;
+    print_int(x);
+
+Move the statement before the return, or remove it.`,
+	"const-cond": `An if or while condition folds to a constant, so the branch is always
+or never taken.
+
+    if (1 == 2) { ... }
+
+Check the condition for a typo. For an infinite loop, lang:nowarn
+const-cond on the line says the constant is intended.`,
+	"int-div": `An integer division is stored in a float or double variable. The
+division truncates before the conversion, so the fraction is lost.
+
+    double half = 1 / 2;    // 0.0, not 0.5
+
+Make an operand floating-point, as in 1.0 / 2.`,
+	"int-cond": `An if or while condition is an integer expression, not a comparison.
+It is true when the value is nonzero, which is easy to misread. This
+check is off by default; turn it on with --enable int-cond.
+
+    if (count) { ... }
+
+Write the comparison out: if (count != 0).`,
+}
+
+// explain prints the explanation of the error code, warning category or
+// lint check name and returns the exit status.
+func explain(w io.Writer, name string) int {
+	text, ok := explanations[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "no explanation for %q; see lang --help for the error codes, warning categories and lint checks\n", name)
+		return 1
+	}
+	fmt.Fprintf(w, "%s\n\n%s\n", name, text)
+	return 0
+}
+
+// symbol is a declared variable as seen by the checker.
+type symbol struct {
+	Type string
+	Pos  Pos
+}
+
+// SymbolEntry is one declaration seen by the checker, as listed by
+// --dump-symbols. Kind is "function", "extern", "type", "param" or "var",
+// and Scope is "global", the enclosing function's name, or that name and
+// the depth of the block the declaration is in.
+type SymbolEntry struct {
+	Name  string
+	Kind  string
+	Type  string
+	Scope string
+	Pos   Pos
+}
+
+type Checker struct {
+	Diagnostics []Diagnostic
+	// Symbols lists every declaration in the order it was checked.
+	Symbols []SymbolEntry
+
+	// NoPrelude mirrors C99Generator.NoPrelude.
+	NoPrelude bool
+
+	// Werror reports every warning as an error, and ErrorCategories
+	// those of the categories it holds.
+	Werror          bool
+	ErrorCategories map[string]bool
+
+	// MaxIdentLen, when positive, warns about declared names longer than it.
+	MaxIdentLen int
+
+	// LabeledLoops allows the labeled break and continue extension.
+	LabeledLoops bool
+
+	// scopes maps each visible variable to its declaration, innermost last.
+	scopes []map[string]*symbol
+	// funcs holds the signature of every declared function.
+	funcs map[string]*funcSig
+	// aliases maps each typedef name to its declaration.
+	aliases map[string]*TypeAlias
+	// fn is the function being checked.
+	fn *Function
+	// loops holds the label of each enclosing loop, innermost last, and
+	// labels every loop label used so far in fn.
+	loops  []string
+	labels map[string]bool
+	// known holds what Fold knows of each visible variable, innermost
+	// scope last.
+	known []map[string]knownVar
+}
+
+// knownVar is a variable as seen by Fold: lit is the literal it holds, or
+// nil if that is not known or its type does not allow propagating it.
+type knownVar struct {
+	propagates bool
+	lit        Node
+}
+
+type funcSig struct {
+	Ret    string
+	Params []Param
+	// builtin marks prelude functions, whose arguments are checked
+	// separately.
+	builtin bool
+}
+
+func (c *Checker) Check(n Node) {
+	switch n := n.(type) {
+	case *Program:
+		c.funcs = map[string]*funcSig{}
+		c.aliases = map[string]*TypeAlias{}
+		if !c.NoPrelude {
+			for name := range prelude {
+				c.funcs[name] = &funcSig{Ret: "int", builtin: true}
+			}
+		}
+		for _, decl := range n.Decls {
+			switch decl := decl.(type) {
+			case *TypeAlias:
+				if prev, ok := c.aliases[decl.Name]; ok {
+					c.errorf(decl.Pos, "E0002", "redefinition of type '%s' (previous definition at %s)", decl.Name, prev.Pos)
+				}
+				c.aliases[decl.Name] = decl
+				c.checkIdent(decl.Name, decl.Pos)
+				c.record("type", decl.Name, decl.Type, decl.Pos)
+			case *ExternDecl:
+				c.funcs[decl.Name] = &funcSig{Ret: c.resolve(decl.Ret), Params: decl.Params}
+				c.checkIdent(decl.Name, decl.Pos)
+				c.record("extern", decl.Name, c.funcType(decl.Ret, decl.Params), decl.Pos)
+				for _, param := range decl.Params {
+					c.checkIdent(param.Name, param.Pos)
+				}
+			case *Function:
+				c.funcs[decl.Name] = &funcSig{Ret: c.resolve(decl.Ret), Params: decl.Params}
+				c.checkIdent(decl.Name, decl.Pos)
+				c.record("function", decl.Name, c.funcType(decl.Ret, decl.Params), decl.Pos)
+			}
+		}
+		for _, decl := range n.Decls {
+			c.Check(decl)
+		}
+	case *Function:
+		c.fn = n
+		c.labels = map[string]bool{}
+		if n.Name == "main" {
+			c.checkMain(n)
+		}
+		c.pushScope()
+		for _, param := range n.Params {
+			c.declare("param", param.Name, c.resolve(param.Type), param.Pos)
+			c.checkIdent(param.Name, param.Pos)
+		}
+		for _, stmt := range n.Body {
+			c.Check(stmt)
+		}
+		c.popScope()
+	case *VarDecl:
+		typ := c.resolve(n.Type)
+		if n.Array {
+			c.checkArrayInit(n, unqualified(typ))
+			typ += "[]"
+		} else if n.Expr != nil {
+			value := unqualified(typ)
+			adaptLiteral(n.Expr, value)
+			if from := c.expr(n.Expr, n.Pos); discardsConst(from, value) {
+				c.errorf(nodePos(n.Expr), "E0006", "initializing '%s' of type %s with %s discards const", n.Name, typ, from)
+			}
+			c.checkRange(n.Expr, value, n.Pos)
+		}
+		c.declare("var", n.Name, typ, n.Pos)
+		c.checkIdent(n.Name, n.Pos)
+	case *Return:
+		adaptLiteral(n.Expr, unqualified(c.resolve(c.fn.Ret)))
+		typ, ret := c.expr(n.Expr, n.Pos), c.resolve(c.fn.Ret)
+		if !convertible(typ, ret) {
+			c.errorf(n.Pos, "E0005", "cannot return %s from function '%s' returning %s", typ, c.fn.Name, c.fn.Ret)
+		}
+	case *ExprStmt:
+		c.expr(n.Expr, n.Pos)
+	case *If:
+		c.expr(n.Cond, n.Pos)
+		c.Check(n.Then)
+		if n.Else != nil {
+			c.Check(n.Else)
+		}
+	case *While:
+		c.expr(n.Cond, n.Pos)
+		if n.Label != "" {
+			c.checkLabelsEnabled(n.Pos)
+			if c.labels[n.Label] {
+				c.errorf(n.Pos, "E0008", "duplicate loop label '%s'", n.Label)
+			}
+			c.labels[n.Label] = true
+		}
+		c.loops = append(c.loops, n.Label)
+		c.Check(n.Body)
+		c.loops = c.loops[:len(c.loops)-1]
+	case *Break:
+		c.checkJump("break", n.Label, n.Pos)
+	case *Continue:
+		c.checkJump("continue", n.Label, n.Pos)
+	case *StaticAssert:
+		c.expr(n.Expr, n.Pos)
+		v, ok := constValue(n.Expr)
+		if !ok {
+			c.errorf(n.Pos, "E0009", "static_assert expression is not an integer constant")
+		} else if v.Sign() == 0 {
+			c.errorf(n.Pos, "E0009", "static assertion failed: \"%s\"", n.Msg.Value)
+		}
+	case *Assert:
+		c.expr(n.Expr, n.Pos)
+	case *Block:
+		c.pushScope()
+		for _, stmt := range n.Body {
+			c.Check(stmt)
+		}
+		c.popScope()
+	}
+}
+
+// intType describes the width and signedness of an integer type.
+type intType struct {
+	Bits     int
+	Unsigned bool
+}
+
+var intTypes = map[string]intType{
+	"char":   {8, false},
+	"int8":   {8, false},
+	"int16":  {16, false},
+	"int32":  {32, false},
+	"int":    {32, false},
+	"int64":  {64, false},
+	"uint8":  {8, true},
+	"uint16": {16, true},
+	"uint32": {32, true},
+	"uint":   {32, true},
+	"uint64": {64, true},
+}
+
+// promote applies C's integer promotions: anything narrower than int
+// becomes int.
+func promote(t intType) intType {
+	if t.Bits < 32 {
+		return intType{32, false}
+	}
+	return t
+}
+
+// arithType applies C's usual arithmetic conversions to two integer types.
+func arithType(a, b intType) intType {
+	a, b = promote(a), promote(b)
+	if a.Unsigned == b.Unsigned {
+		if a.Bits >= b.Bits {
+			return a
+		}
+		return b
+	}
+	bits := a.Bits
+	if b.Bits > bits {
+		bits = b.Bits
+	}
+	unsigned := a.Unsigned && a.Bits >= b.Bits || b.Unsigned && b.Bits >= a.Bits
+	return intType{bits, unsigned}
+}
+
+// typeName returns the lang spelling of a promoted integer type.
+func (t intType) typeName() string {
+	name := "int"
+	if t.Bits == 64 {
+		name = "int64"
+	}
+	if t.Unsigned {
+		name = "u" + name
+	}
+	return name
+}
+
+var comparisonOps = map[string]bool{"==": true, "!=": true, "<": true, ">": true, "<=": true, ">=": true}
+
+// expr checks an expression and returns its type, or "" when unknown.
+// pos is the statement the expression belongs to.
+func (c *Checker) expr(n Node, pos Pos) string {
+	switch n := n.(type) {
+	case *Number:
+		return intSuffixTypes[n.Suffix]
+	case *StringLit:
+		return "string"
+	case *CharLit:
+		// As in C, a character literal is an int.
+		return "int"
+	case *FloatLit:
+		if n.Type != "" {
+			return n.Type
+		}
+		return "double"
+	case *Ident:
+		if sym := c.lookup(n.Name); sym != nil {
+			// Reading a const variable gives a plain value.
+			return unqualified(sym.Type)
+		}
+	case *Call:
+		args := make([]string, len(n.Args))
+		for i, arg := range n.Args {
+			args[i] = c.expr(arg, pos)
+		}
+		sig := c.funcs[n.Name]
+		switch {
+		case sig == nil:
+			c.errorf(n.Pos, "E0003", "call to undeclared function '%s'", n.Name)
+			return ""
+		case sig.builtin && (n.Name == "print" || n.Name == "debug_print"):
+			c.checkFormat(n)
+		case sig.builtin && len(n.Args) != 1:
+			c.errorf(n.Pos, "E0004", "%s expects 1 argument, got %d", n.Name, len(n.Args))
+		case sig.builtin && !builtinArgOK(n.Name, args[0]):
+			c.errorf(nodePos(n.Args[0]), "E0005", "%s takes %s, got %s; use print with a format instead", n.Name, builtinArgs[n.Name], args[0])
+		case !sig.builtin && len(n.Args) != len(sig.Params):
+			noun := "arguments"
+			if len(sig.Params) == 1 {
+				noun = "argument"
+			}
+			c.errorf(n.Pos, "E0004", "'%s' expects %d %s, got %d", n.Name, len(sig.Params), noun, len(n.Args))
+		case !sig.builtin:
+			for i, param := range sig.Params {
+				if typ := c.resolve(param.Type); discardsConst(args[i], typ) {
+					c.errorf(nodePos(n.Args[i]), "E0006", "passing %s as argument %d of '%s', which takes %s, discards const", args[i], i+1, n.Name, typ)
+				}
+			}
+		}
+		return unqualified(sig.Ret)
+	case *Ternary:
+		c.expr(n.Cond, pos)
+		n.Type = commonType(c.expr(n.Then, pos), c.expr(n.Else, pos))
+		return n.Type
+	case *BinOp:
+		lt, rt := c.expr(n.Left, pos), c.expr(n.Right, pos)
+		if n.Op == "&&" || n.Op == "||" {
+			n.Type = "int"
+			return n.Type
+		}
+		if n.Op == "**" {
+			// A power of two integers has their common type and is
+			// computed exactly; anything else goes through pow in double.
+			left, lint := intTypes[lt]
+			right, rint := intTypes[rt]
+			if !(floatTypes[lt] || lint) || !(floatTypes[rt] || rint) {
+				return ""
+			}
+			n.Type = "double"
+			if lint && rint {
+				n.Type = arithType(left, right).typeName()
+			}
+			return n.Type
+		}
+		if floatTypes[lt] || floatTypes[rt] {
+			return c.floatBinOp(n, lt, rt)
+		}
+		left, lok := intTypes[lt]
+		right, rok := intTypes[rt]
+		if !lok || !rok {
+			return ""
+		}
+		if n.Op == "<<" || n.Op == ">>" {
+			// Shifts take the promoted type of the left operand alone.
+			n.Type = promote(left).typeName()
+			return n.Type
+		}
+		result := arithType(left, right)
+		if !comparisonOps[n.Op] {
+			n.Type = result.typeName()
+			return n.Type
+		}
+		if result.Unsigned && (!promote(left).Unsigned && !isNonNegativeLiteral(n.Left) ||
+			!promote(right).Unsigned && !isNonNegativeLiteral(n.Right)) {
+			c.warnf("sign-compare", n.Pos, "comparison of integers of different signs: '%s' and '%s'", lt, rt)
+		}
+		n.Type = "int"
+		return n.Type
+	case *Assign:
+		return c.assign(n)
+	case *Unary:
+		typ := c.expr(n.Expr, pos)
+		t, ok := intTypes[typ]
+		if !ok {
+			if typ != "" {
+				c.errorf(n.Pos, "E0005", "invalid operand to unary '%s': %s", n.Op, typ)
+			}
+			return ""
+		}
+		n.Type = promote(t).typeName()
+		return n.Type
+	case *Comma:
+		var typ string
+		for _, expr := range n.Exprs {
+			typ = c.expr(expr, pos)
+		}
+		return typ
+	case *Index:
+		typ := c.expr(n.Array, pos)
+		if _, ok := intTypes[c.expr(n.Index, pos)]; !ok {
+			c.errorf(n.Pos, "E0005", "array index is not an integer")
+		}
+		switch {
+		case typ == "string":
+			return "char"
+		case strings.HasSuffix(typ, "[]"):
+			return unqualified(strings.TrimSuffix(typ, "[]"))
+		case strings.HasSuffix(typ, "*"):
+			return unqualified(strings.TrimSuffix(typ, "*"))
+		case typ != "":
+			c.errorf(n.Pos, "E0005", "subscripted value of type %s is not an array or pointer", typ)
+		}
+	}
+	return ""
+}
+
+// assign checks an assignment and returns its type, the target's.
+func (c *Checker) assign(n *Assign) string {
+	var typ string
+	switch target := n.Target.(type) {
+	case *Ident:
+		if sym := c.lookup(target.Name); sym != nil {
+			typ = sym.Type
+		}
+		if strings.HasSuffix(typ, "[]") {
+			c.errorf(n.Pos, "E0007", "cannot assign to array '%s'", target.Name)
+		}
+		if isConst(typ) {
+			c.errorf(n.Pos, "E0007", "cannot assign to '%s', which is %s", target.Name, typ)
+			typ = unqualified(typ)
+		}
+		if id, ok := n.Expr.(*Ident); ok && id.Name == target.Name {
+			c.warnf("self-assign", n.Pos, "self-assignment of '%s' has no effect", target.Name)
+		}
+	case *Index:
+		typ = c.expr(target, n.Pos)
+		switch array := c.expr(target.Array, n.Pos); {
+		case array == "string":
+			c.errorf(n.Pos, "E0007", "cannot assign to a character of a string")
+		case strings.HasSuffix(array, "[]") && isConst(strings.TrimSuffix(array, "[]")):
+			c.errorf(n.Pos, "E0007", "cannot assign to an element of %s, a const array", array)
+		case strings.HasSuffix(array, "*") && isConst(strings.TrimSuffix(array, "*")):
+			c.errorf(n.Pos, "E0007", "cannot assign through %s, a pointer to const", array)
+		}
+	default:
+		c.errorf(n.Pos, "E0007", "expression is not assignable")
+		c.expr(target, n.Pos)
+	}
+	adaptLiteral(n.Expr, typ)
+	if from := c.expr(n.Expr, n.Pos); discardsConst(from, typ) {
+		c.errorf(n.Pos, "E0006", "assigning %s to %s discards const", from, typ)
+	}
+	c.checkRange(n.Expr, typ, n.Pos)
+	return typ
+}
+
+// checkJump checks that a break or continue is inside a loop, and that
+// the loop it names, if any, encloses it.
+func (c *Checker) checkJump(stmt, label string, pos Pos) {
+	if len(c.loops) == 0 {
+		c.errorf(pos, "E0008", "%s statement not within a loop", stmt)
+		return
+	}
+	if label == "" {
+		return
+	}
+	c.checkLabelsEnabled(pos)
+	for _, l := range c.loops {
+		if l == label {
+			return
+		}
+	}
+	c.errorf(pos, "E0008", "%s label '%s' does not name an enclosing loop", stmt, label)
+}
+
+func (c *Checker) checkLabelsEnabled(pos Pos) {
+	if !c.LabeledLoops {
+		c.errorf(pos, "E0008", "labeled loops are a language extension; enable them with --enable-labeled-loops")
+	}
+}
+
+// checkMain checks main's parameters against the two forms C allows:
+// none, or the argument count and vector, `int argc, char** argv`.
+func (c *Checker) checkMain(n *Function) {
+	if len(n.Params) == 0 {
+		return
+	}
+	if len(n.Params) == 2 && intTypes[c.resolve(n.Params[0].Type)] == (intType{32, false}) && c.resolve(n.Params[1].Type) == "char**" {
+		return
+	}
+	c.errorf(n.Params[0].Pos, "E0010", "main must take no parameters or (int argc, char** argv)")
+}
+
+// checkArrayInit checks an array declaration's initializer against its
+// element type elem and declared length.
+func (c *Checker) checkArrayInit(n *VarDecl, elem string) {
+	lit, ok := n.Expr.(*ArrayLit)
+	switch {
+	case n.Expr == nil && n.Len == 0:
+		c.errorf(n.Pos, "E0011", "array '%s' needs a size or an initializer list", n.Name)
+		return
+	case n.Expr == nil:
+		return
+	case !ok:
+		c.errorf(nodePos(n.Expr), "E0011", "array '%s' must be initialized with a brace-enclosed list", n.Name)
+		c.expr(n.Expr, n.Pos)
+		return
+	case n.Len > 0 && len(lit.Elems) > n.Len:
+		c.errorf(nodePos(lit.Elems[n.Len]), "E0011", "too many initializers for '%s[%d]': got %d", n.Name, n.Len, len(lit.Elems))
+	case n.Len == 0 && len(lit.Elems) == 0:
+		c.errorf(lit.Pos, "E0011", "array '%s' has zero size", n.Name)
+	}
+	for _, e := range lit.Elems {
+		adaptLiteral(e, elem)
+		c.expr(e, n.Pos)
+		c.checkRange(e, elem, nodePos(e))
+	}
+}
+
+// checkFormat checks a call to print: its first argument must be a string
+// literal whose conversions match the remaining arguments in number.
+func (c *Checker) checkFormat(n *Call) {
+	if len(n.Args) == 0 {
+		c.errorf(n.Pos, "E0012", "%s expects a format string", n.Name)
+		return
+	}
+	lit, ok := n.Args[0].(*StringLit)
+	if !ok {
+		c.errorf(nodePos(n.Args[0]), "E0012", "%s format must be a string literal", n.Name)
+		return
+	}
+	want, err := countConversions(lit.Value)
+	if err != nil {
+		c.errorf(lit.Pos, "E0012", "%v", err)
+		return
+	}
+	if got := len(n.Args) - 1; got != want {
+		c.errorf(n.Pos, "E0012", "%s format %s expects %d arguments, got %d", n.Name, `"`+lit.Value+`"`, want, got)
+	}
+}
+
+// builtinArgs describes the argument of each single-argument builtin.
+var builtinArgs = map[string]string{"print_int": "an int", "print_str": "a string"}
+
+// builtinArgOK reports whether a value of type typ suits the printf
+// conversion the builtin name lowers to: %d takes an int, or a narrower
+// integer, which C promotes to one, and %s a string. An unknown type is
+// given the benefit of the doubt.
+func builtinArgOK(name, typ string) bool {
+	switch {
+	case typ == "":
+		return true
+	case name == "print_str":
+		return typ == "string" || typ == "char*" || typ == "const char*"
+	}
+	t, ok := intTypes[typ]
+	return ok && promote(t) == intType{32, false}
+}
+
+// countConversions returns how many arguments a printf format consumes.
+func countConversions(format string) (int, error) {
+	count := 0
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			continue
+		}
+		i++
+		for i < len(format) && strings.IndexByte("-+ #0", format[i]) >= 0 {
+			i++
+		}
+		// Width and precision are digits or a '*' taking an argument.
+		for i < len(format) && (isDigit(format[i]) || format[i] == '.' || format[i] == '*') {
+			if format[i] == '*' {
+				count++
+			}
+			i++
+		}
+		for i < len(format) && strings.IndexByte("hlLjzt", format[i]) >= 0 {
+			i++
+		}
+		switch {
+		case i == len(format):
+			return 0, fmt.Errorf("print format ends in an incomplete conversion")
+		case format[i] == '%':
+		case strings.IndexByte("diouxXcspfFeEgGaA", format[i]) >= 0:
+			count++
+		default:
+			return 0, fmt.Errorf("unknown conversion '%%%c' in print format", format[i])
+		}
+	}
+	return count, nil
+}
+
+// floatTypes lists the floating-point types.
+var floatTypes = map[string]bool{"float": true, "double": true}
+
+// floatBinOp types a binary operation with a floating-point operand: the
+// result is double if either side is, and float otherwise.
+func (c *Checker) floatBinOp(n *BinOp, lt, rt string) string {
+	_, lint := intTypes[lt]
+	_, rint := intTypes[rt]
+	if !(floatTypes[lt] || lint) || !(floatTypes[rt] || rint) {
+		return ""
+	}
+	switch {
+	case n.Op == "<<" || n.Op == ">>":
+		c.errorf(n.Pos, "E0005", "invalid operands to '%s': %s and %s", n.Op, lt, rt)
+		return ""
+	case comparisonOps[n.Op]:
+		n.Type = "int"
+	case lt == "double" || rt == "double":
+		n.Type = "double"
+	default:
+		n.Type = "float"
+	}
+	return n.Type
+}
+
+// commonType returns the type of a conditional expression whose branches
+// have types a and b, or "" if they have none in common.
+func commonType(a, b string) string {
+	ai, aok := intTypes[a]
+	bi, bok := intTypes[b]
+	switch {
+	case a == b:
+		return a
+	case aok && bok:
+		return arithType(ai, bi).typeName()
+	case a == "double" && (bok || floatTypes[b]), b == "double" && (aok || floatTypes[a]):
+		return "double"
+	case a == "float" && bok, b == "float" && aok:
+		return "float"
+	}
+	return ""
+}
+
+// adaptLiteral gives numeric literals that initialize a floating-point
+// value of type typ that type, so that they are emitted as, say, 5.0f
+// instead of an int or double constant for C to convert.
+func adaptLiteral(n Node, typ string) {
+	if !floatTypes[typ] {
+		return
+	}
+	switch n := n.(type) {
+	case *Number:
+		n.Type = typ
+	case *FloatLit:
+		n.Type = typ
+	case *ArrayLit:
+		for _, elem := range n.Elems {
+			adaptLiteral(elem, typ)
+		}
+	}
+}
+
+// convertible reports whether a value of type from may be used where type
+// to is expected. Arithmetic types convert to each other implicitly, as in C;
+// an unknown type is given the benefit of the doubt.
+func convertible(from, to string) bool {
+	from, to = unqualified(from), unqualified(to)
+	if from == "" || from == to {
+		return true
+	}
+	if pf, ok := pointee(from); ok {
+		// A pointer may gain a const on what it points at, not lose one.
+		if pt, ok := pointee(to); ok && pt == qualified(pf) {
+			return true
+		}
+	}
+	_, fromInt := intTypes[from]
+	_, toInt := intTypes[to]
+	return (fromInt || floatTypes[from]) && (toInt || floatTypes[to])
+}
+
+// unqualified drops the const that applies to a value of type typ as a
+// whole, which stops mattering once the value is read: int*const becomes
+// int* and const int becomes int, but const int* keeps the const on what
+// it points at.
+func unqualified(typ string) string {
+	if strings.HasSuffix(typ, "*const") {
+		return strings.TrimSuffix(typ, "const")
+	}
+	if !strings.ContainsAny(typ, "*[") {
+		return strings.TrimPrefix(typ, "const ")
+	}
+	return typ
+}
+
+// isConst reports whether a variable of type typ is read-only.
+func isConst(typ string) bool {
+	return unqualified(typ) != typ
+}
+
+// qualified makes typ as a whole const.
+func qualified(typ string) string {
+	switch {
+	case isConst(typ):
+		return typ
+	case strings.Contains(typ, "*"):
+		return typ + "const"
+	}
+	return "const " + typ
+}
+
+// pointee returns the type that pointer type typ points at.
+func pointee(typ string) (string, bool) {
+	typ = unqualified(typ)
+	if !strings.HasSuffix(typ, "*") {
+		return "", false
+	}
+	return strings.TrimSuffix(typ, "*"), true
+}
+
+// discardsConst reports whether converting pointer type from to pointer
+// type to drops the const on what it points at, as passing a const int*
+// for an int* parameter would.
+func discardsConst(from, to string) bool {
+	pf, fok := pointee(from)
+	pt, tok := pointee(to)
+	return fok && tok && isConst(pf) && !isConst(pt)
+}
+
+// limits returns the smallest and largest values representable in t.
+func (t intType) limits() (int64, uint64) {
+	if t.Unsigned {
+		return 0, 1<<t.Bits - 1
+	}
+	return -1 << (t.Bits - 1), 1<<(t.Bits-1) - 1
+}
+
+// checkRange reports an integer literal that does not fit in typ.
+func (c *Checker) checkRange(expr Node, typ string, pos Pos) {
+	num, ok := expr.(*Number)
+	t, isInt := intTypes[typ]
+	if !ok || !isInt {
+		return
+	}
+	v := num.Value
+	min, max := t.limits()
+	if int64(v) < min || v >= 0 && uint64(v) > max {
+		c.errorf(pos, "E0013", "constant %d overflows %s (range %d to %d)", v, typ, min, max)
+	}
+}
+
+func isNonNegativeLiteral(n Node) bool {
+	num, ok := n.(*Number)
+	return ok && num.Value >= 0
+}
+
+// parseDiagnostics converts the error returned by Parse into Diagnostics.
+func parseDiagnostics(err error) []Diagnostic {
+	list, ok := err.(ErrorList)
+	if !ok {
+		return []Diagnostic{parseDiagnostic(err)}
+	}
+	var diags []Diagnostic
+	for _, perr := range list {
+		diags = append(diags, parseDiagnostic(perr))
+	}
+	return diags
+}
+
+// parseDiagnostic converts a lexing or parsing error into a Diagnostic.
+func parseDiagnostic(err error) Diagnostic {
+	if perr, ok := err.(*ParseError); ok {
+		return Diagnostic{Pos: perr.Pos, Severity: Error, Message: perr.Msg, Code: "E0001"}
+	}
+	return Diagnostic{Severity: Error, Message: err.Error(), Code: "E0001"}
+}
+
+// HasErrors reports whether any error-severity diagnostic was recorded.
+func (c *Checker) HasErrors() bool {
+	for _, d := range c.Diagnostics {
+		if d.Severity == Error {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Checker) pushScope() {
+	c.scopes = append(c.scopes, map[string]*symbol{})
+}
+
+func (c *Checker) popScope() {
+	c.scopes = c.scopes[:len(c.scopes)-1]
+}
+
+// declare records name, a variable of the given kind, in the innermost
+// scope, reporting a redeclaration in the same scope as an error and
+// shadowing of an outer one as a warning.
+func (c *Checker) declare(kind, name, typ string, pos Pos) {
+	inner := c.scopes[len(c.scopes)-1]
+	if prev, ok := inner[name]; ok {
+		c.errorf(pos, "E0002", "redeclaration of '%s' (previous declaration at %s)", name, prev.Pos)
+		return
+	}
+	for i := len(c.scopes) - 2; i >= 0; i-- {
+		if prev, ok := c.scopes[i][name]; ok {
+			c.warnf("shadow", pos, "declaration of '%s' shadows previous declaration at %s", name, prev.Pos)
+			break
+		}
+	}
+	inner[name] = &symbol{Type: typ, Pos: pos}
+	c.record(kind, name, typ, pos)
+}
+
+// record adds a declaration to Symbols, in the current scope.
+func (c *Checker) record(kind, name, typ string, pos Pos) {
+	scope := "global"
+	if len(c.scopes) == 1 {
+		scope = c.fn.Name
+	} else if len(c.scopes) > 1 {
+		scope = fmt.Sprintf("%s block %d", c.fn.Name, len(c.scopes)-1)
+	}
+	c.Symbols = append(c.Symbols, SymbolEntry{Name: name, Kind: kind, Type: typ, Scope: scope, Pos: pos})
+}
+
+// funcType renders a function's signature as a type, such as int(int, char**).
+func (c *Checker) funcType(ret string, params []Param) string {
+	types := make([]string, len(params))
+	for i, param := range params {
+		types[i] = c.resolve(param.Type)
+	}
+	return c.resolve(ret) + "(" + strings.Join(types, ", ") + ")"
+}
+
+// DumpSymbols renders symbols one per line: position, kind, name, type and
+// scope, separated by tabs.
+func DumpSymbols(symbols []SymbolEntry) string {
+	var sb strings.Builder
+	for _, sym := range symbols {
+		fmt.Fprintf(&sb, "%s\t%s\t%s\t%s\t%s\n", sym.Pos, sym.Kind, sym.Name, sym.Type, sym.Scope)
+	}
+	return sb.String()
+}
+
+// checkIdent warns when name is longer than MaxIdentLen.
+func (c *Checker) checkIdent(name string, pos Pos) {
+	if c.MaxIdentLen > 0 && len(name) > c.MaxIdentLen {
+		c.warnf("ident-length", pos, "identifier '%s' is %d characters long, exceeding the limit of %d", name, len(name), c.MaxIdentLen)
+	}
+}
+
+// resolve expands typedef names in typ, following aliases of aliases, so
+// that the result is spelled with built-in types only.
+func (c *Checker) resolve(typ string) string {
+	rest := strings.TrimPrefix(typ, "const ")
+	base := rest
+	if i := strings.IndexByte(rest, '*'); i >= 0 {
+		base = rest[:i]
+	}
+	alias, ok := c.aliases[base]
+	if !ok {
+		return typ
+	}
+	resolved := c.resolve(alias.Type)
+	if rest != typ {
+		// const applies to the alias as a whole, so a const alias of
+		// int* is int*const.
+		resolved = qualified(resolved)
+	}
+	return resolved + rest[len(base):]
+}
+
+// lookup finds the innermost declaration of name, or nil.
+func (c *Checker) lookup(name string) *symbol {
+	for i := len(c.scopes) - 1; i >= 0; i-- {
+		if sym, ok := c.scopes[i][name]; ok {
+			return sym
+		}
+	}
+	return nil
+}
+
+func (c *Checker) errorf(pos Pos, code, format string, args ...interface{}) {
+	c.Diagnostics = append(c.Diagnostics, Diagnostic{Pos: pos, Severity: Error, Message: fmt.Sprintf(format, args...), Code: code})
+}
+
+func (c *Checker) warnf(category string, pos Pos, format string, args ...interface{}) {
+	severity := Warning
+	if c.Werror || c.ErrorCategories[category] {
+		severity = Error
+	}
+	c.Diagnostics = append(c.Diagnostics, Diagnostic{Pos: pos, Severity: severity, Message: fmt.Sprintf(format, args...), Category: category})
+}
+
+// -------------------------------
+// Constant Folding
+// -------------------------------
+
+// Fold replaces integer operations on two literals with their value. It
+// runs after Check, which records the C type of every operation; results
+// that do not fit that type are left for the C compiler and reported.
+//
+// Variables initialized or assigned a literal are replaced by it in later
+// reads, until they are next assigned. Past an if or a loop, a variable
+// assigned inside it is no longer known.
+func (c *Checker) Fold(n Node) Node {
+	switch n := n.(type) {
+	case *Program:
+		for _, decl := range n.Decls {
+			c.Fold(decl)
+		}
+	case *Function:
+		c.known = []map[string]knownVar{{}}
+		for _, param := range n.Params {
+			c.known[0][param.Name] = knownVar{}
+		}
+		for _, stmt := range n.Body {
+			c.Fold(stmt)
+		}
+		c.known = nil
+	case *Block:
+		c.known = append(c.known, map[string]knownVar{})
+		for _, stmt := range n.Body {
+			c.Fold(stmt)
+		}
+		c.known = c.known[:len(c.known)-1]
+	case *If:
+		n.Cond = c.Fold(n.Cond)
+		before := c.snapshotKnown()
+		c.Fold(n.Then)
+		c.known = before
+		if n.Else != nil {
+			before = c.snapshotKnown()
+			c.Fold(n.Else)
+			c.known = before
+		}
+		c.forgetAssigned(n)
+	case *While:
+		c.forgetAssigned(n)
+		n.Cond = c.Fold(n.Cond)
+		c.Fold(n.Body)
+		c.forgetAssigned(n)
+	case *Return:
+		n.Expr = c.Fold(n.Expr)
+	case *VarDecl:
+		n.Expr = c.Fold(n.Expr)
+		c.known[len(c.known)-1][n.Name] = knownVar{propagates: !n.Array && c.propagates(n.Type)}
+		c.setKnown(n.Name, n.Expr)
+	case *Assign:
+		n.Expr = c.Fold(n.Expr)
+		switch target := n.Target.(type) {
+		case *Ident:
+			c.setKnown(target.Name, n.Expr)
+		case *Index:
+			target.Index = c.Fold(target.Index)
+		}
+	case *Ident:
+		for i := len(c.known) - 1; i >= 0; i-- {
+			if v, ok := c.known[i][n.Name]; ok {
+				if v.lit != nil {
+					return relocate(v.lit, n.Pos)
+				}
+				break
+			}
+		}
+	case *ExprStmt:
+		n.Expr = c.Fold(n.Expr)
+	case *StaticAssert:
+		n.Expr = c.Fold(n.Expr)
+	case *Assert:
+		// The check may be compiled out, so nothing it assigns is known
+		// afterwards.
+		n.Expr = c.Fold(n.Expr)
+		c.forgetAssigned(n)
+	case *Call:
+		for i, arg := range n.Args {
+			n.Args[i] = c.Fold(arg)
+		}
+		if n.Name == "debug_print" && !c.NoPrelude {
+			// The call may be compiled out.
+			c.forgetAssigned(n)
+		}
+	case *Comma:
+		var exprs []Node
+		for i, expr := range n.Exprs {
+			expr = c.Fold(expr)
+			// A literal other than the last has no effect.
+			if _, ok := literalValue(expr); ok && i < len(n.Exprs)-1 {
+				continue
+			}
+			exprs = append(exprs, expr)
+		}
+		if len(exprs) == 1 {
+			return exprs[0]
+		}
+		n.Exprs = exprs
+	case *Ternary:
+		n.Cond = c.Fold(n.Cond)
+		// Only one branch runs, so each is folded without the other's
+		// assignments, and neither's are known after.
+		before := c.snapshotKnown()
+		n.Then = c.Fold(n.Then)
+		c.known = before
+		before = c.snapshotKnown()
+		n.Else = c.Fold(n.Else)
+		c.known = before
+		c.forgetAssigned(n)
+	case *ArrayLit:
+		for i, elem := range n.Elems {
+			n.Elems[i] = c.Fold(elem)
+		}
+	case *Index:
+		n.Array, n.Index = c.Fold(n.Array), c.Fold(n.Index)
+	case *BinOp:
+		n.Left, n.Right = c.Fold(n.Left), c.Fold(n.Right)
+		if n.Op == "&&" || n.Op == "||" {
+			// The right operand may not run.
+			c.forgetAssigned(n.Right)
+		}
+		left, lok := literalValue(n.Left)
+		right, rok := literalValue(n.Right)
+		t, tok := intTypes[n.Type]
+		if !lok || !rok || !tok {
+			return n
+		}
+		v, ok := foldBinOp(n.Op, big.NewInt(int64(left)), big.NewInt(int64(right)), t)
+		if !ok {
+			return n
+		}
+		if unsignedOperands(n) && (left < 0 || right < 0 || !t.fits(v)) {
+			// Unsigned arithmetic wraps instead of overflowing; leave it to C.
+			return n
+		}
+		if !t.fits(v) {
+			c.warnf("overflow", n.Pos, "integer overflow in constant expression: %d %s %d does not fit in %s", left, n.Op, right, n.Type)
+			return n
+		}
+		return &Number{Value: int(v.Int64()), Pos: nodePos(n.Left), Suffix: typeSuffixes[n.Type]}
+	case *Unary:
+		n.Expr = c.Fold(n.Expr)
+		operand, ok := literalValue(n.Expr)
+		t, tok := intTypes[n.Type]
+		if !ok || !tok {
+			return n
+		}
+		v, ok := foldUnary(n.Op, big.NewInt(int64(operand)), t)
+		if !ok || !t.fits(v) {
+			return n
+		}
+		return &Number{Value: int(v.Int64()), Pos: n.Pos, Suffix: typeSuffixes[n.Type]}
+	}
+	return n
+}
+
+// typeSuffixes gives the suffix a folded literal of each integer type
+// needs to keep that type.
+var typeSuffixes = map[string]string{"uint": "U", "int64": "L", "uint64": "UL"}
+
+// propagates reports whether variables of type typ may be replaced by
+// their value. Only types that C promotes to int qualify, since that is
+// the type the literal replacing them has.
+func (c *Checker) propagates(typ string) bool {
+	t, ok := intTypes[unqualified(c.resolve(typ))]
+	return ok && promote(t) == intType{32, false}
+}
+
+// setKnown records that the innermost variable called name now holds
+// value, or that what it holds is unknown if value is not a literal.
+func (c *Checker) setKnown(name string, value Node) {
+	if _, ok := literalValue(value); !ok {
+		value = nil
+	}
+	if n, isNum := value.(*Number); isNum && n.Type != "" {
+		value = nil
+	}
+	for i := len(c.known) - 1; i >= 0; i-- {
+		if v, ok := c.known[i][name]; ok {
+			if v.propagates {
+				v.lit = value
+			}
+			c.known[i][name] = v
+			return
+		}
+	}
+}
+
+// snapshotKnown copies known, so it can be restored after folding one
+// branch of an if or a conditional expression.
+func (c *Checker) snapshotKnown() []map[string]knownVar {
+	snap := make([]map[string]knownVar, len(c.known))
+	for i, scope := range c.known {
+		snap[i] = map[string]knownVar{}
+		for name, v := range scope {
+			snap[i][name] = v
+		}
+	}
+	return snap
+}
+
+// forgetAssigned marks every variable assigned within n as unknown.
+func (c *Checker) forgetAssigned(n Node) {
+	assigned := &assignedNames{}
+	Walk(n, assigned)
+	for _, name := range assigned.names {
+		c.setKnown(name, nil)
+	}
+}
+
+// assignedNames is a Visitor collecting the names of assigned variables.
+type assignedNames struct {
+	names []string
+}
+
+func (a *assignedNames) Enter(n Node) bool {
+	if n, ok := n.(*Assign); ok {
+		if target, ok := n.Target.(*Ident); ok {
+			a.names = append(a.names, target.Name)
+		}
+	}
+	return true
+}
+
+func (a *assignedNames) Leave(n Node) {}
+
+// relocate copies the literal lit to pos.
+func relocate(lit Node, pos Pos) Node {
+	switch lit := lit.(type) {
+	case *Number:
+		return &Number{Value: lit.Value, Pos: pos, Base: lit.Base, Raw: lit.Raw, Suffix: lit.Suffix}
+	case *CharLit:
+		return &CharLit{Value: lit.Value, Pos: pos}
+	}
+	return lit
+}
+
+// literalValue returns the value of an integer or character literal.
+func literalValue(n Node) (int, bool) {
+	switch n := n.(type) {
+	case *Number:
+		return n.Value, true
+	case *CharLit:
+		return n.Value, true
+	}
+	return 0, false
+}
+
+// constValue evaluates an integer constant expression. It reports false if
+// n is not one, or if some operation overflows the type Check recorded.
+func constValue(n Node) (*big.Int, bool) {
+	switch n := n.(type) {
+	case *Number, *CharLit:
+		v, _ := literalValue(n)
+		return big.NewInt(int64(v)), true
+	case *Ternary:
+		cond, ok := constValue(n.Cond)
+		if _, isInt := intTypes[n.Type]; !ok || !isInt {
+			return nil, false
+		}
+		if cond.Sign() != 0 {
+			return constValue(n.Then)
+		}
+		return constValue(n.Else)
+	case *BinOp:
+		left, lok := constValue(n.Left)
+		right, rok := constValue(n.Right)
+		t, tok := intTypes[n.Type]
+		if !lok || !rok || !tok {
+			return nil, false
+		}
+		v, ok := foldBinOp(n.Op, left, right, t)
+		if !ok || !t.fits(v) || unsignedOperands(n) && (left.Sign() < 0 || right.Sign() < 0) {
+			return nil, false
+		}
+		return v, true
+	case *Unary:
+		operand, ok := constValue(n.Expr)
+		t, tok := intTypes[n.Type]
+		if !ok || !tok {
+			return nil, false
+		}
+		v, ok := foldUnary(n.Op, operand, t)
+		if !ok || !t.fits(v) {
+			return nil, false
+		}
+		return v, true
+	}
+	return nil, false
+}
+
+// fits reports whether v is representable in t.
+func (t intType) fits(v *big.Int) bool {
+	min, max := t.limits()
+	return v.Cmp(big.NewInt(min)) >= 0 && v.Cmp(new(big.Int).SetUint64(max)) <= 0
+}
+
+// unsignedOperands reports whether the operands of n are converted to an
+// unsigned type, where negative values wrap and so neither compare nor
+// compute as foldBinOp does.
+func unsignedOperands(n *BinOp) bool {
+	left, lok := intTypes[exprType(n.Left)]
+	right, rok := intTypes[exprType(n.Right)]
+	if n.Op == "<<" || n.Op == ">>" {
+		return lok && promote(left).Unsigned
+	}
+	return lok && rok && arithType(left, right).Unsigned
+}
+
+// foldBinOp computes a op b exactly. It reports false for operations whose
+// result C leaves undefined, such as division by zero or an out-of-range
+// shift, so that they are not folded.
+func foldBinOp(op string, a, b *big.Int, t intType) (*big.Int, bool) {
+	v := new(big.Int)
+	switch op {
+	case "+":
+		return v.Add(a, b), true
+	case "-":
+		return v.Sub(a, b), true
+	case "*":
+		return v.Mul(a, b), true
+	case "/":
+		if b.Sign() == 0 {
+			return nil, false
+		}
+		return v.Quo(a, b), true
+	case "**":
+		// A negative power truncates towards zero, and a huge one
+		// overflows; neither is worth computing here.
+		if b.Sign() < 0 || b.BitLen() > 16 {
+			return nil, false
+		}
+		return v.Exp(a, b, nil), true
+	case "<<", ">>":
+		if b.Sign() < 0 || b.Int64() >= int64(t.Bits) || a.Sign() < 0 {
+			return nil, false
+		}
+		if op == "<<" {
+			return v.Lsh(a, uint(b.Int64())), true
+		}
+		return v.Rsh(a, uint(b.Int64())), true
+	}
+	var result bool
+	switch cmp := a.Cmp(b); op {
+	case "&&":
+		result = a.Sign() != 0 && b.Sign() != 0
+	case "||":
+		result = a.Sign() != 0 || b.Sign() != 0
+	case "==":
+		result = cmp == 0
+	case "!=":
+		result = cmp != 0
+	case "<":
+		result = cmp < 0
+	case ">":
+		result = cmp > 0
+	case "<=":
+		result = cmp <= 0
+	case ">=":
+		result = cmp >= 0
+	default:
+		return nil, false
+	}
+	if result {
+		return v.SetInt64(1), true
+	}
+	return v, true
+}
+
+// foldUnary computes op a, where a is a value of type t.
+func foldUnary(op string, a *big.Int, t intType) (*big.Int, bool) {
+	switch op {
+	case "~":
+		if t.Unsigned {
+			_, max := t.limits()
+			return new(big.Int).Sub(new(big.Int).SetUint64(max), a), true
+		}
+		return new(big.Int).Not(a), true
+	}
+	return nil, false
+}
+
+// -------------------------------
+// Lint
+// -------------------------------
+
+// lintChecks describes the checks run by `lang lint`, each of which can be
+// turned off with --disable.
+var lintChecks = map[string]string{
+	"unused":      "variables that are never read",
+	"unreachable": "statements after a return",
+	"self-assign": "assignments of a variable to itself",
+	"const-cond":  "if and while conditions that are constant",
+	"int-div":     "integer divisions stored in floating-point variables",
+	"int-cond":    "if and while conditions that are integers, not comparisons (off by default)",
+}
+
+// optInChecks are the lint checks that only run when named by --enable.
+var optInChecks = map[string]bool{"int-cond": true}
+
+// Linter reports likely mistakes that do not stop a program compiling.
+type Linter struct {
+	Diagnostics []Diagnostic
+	// Disabled holds the names of checks to skip, Enabled the opt-in
+	// checks to run, and ErrorCategories those to report as errors.
+	Disabled        map[string]bool
+	Enabled         map[string]bool
+	ErrorCategories map[string]bool
+	scopes          [][]*lintVar
+	// aliases maps each typedef name to the type it stands for.
+	aliases map[string]string
+}
+
+type lintVar struct {
+	Name string
+	Type string
+	Pos  Pos
+	used bool
+}
+
+func (l *Linter) Lint(n Node) {
+	switch n := n.(type) {
+	case *TypeAlias:
+		if l.aliases == nil {
+			l.aliases = map[string]string{}
+		}
+		l.aliases[n.Name] = n.Type
+	case *Function:
+		l.scopes = append(l.scopes, nil)
+		for _, param := range n.Params {
+			// Parameters are part of the signature, so never flagged.
+			l.declare(param.Name, param.Type, param.Pos).used = true
+		}
+		l.lintBody(n.Body)
+		l.popScope()
+	case *Block:
+		l.scopes = append(l.scopes, nil)
+		l.lintBody(n.Body)
+		l.popScope()
+	case *VarDecl:
+		if !n.Array {
+			l.lintIntDiv(n.Name, n.Type, n.Expr)
+		}
+		l.Lint(n.Expr)
+		l.declare(n.Name, n.Type, n.Pos)
+	case *Assign:
+		target, ok := n.Target.(*Ident)
+		if !ok {
+			l.Lint(n.Target)
+			l.Lint(n.Expr)
+			break
+		}
+		// Storing to a variable does not count as using it.
+		if ident, ok := n.Expr.(*Ident); ok && ident.Name == target.Name {
+			l.warnf("self-assign", n.Pos, "self-assignment of '%s' has no effect", target.Name)
+		}
+		if v := l.lookup(target.Name); v != nil {
+			l.lintIntDiv(target.Name, v.Type, n.Expr)
+		}
+		l.Lint(n.Expr)
+	case *If:
+		l.lintCond("if", n.Cond)
+		l.Lint(n.Then)
+		if n.Else != nil {
+			l.Lint(n.Else)
+		}
+	case *While:
+		l.lintCond("while", n.Cond)
+		l.Lint(n.Body)
+	case *Ident:
+		if v := l.lookup(n.Name); v != nil {
+			v.used = true
+		}
+	default:
+		for _, child := range Children(n) {
+			l.Lint(child)
+		}
+	}
+}
+
+// lintCond reports a condition that folds to a constant, or that is an
+// integer rather than a comparison. It relies on the types Check records
+// on the condition.
+func (l *Linter) lintCond(stmt string, cond Node) {
+	if v, ok := constValue(cond); ok {
+		always := "true"
+		if v.Sign() == 0 {
+			always = "false"
+		}
+		l.warnf("const-cond", nodePos(cond), "%s condition is always %s (folds to %s)", stmt, always, v)
+	} else {
+		l.lintIntCond(stmt, cond)
+	}
+	l.Lint(cond)
+}
+
+// lintIntCond reports an integer used directly as a truth value, as in
+// if (x), suggesting the comparison with zero it stands for. The operands
+// of && and || are conditions too.
+func (l *Linter) lintIntCond(stmt string, cond Node) {
+	if bin, ok := cond.(*BinOp); ok && (bin.Op == "&&" || bin.Op == "||") {
+		l.lintIntCond(stmt, bin.Left)
+		l.lintIntCond(stmt, bin.Right)
+		return
+	}
+	if bin, ok := cond.(*BinOp); ok && comparisonOps[bin.Op] {
+		return
+	}
+	if _, ok := intTypes[l.condType(cond)]; !ok {
+		return
+	}
+	f := &formatter{}
+	l.warnf("int-cond", nodePos(cond), "%s condition '%s' is an integer, not a comparison; write '%s != 0'", stmt, f.expr(cond, fmtPrecComma), f.expr(cond, binaryPrec["!="]+1))
+}
+
+// condType returns the type of cond, or "" for expressions whose type the
+// linter does not know.
+func (l *Linter) condType(cond Node) string {
+	switch n := cond.(type) {
+	case *Ident:
+		v := l.lookup(n.Name)
+		if v == nil {
+			return ""
+		}
+		typ := strings.TrimPrefix(v.Type, "const ")
+		for l.aliases[typ] != "" {
+			typ = l.aliases[typ]
+		}
+		return typ
+	case *Assign:
+		return l.condType(n.Target)
+	case *BinOp, *Unary, *Ternary:
+		return exprType(n)
+	}
+	return ""
+}
+
+// lintIntDiv reports an integer division stored in a floating-point
+// variable, whose fraction is lost before the conversion. It relies on the
+// types Check records on the division.
+func (l *Linter) lintIntDiv(name, typ string, expr Node) {
+	typ = strings.TrimPrefix(typ, "const ")
+	for l.aliases[typ] != "" {
+		typ = l.aliases[typ]
+	}
+	div, ok := expr.(*BinOp)
+	if !ok || div.Op != "/" || !floatTypes[typ] {
+		return
+	}
+	if _, isInt := intTypes[div.Type]; isInt {
+		l.warnf("int-div", div.Pos, "integer division stored in %s '%s' discards the fraction; make an operand floating-point, as in 1.0 / 2", typ, name)
+	}
+}
+
+func (l *Linter) lintBody(body []Node) {
+	for i, stmt := range body {
+		if _, empty := stmt.(*EmptyStmt); i > 0 && !empty {
+			if _, ok := body[i-1].(*Return); ok {
+				l.warnf("unreachable", nodePos(stmt), "unreachable code after return")
+			}
+		}
+		l.Lint(stmt)
+	}
+}
+
+func (l *Linter) declare(name, typ string, pos Pos) *lintVar {
+	v := &lintVar{Name: name, Type: typ, Pos: pos}
+	l.scopes[len(l.scopes)-1] = append(l.scopes[len(l.scopes)-1], v)
+	return v
+}
+
+// popScope leaves the innermost scope, reporting variables it declared
+// that were never read.
+func (l *Linter) popScope() {
+	for _, v := range l.scopes[len(l.scopes)-1] {
+		if !v.used {
+			l.warnf("unused", v.Pos, "variable '%s' is never used", v.Name)
+		}
+	}
+	l.scopes = l.scopes[:len(l.scopes)-1]
+}
+
+// lookup finds the innermost variable called name, or nil.
+func (l *Linter) lookup(name string) *lintVar {
+	for i := len(l.scopes) - 1; i >= 0; i-- {
+		scope := l.scopes[i]
+		for j := len(scope) - 1; j >= 0; j-- {
+			if scope[j].Name == name {
+				return scope[j]
+			}
+		}
+	}
+	return nil
+}
+
+func (l *Linter) warnf(check string, pos Pos, format string, args ...interface{}) {
+	if l.Disabled[check] || optInChecks[check] && !l.Enabled[check] {
+		return
+	}
+	severity := Warning
+	if l.ErrorCategories[check] {
+		severity = Error
+	}
+	l.Diagnostics = append(l.Diagnostics, Diagnostic{Pos: pos, Severity: severity, Message: fmt.Sprintf(format, args...), Category: check})
+}
+
+// -------------------------------
+// Backends
+// -------------------------------
+
+// Generator is a code generation backend.
+type Generator interface {
+	Generate(Node) (string, error)
+	// FileExtension is the suffix, including the dot, of emitted files.
+	FileExtension() string
+}
+
+// backends maps each --emit name to a constructor for its Generator.
+var backends = map[string]func(*Options) Generator{}
+
+// RegisterBackend makes a backend selectable with --emit=name.
+func RegisterBackend(name string, factory func(*Options) Generator) {
+	if _, dup := backends[name]; dup {
+		panic("backend registered twice: " + name)
+	}
+	backends[name] = factory
+}
+
+// LookupBackend returns a Generator for the named backend configured from
+// opts.
+func LookupBackend(name string, opts *Options) (Generator, error) {
+	factory, ok := backends[name]
+	if !ok {
+		var names []string
+		for name := range backends {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown backend %q (available: %s)", name, strings.Join(names, ", "))
+	}
+	return factory(opts), nil
+}
+
+func init() {
+	RegisterBackend("c", func(opts *Options) Generator {
+		return newC99Generator(opts)
+	})
+	RegisterBackend("wasm", func(opts *Options) Generator {
+		return &WasmGenerator{
+			C:        newC99Generator(opts),
+			OptLevel: opts.OptLevel,
+			Std:      opts.Std,
+			NoAssert: opts.NoAssert,
+			Sysroot:  os.Getenv("WASI_SYSROOT"),
+		}
+	})
+	RegisterBackend("dot", func(opts *Options) Generator {
+		return &DotGenerator{Hex: opts.Hex}
+	})
+}
+
+// -------------------------------
+// C99 Generator
+// -------------------------------
+
+// newC99Generator returns a C99Generator configured from opts, for the
+// "c" backend and those built on its output.
+func newC99Generator(opts *Options) *C99Generator {
+	return &C99Generator{
+		Filename:       opts.Input,
+		NoPrelude:      opts.NoPrelude,
+		Debug:          opts.Debug,
+		ImplicitReturn: opts.ImplicitReturn,
+		MaxLineLen:     opts.MaxCLineLen,
+	}
+}
+
+type C99Generator struct {
+	// Filename, when set, is referenced by #line directives so that gcc
+	// diagnostics point back at the original .lang source.
+	Filename string
+
+	// NoPrelude disables lowering of the prelude builtins, leaving calls to
+	// print_int and friends to be resolved like any other function.
+	NoPrelude bool
+
+	// Debug keeps debug_print calls; otherwise they are compiled out.
+	Debug bool
+
+	// ImplicitReturn appends `return 0;` to a main that does not end in a
+	// return, as C99 and later do implicitly.
+	ImplicitReturn bool
+
+	// MaxLineLen, when positive, makes Generate warn about every
+	// generated line longer than it, in Diagnostics.
+	MaxLineLen  int
+	Diagnostics []Diagnostic
+
+	// SourceMap is filled in by Generate with the lang position of each
+	// statement in the generated code.
+	SourceMap []Mapping
+
+	// Libs names the libraries, such as m for pow, that the generated code
+	// must be linked with; filled in by Generate.
+	Libs []string
+
+	includes map[string]bool
+	// helpers maps the name of each support function the output calls,
+	// such as lang_pow_int, to its definition.
+	helpers map[string]string
+	// depth is the indentation level of the statement being generated.
+	depth int
+	// marks holds the positions referenced by markers in the output until
+	// Generate resolves them.
+	marks []Pos
+}
+
+// Mapping ties lines CLine through CEndLine of the generated C to the lang
+// statement starting at Line and Col.
+type Mapping struct {
+	CLine    int `json:"c_line"`
+	CEndLine int `json:"c_end_line"`
+	Line     int `json:"line"`
+	Col      int `json:"col"`
+}
+
+// SourceMapFile is the JSON document written by --sourcemap.
+type SourceMapFile struct {
+	Version   int       `json:"version"`
+	Source    string    `json:"source"`
+	Generated string    `json:"generated"`
+	Mappings  []Mapping `json:"mappings"`
+}
+
+// prelude maps each builtin function to the printf format it lowers to.
+// print and debug_print have none: their arguments are printf's own.
+var prelude = map[string]string{
+	"print":     "",
+	"print_int": `"%d\n"`,
+	"print_str": `"%s\n"`,
+
+	"debug_print": "",
+}
+
+var _ Generator = (*C99Generator)(nil)
+
+// Generate renders a whole program as C99 source.
+func (g *C99Generator) Generate(ast Node) (out string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	out = g.resolveMarks(g.gen(ast))
+	g.checkLineLengths(out)
+	return out, nil
+}
+
+// checkLineLengths warns about lines of code longer than MaxLineLen,
+// placing each warning at the source statement the line came from.
+func (g *C99Generator) checkLineLengths(code string) {
+	g.Diagnostics = nil
+	if g.MaxLineLen <= 0 {
+		return
+	}
+	for i, line := range strings.Split(code, "\n") {
+		if len(line) <= g.MaxLineLen || strings.HasPrefix(line, "#line ") {
+			continue
+		}
+		var pos Pos
+		for _, m := range g.SourceMap {
+			if m.CLine <= i+1 && i+1 <= m.CEndLine {
+				pos = Pos{m.Line, m.Col}
+			}
+		}
+		g.Diagnostics = append(g.Diagnostics, Diagnostic{
+			Pos:      pos,
+			Severity: Warning,
+			Category: "line-length",
+			Message:  fmt.Sprintf("generated C line %d is %d characters long, exceeding %d", i+1, len(line), g.MaxLineLen),
+		})
+	}
+}
+
+func (g *C99Generator) FileExtension() string {
+	return ".c"
+}
+
+func (g *C99Generator) gen(ast Node) string {
+	switch n := ast.(type) {
+	case *Number:
+		switch n.Type {
+		case "float":
+			return strconv.Itoa(n.Value) + ".0f"
+		case "double":
+			return strconv.Itoa(n.Value) + ".0"
+		}
+		// lang's L is 64 bits, which C only promises for LL.
+		suffix := map[string]string{"U": "U", "L": "LL", "UL": "ULL"}[n.Suffix]
+		switch n.Base {
+		case 16, 8:
+			return n.Raw + suffix
+		case 2:
+			// C99 has no binary literals.
+			return fmt.Sprintf("%#x", n.Value) + suffix
+		}
+		return strconv.Itoa(n.Value) + suffix
+	case *FloatLit:
+		text := strconv.FormatFloat(n.Value, 'g', -1, 64)
+		if !strings.ContainsAny(text, ".e") {
+			text += ".0"
+		}
+		if n.Type == "float" {
+			text += "f"
+		}
+		return text
+	case *Ident:
+		return n.Name
+	case *StringLit:
+		return `"` + n.Value + `"`
+	case *CharLit:
+		return cCharLit(n.Value)
+	case *Program:
+		g.includes = map[string]bool{}
+		g.helpers = map[string]string{}
+		g.Libs = nil
+		g.marks = nil
+		var decls []string
+		for _, decl := range n.Decls {
+			decls = append(decls, g.gen(decl))
+		}
+		return g.includeLines() + g.helperLines() + strings.Join(decls, "\n")
+	case *ExternDecl:
+		g.useType(n.Ret)
+		return g.lineDirective(n.Pos) + fmt.Sprintf("extern %s(%s);\n", cDecl(n.Ret, n.Name), g.params(n.Params))
+	case *TypeAlias:
+		g.useType(n.Type)
+		return g.lineDirective(n.Pos) + fmt.Sprintf("typedef %s;\n", cDecl(n.Type, n.Name))
+	case *Function:
+		g.depth = 1
+		body := g.genBody(n.Body)
+		if g.ImplicitReturn && n.Name == "main" && !endsInReturn(n.Body) {
+			body += "    return 0;\n"
+		}
+		g.useType(n.Ret)
+		doc := ""
+		for _, line := range n.Doc {
+			doc += strings.TrimRight("// "+line, " ") + "\n"
+		}
+		return doc + g.lineDirective(n.Pos) + fmt.Sprintf("%s(%s) {\n%s}\n", cDecl(n.Ret, n.Name), g.params(n.Params), body)
+	case *Return:
+		return "return " + g.gen(n.Expr) + ";"
+	case *VarDecl:
+		g.useType(n.Type)
+		decl := cDecl(n.Type, n.Name)
+		if n.Array && n.Len > 0 {
+			decl += fmt.Sprintf("[%d]", n.Len)
+		} else if n.Array {
+			decl += "[]"
+		}
+		if n.Expr == nil {
+			return decl + ";"
+		}
+		return fmt.Sprintf("%s = %s;", decl, g.gen(n.Expr))
+	case *Assign:
+		return g.gen(n.Target) + " = " + g.gen(n.Expr)
+	case *ExprStmt:
+		if g.compiledOut(n) {
+			return ";"
+		}
+		return g.gen(n.Expr) + ";"
+	case *EmptyStmt:
+		return ";"
+	case *If:
+		out := "if (" + g.gen(n.Cond) + ") " + g.gen(n.Then)
+		if n.Else != nil {
+			out += " else " + g.gen(n.Else)
+		}
+		return out
+	case *While:
+		body := g.gen(n.Body)
+		if n.Label == "" {
+			return "while (" + g.gen(n.Cond) + ") " + body
+		}
+		// Labeled jumps become gotos to labels emitted only when used:
+		// one at the end of the body for continue, one after the loop for
+		// break.
+		brk, cont := jumpsTo(n)
+		indent := strings.Repeat("    ", g.depth)
+		if cont {
+			end := strings.LastIndex(body, "\n") + 1
+			body = body[:end] + indent + "    " + n.Label + "_continue:;\n" + body[end:]
+		}
+		loop := "while (" + g.gen(n.Cond) + ") " + body
+		if brk {
+			loop += "\n" + indent + n.Label + "_break:;"
+		}
+		return loop
+	case *Break:
+		if n.Label != "" {
+			return "goto " + n.Label + "_break;"
+		}
+		return "break;"
+	case *Continue:
+		if n.Label != "" {
+			return "goto " + n.Label + "_continue;"
+		}
+		return "continue;"
+	case *StaticAssert:
+		return fmt.Sprintf("_Static_assert(%s, %s);", g.gen(n.Expr), g.gen(n.Msg))
+	case *Assert:
+		g.include("assert.h")
+		return "assert(" + g.gen(n.Expr) + ");"
+	case *Block:
+		// Declarations stay inside the braces, so C scopes them exactly as
+		// the checker did.
+		g.depth++
+		body := g.genBody(n.Body)
+		g.depth--
+		return "{\n" + body + strings.Repeat("    ", g.depth) + "}"
+	case *Call:
+		var args []string
+		for _, arg := range n.Args {
+			args = append(args, g.gen(arg))
+		}
+		if format, ok := prelude[n.Name]; ok && !g.NoPrelude {
+			if n.Name == "debug_print" && !g.Debug {
+				return "0"
+			}
+			g.include("stdio.h")
+			if format == "" {
+				return fmt.Sprintf("printf(%s)", strings.Join(args, ", "))
+			}
+			return fmt.Sprintf("printf(%s, %s)", format, args[0])
+		}
+		return fmt.Sprintf("%s(%s)", n.Name, strings.Join(args, ", "))
+	case *BinOp:
+		if n.Op == "**" {
+			if t, ok := intTypes[n.Type]; ok {
+				return fmt.Sprintf("%s(%s, %s)", g.powHelper(t), g.gen(n.Left), g.gen(n.Right))
+			}
+			g.include("math.h")
+			g.link("m")
+			return fmt.Sprintf("pow(%s, %s)", g.gen(n.Left), g.gen(n.Right))
+		}
+		return fmt.Sprintf("%s %s %s", g.maybeParen(n.Left, n.Op, false), n.Op, g.maybeParen(n.Right, n.Op, true))
+	case *Unary:
+		switch n.Expr.(type) {
+		case *BinOp, *Ternary, *Comma, *Assign:
+			return n.Op + "(" + g.gen(n.Expr) + ")"
+		}
+		return n.Op + g.gen(n.Expr)
+	case *ArrayLit:
+		var elems []string
+		for _, elem := range n.Elems {
+			elems = append(elems, g.gen(elem))
+		}
+		return "{" + strings.Join(elems, ", ") + "}"
+	case *Index:
+		array := g.gen(n.Array)
+		switch n.Array.(type) {
+		case *BinOp, *Ternary, *Assign:
+			array = "(" + array + ")"
+		}
+		return array + "[" + g.gen(n.Index) + "]"
+	case *Ternary:
+		// Only a conditional or assignment as the condition, or an
+		// assignment as the else branch, needs parentheses; anything else
+		// binds at least as tightly.
+		cond, els := g.gen(n.Cond), g.gen(n.Else)
+		switch n.Cond.(type) {
+		case *Ternary, *Assign:
+			cond = "(" + cond + ")"
+		}
+		if _, ok := n.Else.(*Assign); ok {
+			els = "(" + els + ")"
+		}
+		return cond + " ? " + g.gen(n.Then) + " : " + els
+	case *Comma:
+		// Always parenthesized, so it can appear wherever an operand can.
+		var exprs []string
+		for _, expr := range n.Exprs {
+			exprs = append(exprs, g.gen(expr))
+		}
+		return "(" + strings.Join(exprs, ", ") + ")"
+	default:
+		panic(fmt.Sprintf("unknown AST node: %T", n))
+	}
+}
+
+// params renders a C parameter list, using (void) for an empty one.
+func (g *C99Generator) params(params []Param) string {
+	if len(params) == 0 {
+		return "void"
+	}
+	var out []string
+	for _, param := range params {
+		g.useType(param.Type)
+		out = append(out, cDecl(param.Type, param.Name))
+	}
+	return strings.Join(out, ", ")
+}
+
+// genBody renders statements one per line at the current depth.
+func (g *C99Generator) genBody(stmts []Node) string {
+	body := ""
+	for _, stmt := range stmts {
+		if g.compiledOut(stmt) {
+			continue
+		}
+		body += g.lineDirective(nodePos(stmt)) + strings.Repeat("    ", g.depth) + g.gen(stmt) + "\n"
+	}
+	return body
+}
+
+// compiledOut reports whether stmt is a debug_print call that is left out
+// of a build without Debug.
+func (g *C99Generator) compiledOut(stmt Node) bool {
+	if g.Debug || g.NoPrelude {
+		return false
+	}
+	if stmt, ok := stmt.(*ExprStmt); ok {
+		call, ok := stmt.Expr.(*Call)
+		return ok && call.Name == "debug_print"
+	}
+	return false
+}
+
+func endsInReturn(body []Node) bool {
+	if len(body) == 0 {
+		return false
+	}
+	_, ok := body[len(body)-1].(*Return)
+	return ok
+}
+
+func (g *C99Generator) include(header string) {
+	if g.includes != nil {
+		g.includes[header] = true
+	}
+}
+
+// link records that the output needs library lib.
+func (g *C99Generator) link(lib string) {
+	for _, l := range g.Libs {
+		if l == lib {
+			return
+		}
+	}
+	g.Libs = append(g.Libs, lib)
+}
+
+// includeLines renders the collected headers in a stable order.
+func (g *C99Generator) includeLines() string {
+	var headers []string
+	for header := range g.includes {
+		headers = append(headers, header)
+	}
+	if len(headers) == 0 {
+		return ""
+	}
+	sort.Strings(headers)
+	out := ""
+	for _, header := range headers {
+		out += fmt.Sprintf("#include <%s>\n", header)
+	}
+	return out + "\n"
+}
+
+// helperLines renders the collected support functions in a stable order.
+func (g *C99Generator) helperLines() string {
+	var names []string
+	for name := range g.helpers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	out := ""
+	for _, name := range names {
+		out += g.helpers[name] + "\n"
+	}
+	return out
+}
+
+// powHelper defines, once per output, the function an integer ** of type
+// t is lowered to and returns its name. pow would compute in double and
+// lose precision above 2^53, so it squares and multiplies instead, in the
+// unsigned type of the same width so that overflow wraps rather than
+// being undefined.
+func (g *C99Generator) powHelper(t intType) string {
+	name := "lang_pow_" + t.typeName()
+	if _, ok := g.helpers[name]; ok || g.helpers == nil {
+		return name
+	}
+	g.useType(t.typeName())
+	typ := cType(t.typeName())
+	utyp := cType(intType{t.Bits, true}.typeName())
+	def := fmt.Sprintf("static %s %s(%s base, %s exp) {\n", typ, name, typ, typ)
+	def += fmt.Sprintf("    %s b = base, r = 1;\n", utyp)
+	if !t.Unsigned {
+		// Only 1 and -1 have a negative power that does not truncate to 0.
+		def += "    if (exp < 0) {\n"
+		def += "        return base == 1 ? 1 : base == -1 ? (exp % 2 ? -1 : 1) : 0;\n"
+		def += "    }\n"
+	}
+	def += "    for (; exp; exp /= 2, b *= b) {\n"
+	def += "        if (exp % 2) {\n"
+	def += "            r *= b;\n"
+	def += "        }\n"
+	def += "    }\n"
+	def += "    return r;\n"
+	def += "}\n"
+	g.helpers[name] = def
+	return name
+}
+
+// cTypeNames maps lang base types whose C spelling differs. Names ending
+// in _t come from <stdint.h>.
+var cTypeNames = map[string]string{
+	"int8":   "int8_t",
+	"int16":  "int16_t",
+	"int32":  "int32_t",
+	"int64":  "int64_t",
+	"uint":   "unsigned int",
+	"uint8":  "uint8_t",
+	"uint16": "uint16_t",
+	"uint32": "uint32_t",
+	"uint64": "uint64_t",
+	"string": "const char *",
+}
+
+// useType pulls in any header the C spelling of typ depends on.
+func (g *C99Generator) useType(typ string) {
+	if strings.HasSuffix(cTypeNames[baseType(typ)], "_t") {
+		g.include("stdint.h")
+	}
+}
+
+// cType renders a lang type such as "char*" in C declaration syntax.
+func cType(typ string) string {
+	return cDecl(typ, "")
+}
+
+// baseType returns typ without its qualifiers and pointer levels.
+func baseType(typ string) string {
+	typ = strings.TrimPrefix(typ, "const ")
+	if i := strings.IndexByte(typ, '*'); i >= 0 {
+		return typ[:i]
+	}
+	return typ
+}
+
+// cDecl renders a declaration of name with the given lang type, e.g.
+// "char *s" or "const int *const p". An empty name yields just the type.
+func cDecl(typ, name string) string {
+	rest := strings.TrimPrefix(typ, "const ")
+	base := baseType(typ)
+	stars := strings.ReplaceAll(rest[len(base):], "const*", "const *")
+	if c, ok := cTypeNames[base]; ok {
+		base = c
+	}
+	if rest != typ && strings.HasSuffix(base, "*") {
+		// string is already a pointer, so it is the pointer that is const.
+		base += "const"
+	} else if rest != typ {
+		base = "const " + base
+	}
+	if strings.HasSuffix(stars, "const") && name != "" {
+		name = " " + name
+	}
+	if stars == "" && name == "" {
+		return base
+	}
+	if strings.HasSuffix(base, "*") {
+		return base + stars + name
+	}
+	return base + " " + stars + name
+}
+
+// cCharLit spells a char value as a C character literal, escaping anything
+// that is not printable ASCII.
+func cCharLit(v int) string {
+	switch b := byte(v); {
+	case b == '\\' || b == '\'':
+		return `'\` + string(b) + `'`
+	case b == '\n':
+		return `'\n'`
+	case b == '\t':
+		return `'\t'`
+	case b == 0:
+		return `'\0'`
+	case b >= ' ' && b <= '~':
+		return "'" + string(b) + "'"
+	default:
+		return fmt.Sprintf(`'\x%02x'`, b)
+	}
+}
+
+// lineDirective marks the next C line as coming from pos in the source.
+// Output line numbers are only known once generation is complete, so it
+// returns a marker line that resolveMarks later turns into a #line
+// directive and a SourceMap entry.
+func (g *C99Generator) lineDirective(pos Pos) string {
+	if pos.Line == 0 {
+		return ""
+	}
+	g.marks = append(g.marks, pos)
+	return fmt.Sprintf("\x00%d\n", len(g.marks)-1)
+}
+
+// resolveMarks replaces the markers left by lineDirective with #line
+// directives, or drops them when there is no Filename, and records where
+// each one falls in SourceMap.
+func (g *C99Generator) resolveMarks(code string) string {
+	var sb strings.Builder
+	g.SourceMap = nil
+	line := 1
+	for _, text := range strings.SplitAfter(code, "\n") {
+		if !strings.HasPrefix(text, "\x00") {
+			sb.WriteString(text)
+			if strings.HasSuffix(text, "\n") {
+				line++
+			}
+			continue
+		}
+		id, _ := strconv.Atoi(strings.TrimSpace(text[1:]))
+		pos := g.marks[id]
+		if n := len(g.SourceMap); n > 0 {
+			g.SourceMap[n-1].CEndLine = line - 1
+		}
+		if g.Filename != "" {
+			fmt.Fprintf(&sb, "#line %d %s\n", pos.Line, strconv.Quote(g.Filename))
+			line++
+		}
+		g.SourceMap = append(g.SourceMap, Mapping{CLine: line, Line: pos.Line, Col: pos.Col})
+	}
+	if n := len(g.SourceMap); n > 0 {
+		g.SourceMap[n-1].CEndLine = line - 1
+	}
+	return sb.String()
+}
+
+// jumpsTo reports whether any break or continue in loop names its label.
+func jumpsTo(loop *While) (brk, cont bool) {
+	v := &labeledJumps{label: loop.Label}
+	Walk(loop.Body, v)
+	return v.brk, v.cont
+}
+
+// labeledJumps is a Visitor finding the jumps to one loop label.
+type labeledJumps struct {
+	label     string
+	brk, cont bool
+}
+
+func (v *labeledJumps) Enter(n Node) bool {
+	switch n := n.(type) {
+	case *Break:
+		v.brk = v.brk || n.Label == v.label
+	case *Continue:
+		v.cont = v.cont || n.Label == v.label
+	}
+	return true
+}
+
+func (v *labeledJumps) Leave(n Node) {}
+
+// maybeParen renders an operand of the binary operator parent, adding
+// parentheses only when precedence or left-associativity requires them.
+func (g *C99Generator) maybeParen(expr Node, parent string, right bool) string {
+	switch expr.(type) {
+	case *Ternary, *Assign:
+		return "(" + g.gen(expr) + ")"
+	}
+	if bin, ok := expr.(*BinOp); ok {
+		prec, parentPrec := binaryPrec[bin.Op], binaryPrec[parent]
+		if prec < parentPrec || prec == parentPrec && right {
+			return "(" + g.gen(bin) + ")"
+		}
+	}
+	return g.gen(expr)
+}
+
+// -------------------------------
+// Wasm Generator
+// -------------------------------
+
+// WasmGenerator builds a WebAssembly module by compiling the C backend's
+// output with clang for wasm32-wasi. Generate returns the module's bytes.
+type WasmGenerator struct {
+	C *C99Generator
+
+	// OptLevel and Std are passed to clang as -O<level> and -std=<std>.
+	OptLevel string
+	Std      string
+
+	// Sysroot, when set, is the wasi-libc sysroot handed to clang.
+	Sysroot string
+
+	// NoAssert defines NDEBUG, compiling assert statements out.
+	NoAssert bool
+}
+
+var _ Generator = (*WasmGenerator)(nil)
+
+func (g *WasmGenerator) Generate(ast Node) (string, error) {
+	clang, err := exec.LookPath("clang")
+	if err != nil {
+		return "", fmt.Errorf("--emit=wasm needs clang with a wasm32 target: %v", err)
+	}
+	code, err := g.C.Generate(ast)
+	if err != nil {
+		return "", err
+	}
+	dir, err := os.MkdirTemp("", "lang-wasm-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+	src, out := filepath.Join(dir, "out.c"), filepath.Join(dir, "out.wasm")
+	if err := os.WriteFile(src, []byte(code), 0644); err != nil {
+		return "", err
+	}
+	args := []string{"--target=wasm32-wasi", "-std=" + g.Std, "-O" + g.OptLevel}
+	if g.Sysroot != "" {
+		args = append(args, "--sysroot="+g.Sysroot)
+	}
+	if g.NoAssert {
+		args = append(args, "-DNDEBUG")
+	}
+	args = append(args, src, "-o", out)
+	if msg, err := exec.Command(clang, args...).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("clang could not build for wasm32-wasi (is wasi-libc installed? set WASI_SYSROOT to its sysroot): %v\n%s", err, msg)
+	}
+	wasm, err := os.ReadFile(out)
+	return string(wasm), err
+}
+
+func (g *WasmGenerator) FileExtension() string {
+	return ".wasm"
+}
+
+// -------------------------------
+// Dot Generator
+// -------------------------------
+
+// DotGenerator renders the syntax tree as a Graphviz digraph, with one
+// vertex per node labelled as in the ast dump.
+type DotGenerator struct {
+	// Hex shows integer literals in hexadecimal too, like --hex.
+	Hex bool
+}
+
+var _ Generator = (*DotGenerator)(nil)
+
+func (g *DotGenerator) Generate(ast Node) (string, error) {
+	var sb strings.Builder
+	sb.WriteString("digraph AST {\n\tnode [shape=box];\n")
+	next := 0
+	var walk func(n Node) int
+	walk = func(n Node) int {
+		id := next
+		next++
+		label, children := describeNode(n, g.Hex)
+		fmt.Fprintf(&sb, "\tn%d [label=%s];\n", id, strconv.Quote(label))
+		for _, child := range children {
+			fmt.Fprintf(&sb, "\tn%d -> n%d;\n", id, walk(child))
+		}
+		return id
+	}
+	walk(ast)
+	sb.WriteString("}\n")
+	return sb.String(), nil
+}
+
+func (g *DotGenerator) FileExtension() string {
+	return ".dot"
+}
+
+// -------------------------------
+// Formatter
+// -------------------------------
+
+// Format renders a parsed program as lang source in the canonical layout:
+// four-space indents, one statement per line, braces around every body,
+// single spaces around binary operators and only the parentheses that
+// precedence needs. Blank lines are kept, collapsed to one, and every
+// function is set apart by one. comments, the lexer's Comments, go back
+// on their own lines before the code that followed them, or after the
+// statement they ended a line of.
+func Format(ast Node, comments []Token) string {
+	f := &formatter{comments: comments, start: true}
+	prog, _ := ast.(*Program)
+	if prog == nil {
+		return ""
+	}
+	var prev Node
+	for _, decl := range prog.Decls {
+		_, fn := decl.(*Function)
+		_, prevFn := prev.(*Function)
+		f.blank = fn || prevFn
+		f.decl(decl)
+		prev = decl
+	}
+	f.commentsBefore(int(^uint(0) >> 1))
+	return f.sb.String()
+}
+
+type formatter struct {
+	sb       strings.Builder
+	comments []Token
+	depth    int
+	// last is the last source line written out. start is set at the top
+	// of the file and of each body, where no blank line goes, and blank
+	// asks for one before the next line.
+	last  int
+	start bool
+	blank bool
+}
+
+// Expression precedences for the formatter: the binary operators use
+// binaryPrec, and these cover the rest.
+const (
+	fmtPrecComma   = -2
+	fmtPrecAssign  = -1
+	fmtPrecTernary = 0
+	fmtPrecUnary   = 9
+	fmtPrecPostfix = 10
+)
+
+// commentsBefore writes, each on its own line, the comments that start
+// before line.
+func (f *formatter) commentsBefore(line int) {
+	for len(f.comments) > 0 && f.comments[0].Pos.Line < line {
+		c := f.comments[0]
+		f.comments = f.comments[1:]
+		f.gap(c.Pos.Line)
+		f.indent()
+		f.sb.WriteString(strings.TrimRight(c.Value, " \t\r"))
+		f.endLine(c.Pos.Line)
+	}
+}
+
+// gap writes a blank line before code from source line line if the
+// source had one there or one was asked for.
+func (f *formatter) gap(line int) {
+	if !f.start && (f.blank || line > f.last+1) {
+		f.sb.WriteString("\n")
+	}
+	f.blank = false
+}
+
+func (f *formatter) indent() {
+	f.sb.WriteString(strings.Repeat("    ", f.depth))
+}
+
+// endLine finishes an output line holding code up to source line line,
+// appending any comment that ended that line in the source.
+func (f *formatter) endLine(line int) {
+	if line > f.last {
+		f.last = line
+	}
+	if len(f.comments) > 0 && f.comments[0].Pos.Line <= f.last {
+		f.sb.WriteString(" " + strings.TrimRight(f.comments[0].Value, " \t\r"))
+		f.comments = f.comments[1:]
+	}
+	f.sb.WriteString("\n")
+	f.start = false
+}
+
+func (f *formatter) decl(n Node) {
+	line := nodePos(n).Line
+	f.commentsBefore(line)
+	f.gap(line)
+	switch n := n.(type) {
+	case *TypeAlias:
+		f.sb.WriteString("typedef " + formatType(n.Type) + " " + n.Name + ";")
+		f.endLine(line)
+	case *ExternDecl:
+		f.sb.WriteString("extern " + formatType(n.Ret) + " " + n.Name + "(" + formatParams(n.Params) + ");")
+		f.endLine(line)
+	case *Function:
+		f.sb.WriteString(formatType(n.Ret) + " " + n.Name + "(" + formatParams(n.Params) + ") ")
+		f.body(n.Body, n.End, line)
+		f.endLine(n.End.Line)
+	}
+}
+
+func formatParams(params []Param) string {
+	var out []string
+	for _, param := range params {
+		if param.Name == "" {
+			out = append(out, formatType(param.Type))
+		} else {
+			out = append(out, formatType(param.Type)+" "+param.Name)
+		}
+	}
+	return strings.Join(out, ", ")
+}
+
+// formatType spells a type as written in lang source, e.g. "int* const".
+func formatType(typ string) string {
+	return strings.ReplaceAll(typ, "*const", "* const")
+}
+
+// body writes a braced statement list whose '{' ends source line open and
+// whose '}' is at end, leaving the line open after the '}'. end is the
+// zero Pos for a body the parser wrapped around a lone statement.
+func (f *formatter) body(stmts []Node, end Pos, open int) {
+	f.sb.WriteString("{")
+	f.endLine(open)
+	f.depth++
+	f.start = true
+	for _, stmt := range stmts {
+		f.stmt(stmt)
+	}
+	if end.Line > 0 {
+		f.commentsBefore(end.Line)
+	}
+	f.depth--
+	f.indent()
+	f.sb.WriteString("}")
+}
+
+func (f *formatter) stmt(n Node) {
+	line := nodePos(n).Line
+	f.commentsBefore(line)
+	f.gap(line)
+	f.indent()
+	switch n := n.(type) {
+	case *If:
+		f.ifStmt(n)
+	case *While:
+		if n.Label != "" {
+			f.sb.WriteString(n.Label + ": ")
+		}
+		f.sb.WriteString("while (" + f.expr(n.Cond, fmtPrecComma) + ") ")
+		body := n.Body.(*Block)
+		f.body(body.Body, body.End, lastLine(n.Cond))
+		f.endLine(body.End.Line)
+	case *Block:
+		f.body(n.Body, n.End, line)
+		f.endLine(n.End.Line)
+	default:
+		f.sb.WriteString(f.simpleStmt(n))
+		f.endLine(lastLine(n))
+	}
+}
+
+func (f *formatter) ifStmt(n *If) {
+	f.sb.WriteString("if (" + f.expr(n.Cond, fmtPrecComma) + ") ")
+	then := n.Then.(*Block)
+	f.body(then.Body, then.End, lastLine(n.Cond))
+	switch els := n.Else.(type) {
+	case *If:
+		f.sb.WriteString(" else ")
+		f.ifStmt(els)
+	case *Block:
+		f.sb.WriteString(" else ")
+		f.body(els.Body, els.End, els.Pos.Line)
+		f.endLine(els.End.Line)
+	default:
+		f.endLine(then.End.Line)
+	}
+}
+
+// simpleStmt renders a statement that fits on one line.
+func (f *formatter) simpleStmt(n Node) string {
+	switch n := n.(type) {
+	case *VarDecl:
+		out := formatType(n.Type) + " " + n.Name
+		if n.Array && n.Len > 0 {
+			out += fmt.Sprintf("[%d]", n.Len)
+		} else if n.Array {
+			out += "[]"
+		}
+		if n.Expr != nil {
+			out += " = " + f.expr(n.Expr, fmtPrecAssign)
+		}
+		return out + ";"
+	case *Return:
+		if n.Expr == nil {
+			return "return;"
+		}
+		return "return " + f.expr(n.Expr, fmtPrecComma) + ";"
+	case *ExprStmt:
+		return f.expr(n.Expr, fmtPrecComma) + ";"
+	case *EmptyStmt:
+		return ";"
+	case *Break:
+		return strings.TrimSpace("break "+n.Label) + ";"
+	case *Continue:
+		return strings.TrimSpace("continue "+n.Label) + ";"
+	case *StaticAssert:
+		return "static_assert(" + f.expr(n.Expr, fmtPrecTernary) + ", " + f.expr(n.Msg, fmtPrecPostfix) + ");"
+	case *Assert:
+		return "assert(" + f.expr(n.Expr, fmtPrecAssign) + ");"
+	}
+	return ""
+}
+
+// expr renders n, in parentheses if it binds more loosely than min.
+func (f *formatter) expr(n Node, min int) string {
+	var out string
+	prec := fmtPrecPostfix
+	switch n := n.(type) {
+	case *Number:
+		out = strconv.Itoa(n.Value)
+		if n.Raw != "" {
+			out = n.Raw
+		}
+		out += n.Suffix
+	case *FloatLit:
+		out = formatFloat(n.Value)
+	case *CharLit:
+		out = cCharLit(n.Value)
+	case *StringLit:
+		out = `"` + n.Value + `"`
+	case *Ident:
+		out = n.Name
+	case *Call:
+		out = n.Name + "(" + f.exprList(n.Args) + ")"
+	case *ArrayLit:
+		out = "{" + f.exprList(n.Elems) + "}"
+	case *Index:
+		out = f.expr(n.Array, fmtPrecPostfix) + "[" + f.expr(n.Index, fmtPrecComma) + "]"
+	case *Unary:
+		out, prec = n.Op+f.expr(n.Expr, fmtPrecUnary), fmtPrecUnary
+	case *BinOp:
+		prec = binaryPrec[n.Op]
+		left, right := prec, prec+1
+		if n.Op == "**" {
+			left, right = prec+1, prec
+		}
+		out = f.expr(n.Left, left) + " " + n.Op + " " + f.expr(n.Right, right)
+	case *Ternary:
+		prec = fmtPrecTernary
+		out = f.expr(n.Cond, 1) + " ? " + f.expr(n.Then, fmtPrecComma) + " : " + f.expr(n.Else, fmtPrecTernary)
+	case *Assign:
+		prec = fmtPrecAssign
+		out = f.expr(n.Target, fmtPrecTernary) + " = " + f.expr(n.Expr, fmtPrecAssign)
+	case *Comma:
+		prec = fmtPrecComma
+		var exprs []string
+		for _, expr := range n.Exprs {
+			exprs = append(exprs, f.expr(expr, fmtPrecAssign))
+		}
+		out = strings.Join(exprs, ", ")
+	}
+	if prec < min {
+		return "(" + out + ")"
+	}
+	return out
+}
+
+func (f *formatter) exprList(exprs []Node) string {
+	var out []string
+	for _, expr := range exprs {
+		out = append(out, f.expr(expr, fmtPrecAssign))
+	}
+	return strings.Join(out, ", ")
+}
+
+// formatFloat spells v, which lang literals keep non-negative, as a
+// floating-point literal, in exponent form only when it is very large or
+// small.
+func formatFloat(v float64) string {
+	format := byte('f')
+	if v != 0 && (v < 1e-4 || v >= 1e21) {
+		format = 'e'
+	}
+	text := strconv.FormatFloat(v, format, -1, 64)
+	if !strings.ContainsAny(text, ".e") {
+		text += ".0"
+	}
+	return text
+}
+
+// lastLine returns the last source line n or any node below it starts on.
+func lastLine(n Node) int {
+	line := nodePos(n).Line
+	for _, child := range Children(n) {
+		if l := lastLine(child); l > line {
+			line = l
+		}
+	}
+	return line
+}
+
+// -------------------------------
+// Driver
+// -------------------------------
+
+type Options struct {
+	Input string
+
+	// NoPrelude disables the print, print_int, print_str and debug_print
+	// builtins.
+	NoPrelude bool
+
+	// UseScanner lexes with the hand-written scanner.
+	UseScanner bool
+
+	// TabWidth sets the tab stop used for column numbers.
+	TabWidth int
+
+	// OptLevel is forwarded to gcc as -O<level>. Levels above 0 also
+	// fold constant expressions before code generation.
+	OptLevel string
+
+	// Std is the C standard passed to gcc as -std=<std>.
+	Std string
+
+	// Warnings names the set of gcc warnings to enable, one of
+	// gccWarnings' keys.
+	Warnings string
+
+	// Debug asks gcc for debug info (-g) and keeps debug_print calls.
+	Debug bool
+
+	// NoAssert compiles assert statements out by defining NDEBUG.
+	NoAssert bool
+
+	// Werror, set by --werror alone, turns every warning into an error;
+	// WerrorCategories, set by --werror=a,b, only those of the categories
+	// it holds.
+	Werror           bool
+	WerrorCategories map[string]bool
+
+	// MaxIdentLen limits identifier length; 0 means unlimited.
+	MaxIdentLen int
+
+	// LabeledLoops enables labeled loops with break and continue naming
+	// them, an extension to C.
+	LabeledLoops bool
+
+	// MaxCLineLen warns about generated C lines longer than it; 0 means
+	// no limit.
+	MaxCLineLen int
+
+	// Color is "auto", "always" or "never".
+	Color string
+
+	// MaxErrors caps how many errors are printed; 0 means no limit.
+	MaxErrors int
+
+	// ImplicitReturn adds `return 0;` to a main lacking a final return.
+	ImplicitReturn bool
+
+	// Emit selects the output, one of the modes --help lists. The default,
+	// "bin", builds an executable.
+	Emit string
+
+	// legacyMode records use of the deprecated positional [ast|lex] form.
+	legacyMode string
+
+	// ASTOnly stops after parsing, for timing and profiling the front end.
+	ASTOnly bool
+
+	// DumpSymbols prints the checker's symbol table and stops.
+	DumpSymbols bool
+
+	// CPUProfile and MemProfile name files to write pprof profiles to.
+	CPUProfile string
+	MemProfile string
+
+	// Hex shows integer literals in hexadecimal in the ast dump.
+	Hex bool
+
+	// PrintReturn runs the compiled program and prints its exit status.
+	PrintReturn bool
+
+	// DryRun prints the gcc command, or the files --emit would write,
+	// without writing or running anything.
+	DryRun bool
+
+	// Timeout, when positive, kills gcc if it runs longer.
+	Timeout time.Duration
+
+	// OutDir is where the executable and emitted files are written. It is
+	// created if needed.
+	OutDir string
+
+	// SourceMap writes a JSON source map next to the --emit=c output.
+	SourceMap bool
+
+	// Eval, when set, is an expression to compile and run in place of an
+	// input file, printing its value.
+	Eval string
+
+	// Lint runs the lint checks instead of compiling; set by the `lint`
+	// subcommand. LintDisable lists checks to skip, and LintEnable the
+	// opt-in checks to run.
+	Lint        bool
+	LintDisable map[string]bool
+	LintEnable  map[string]bool
+
+	// Fmt rewrites Inputs in the canonical format; set by the `fmt`
+	// subcommand. FmtCheck lists the files that are not formatted instead.
+	Fmt      bool
+	FmtCheck bool
+	Inputs   []string
+
+	// Run builds the program to a temporary executable and runs it with
+	// RunArgs, exiting with its status; set by the `run` subcommand.
+	Run     bool
+	RunArgs []string
+
+	// Exclude is a glob naming files to skip when Input is a directory.
+	Exclude string
+
+	// Explain names an error code, warning category or lint check to
+	// describe instead of compiling.
+	Explain string
+
+	// Reproducible names the temporary .c file and its directory after a
+	// hash of the input, so that repeated builds hand gcc the same path.
+	Reproducible bool
+}
+
+// legacyModes maps the deprecated positional modes to --emit values.
+var legacyModes = map[string]string{
+	"ast": "ast",
+	"lex": "tokens",
+}
+
+// constFlag is a boolean-style flag that stores a fixed value when given,
+// for spellings like -O2 and --no-color that share one option.
+type constFlag struct {
+	target *string
+	value  string
+}
+
+func (f constFlag) String() string     { return "" }
+func (f constFlag) IsBoolFlag() bool   { return true }
+func (f constFlag) Set(s string) error { *f.target = f.value; return nil }
+
+// werrorFlag is --werror: given alone it turns every warning into an
+// error, and given a comma-separated list only warnings of those
+// categories.
+type werrorFlag struct{ opts *Options }
+
+func (f werrorFlag) String() string   { return "" }
+func (f werrorFlag) IsBoolFlag() bool { return true }
+
+func (f werrorFlag) Set(s string) error {
+	switch s {
+	case "true":
+		f.opts.Werror = true
+		return nil
+	case "false":
+		f.opts.Werror = false
+		return nil
+	}
+	// parseArgs checks the names, since the flag package would report an
+	// error here as an invalid boolean.
+	for _, name := range strings.Split(s, ",") {
+		if f.opts.WerrorCategories == nil {
+			f.opts.WerrorCategories = map[string]bool{}
+		}
+		f.opts.WerrorCategories[name] = true
+	}
+	return nil
+}
+
+// newFlagSet defines every command-line flag, storing into opts.
+func newFlagSet(opts *Options) *flag.FlagSet {
+	fs := flag.NewFlagSet("lang", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	for _, level := range []string{"0", "1", "2", "3"} {
+		fs.Var(constFlag{&opts.OptLevel, level}, "O"+level, "compile with gcc -O"+level)
+	}
+	fs.StringVar(&opts.Std, "std", opts.Std, "C `standard` for gcc: c99, c11 or c17")
+	fs.StringVar(&opts.Warnings, "warnings", opts.Warnings, "gcc warning `set`: none, default, all (-Wall) or extra (-Wall -Wextra)")
+	fs.BoolVar(&opts.Debug, "debug", false, "pass -g to gcc and keep debug_print calls")
+	fs.BoolVar(&opts.NoAssert, "no-assert", false, "compile out assert statements (pass -DNDEBUG to gcc)")
+	fs.Var(constFlag{&opts.Color, "always"}, "color", "always color diagnostics")
+	fs.Var(constFlag{&opts.Color, "never"}, "no-color", "never color diagnostics")
+	fs.BoolVar(&opts.ImplicitReturn, "implicit-return", false, "end main with return 0 if it lacks a return")
+	fs.BoolVar(&opts.PrintReturn, "print-return", false, "run the program and print its exit status")
+	fs.StringVar(&opts.Emit, "emit", opts.Emit, "output `mode`: tokens, ast, lang, c, dot, wasm, bin, lib or makefile")
+	fs.BoolVar(&opts.ASTOnly, "ast-only", false, "stop after parsing")
+	fs.StringVar(&opts.Exclude, "exclude", "", "skip files matching the glob `pattern` when building a directory")
+	fs.BoolVar(&opts.FmtCheck, "check", false, "with fmt, list unformatted files instead of rewriting them")
+	fs.StringVar(&opts.Explain, "explain", "", "describe the error code, warning category or lint check `name`, with an example")
+	fs.BoolVar(&opts.DumpSymbols, "dump-symbols", false, "print every declared function, type and variable after checking")
+	fs.StringVar(&opts.CPUProfile, "cpuprofile", "", "write a CPU profile to `file`")
+	fs.StringVar(&opts.MemProfile, "memprofile", "", "write a heap profile to `file`")
+	fs.BoolVar(&opts.Hex, "hex", false, "show integer literals in hex in the ast dump")
+	fs.IntVar(&opts.MaxErrors, "max-errors", opts.MaxErrors, "stop printing after `n` errors (0 for no limit)")
+	fs.IntVar(&opts.MaxIdentLen, "max-ident-len", 0, "warn about identifiers longer than `n`")
+	fs.BoolVar(&opts.LabeledLoops, "enable-labeled-loops", false, "allow labeled loops and break or continue naming them")
+	fs.IntVar(&opts.MaxCLineLen, "max-c-line", 0, "warn about generated C lines longer than `n` characters")
+	fs.BoolVar(&opts.UseScanner, "scanner", false, "lex with the hand-written scanner")
+	fs.IntVar(&opts.TabWidth, "tab-width", 0, "tab stop `width` for column numbers")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "print the gcc command instead of running it")
+	fs.DurationVar(&opts.Timeout, "timeout", 0, "kill gcc after `duration` (e.g. 30s; 0 for no limit)")
+	fs.StringVar(&opts.OutDir, "out-dir", opts.OutDir, "write the executable and emitted files to `dir`")
+	fs.BoolVar(&opts.SourceMap, "sourcemap", false, "with --emit=c, also write a JSON source map to <file>.c.map")
+	fs.StringVar(&opts.Eval, "eval", "", "compile and run `expr`, printing its value, instead of a file")
+	fs.BoolVar(&opts.Reproducible, "reproducible", false, "name temporary files after the input hash")
+	fs.BoolVar(&opts.NoPrelude, "no-prelude", false, "disable the print, print_int, print_str and debug_print builtins")
+	fs.Var(werrorFlag{opts}, "werror", "treat warnings as errors; --werror=a,b only those of categories a and b")
+	fs.Func("disable", "comma-separated lint `checks` to skip", func(s string) error {
+		for _, name := range strings.Split(s, ",") {
+			if _, ok := lintChecks[name]; !ok {
+				return fmt.Errorf("unknown lint check: %s", name)
+			}
+			if opts.LintDisable == nil {
+				opts.LintDisable = map[string]bool{}
+			}
+			opts.LintDisable[name] = true
+		}
+		return nil
+	})
+	fs.Func("enable", "comma-separated opt-in lint `checks` to run", func(s string) error {
+		for _, name := range strings.Split(s, ",") {
+			if !optInChecks[name] {
+				return fmt.Errorf("not an opt-in lint check: %s", name)
+			}
+			if opts.LintEnable == nil {
+				opts.LintEnable = map[string]bool{}
+			}
+			opts.LintEnable[name] = true
+		}
+		return nil
+	})
+	return fs
+}
+
+// cStandards lists the values accepted by --std.
+var cStandards = map[string]bool{"c99": true, "c11": true, "c17": true}
+
+// gccWarnings maps each --warnings set to the gcc flags selecting it.
+// default leaves gcc's own set in place.
+var gccWarnings = map[string][]string{
+	"none":    {"-w"},
+	"default": nil,
+	"all":     {"-Wall"},
+	"extra":   {"-Wall", "-Wextra"},
+}
+
+// Config is a .langrc file: a JSON object mapping flag names to default
+// values, such as {"std": "c11", "O2": true}.
+type Config struct {
+	Path  string
+	Flags map[string]interface{}
+}
+
+// findConfig looks for a .langrc in dir and then its parents, up to the
+// project root: the first directory holding .git. It returns nil if there
+// is none.
+func findConfig(dir string) (*Config, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		path := filepath.Join(dir, ".langrc")
+		data, err := os.ReadFile(path)
+		if err == nil {
+			config := &Config{Path: path}
+			if err := json.Unmarshal(data, &config.Flags); err != nil {
+				return nil, fmt.Errorf("%s: %v", path, err)
+			}
+			return config, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		parent := filepath.Dir(dir)
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil || parent == dir {
+			return nil, nil
+		}
+		dir = parent
+	}
+}
+
+// apply sets each flag named in c on fs, in name order.
+func (c *Config) apply(fs *flag.FlagSet) error {
+	names := make([]string, 0, len(c.Flags))
+	for name := range c.Flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		var value string
+		switch v := c.Flags[name].(type) {
+		case string:
+			value = v
+		case bool:
+			value = strconv.FormatBool(v)
+		case float64:
+			value = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			return fmt.Errorf("%s: %s must be a string, number or boolean", c.Path, name)
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("%s: %s: %v", c.Path, name, err)
+		}
+	}
+	return nil
+}
+
+// parseArgs parses the command line. Defaults come first from config,
+// which may be nil, then from envFlags, the contents of LANG_FLAGS.
+func parseArgs(args []string, config *Config, envFlags string) (*Options, error) {
+	opts := &Options{OptLevel: "0", Std: "c99", Warnings: "default", MaxErrors: 20, Color: "auto", Emit: "bin", OutDir: "."}
+	fs := newFlagSet(opts)
+	if len(args) > 0 && args[0] == "lint" {
+		opts.Lint = true
+		args = args[1:]
+	}
+	if len(args) > 0 && args[0] == "fmt" {
+		opts.Fmt = true
+		args = args[1:]
+	}
+	if len(args) > 0 && args[0] == "run" {
+		opts.Run = true
+		args = args[1:]
+		// Everything after -- belongs to the program.
+		for i, arg := range args {
+			if arg == "--" {
+				args, opts.RunArgs = args[:i], args[i+1:]
+				break
+			}
+		}
+	}
+	// Defaults are parsed first, so that the command line overrides them.
+	if config != nil {
+		if err := config.apply(fs); err != nil {
+			return nil, err
+		}
+	}
+	defaults, err := shellSplit(envFlags)
+	if err != nil {
+		return nil, fmt.Errorf("LANG_FLAGS: %v", err)
+	}
+	if err := fs.Parse(defaults); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("LANG_FLAGS: unexpected argument %s", fs.Arg(0))
+	}
+	// flag stops at the first positional argument; resume after each one
+	// so flags may follow the input file.
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			break
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+	if opts.MaxErrors < 0 || opts.MaxIdentLen < 0 || opts.TabWidth < 0 || opts.MaxCLineLen < 0 {
+		return nil, fmt.Errorf("numeric flags must not be negative")
+	}
+	if opts.SourceMap && opts.Emit != "c" {
+		return nil, fmt.Errorf("--sourcemap requires --emit=c")
+	}
+	if opts.Run && (opts.Emit != "bin" || opts.Eval != "") {
+		return nil, fmt.Errorf("run cannot be combined with --emit or --eval")
+	}
+	if opts.Emit == "lib" && (opts.Eval != "" || opts.PrintReturn) {
+		return nil, fmt.Errorf("--emit=lib cannot be combined with --eval or --print-return")
+	}
+	if !cStandards[opts.Std] {
+		return nil, fmt.Errorf("unsupported C standard: %s", opts.Std)
+	}
+	var categories []string
+	for name := range opts.WerrorCategories {
+		categories = append(categories, name)
+	}
+	sort.Strings(categories)
+	for _, name := range categories {
+		if _, ok := warningCategories[name]; !ok {
+			if _, ok := lintChecks[name]; !ok {
+				return nil, fmt.Errorf("unknown warning category: %s", name)
+			}
+		}
+	}
+	if _, ok := gccWarnings[opts.Warnings]; !ok {
+		return nil, fmt.Errorf("unknown warning set: %s", opts.Warnings)
+	}
+	if opts.FmtCheck && !opts.Fmt {
+		return nil, fmt.Errorf("--check requires the fmt subcommand")
+	}
+	if opts.Emit == "makefile" && (opts.Eval != "" || opts.PrintReturn) {
+		return nil, fmt.Errorf("--emit=makefile cannot be combined with --eval or --print-return")
+	}
+	if opts.Fmt || opts.Emit == "makefile" {
+		if len(positional) == 0 {
+			return nil, fmt.Errorf("missing input file")
+		}
+		opts.Inputs = positional
+		return opts, nil
+	}
+	if opts.Explain != "" {
+		if len(positional) > 0 {
+			return nil, fmt.Errorf("--explain takes no input file")
+		}
+		return opts, nil
+	}
+	if opts.Eval != "" {
+		if len(positional) > 0 {
+			return nil, fmt.Errorf("--eval takes no input file")
+		}
+		// The value is shown with the print builtin.
+		if opts.NoPrelude {
+			return nil, fmt.Errorf("--eval cannot be combined with --no-prelude")
+		}
+		opts.Input = "<eval>"
+		return opts, nil
+	}
+	if len(positional) < 1 {
+		return nil, fmt.Errorf("missing input file")
+	}
+	opts.Input = positional[0]
+	if len(positional) > 1 {
+		emit, ok := legacyModes[positional[1]]
+		if !ok {
+			return nil, fmt.Errorf("unknown mode: %s", positional[1])
+		}
+		opts.Emit = emit
+		opts.legacyMode = positional[1]
+	}
+	return opts, nil
+}
+
+// printUsage writes a usage message listing every flag.
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: lang [flags] <file or directory>")
+	fmt.Fprintln(w, "       lang lint [flags] <file>")
+	fmt.Fprintln(w, "       lang fmt [--check] <file>...")
+	fmt.Fprintln(w, "       lang run [flags] <file or directory> [-- args...]")
+	fs := newFlagSet(&Options{OptLevel: "0", Std: "c99", Warnings: "default", MaxErrors: 20, Color: "auto", Emit: "bin", OutDir: "."})
+	fs.SetOutput(w)
+	fs.PrintDefaults()
+}
+
+// printHelp writes the full --help text: usage, emit modes, flags and
+// examples.
+func printHelp(w io.Writer) {
+	fmt.Fprintln(w, "lang compiles a .lang program to C and builds it with gcc.")
+	fmt.Fprintln(w)
+	printUsage(w)
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Emit modes (--emit):")
+	fmt.Fprintln(w, "  tokens  print the token stream")
+	fmt.Fprintln(w, "  ast     print the syntax tree")
+	fmt.Fprintln(w, "  lang    print the source in the canonical format")
+	var names []string
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		gen := backends[name](&Options{})
+		fmt.Fprintf(w, "  %-7s write <file>%s\n", name, gen.FileExtension())
+	}
+	fmt.Fprintln(w, "  bin     build the executable <file> (default)")
+	fmt.Fprintf(w, "  lib     build the shared library <file>%s\n", sharedLibExtension())
+	fmt.Fprintln(w, "  makefile print a Makefile building the input files or directory")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Error codes (--explain <code>):")
+	var codes []string
+	for code := range errorCodes {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		fmt.Fprintf(w, "  %-12s %s\n", code, errorCodes[code])
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Warning categories (--werror=<categories>, which also takes the lint checks below):")
+	var categories []string
+	for name := range warningCategories {
+		categories = append(categories, name)
+	}
+	sort.Strings(categories)
+	for _, name := range categories {
+		fmt.Fprintf(w, "  %-12s %s\n", name, warningCategories[name])
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Lint checks (--disable, or --enable for those off by default):")
+	var checks []string
+	for name := range lintChecks {
+		checks = append(checks, name)
+	}
+	sort.Strings(checks)
+	for _, name := range checks {
+		fmt.Fprintf(w, "  %-12s %s\n", name, lintChecks[name])
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Environment:")
+	fmt.Fprintln(w, "  LANG_FLAGS    default flags, read before the command line's")
+	fmt.Fprintln(w, "  WASI_SYSROOT  wasi-libc sysroot for --emit=wasm")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Flag defaults are also read from a .langrc file in the current directory")
+	fmt.Fprintln(w, "or a parent, up to the project root, holding a JSON object of flag names")
+	fmt.Fprintln(w, "and values such as {\"std\": \"c11\", \"O2\": true}. LANG_FLAGS and the")
+	fmt.Fprintln(w, "command line override it.")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Examples:")
+	fmt.Fprintln(w, "  lang sample.lang                    build ./sample")
+	fmt.Fprintln(w, "  lang src/                           build every .lang file in src into ./src")
+	fmt.Fprintln(w, "  lang --emit=c sample.lang           write sample.c")
+	fmt.Fprintln(w, "  lang -O2 --print-return sample.lang build, run and print the exit status")
+	fmt.Fprintln(w, "  lang lint sample.lang               report likely mistakes without building")
+	fmt.Fprintln(w, "  lang fmt *.lang                     rewrite files in the canonical format")
+	fmt.Fprintln(w, "  lang --emit=makefile src/ > Makefile write a Makefile building src")
+	fmt.Fprintln(w, "  lang run sample.lang -- a b         build and run with arguments a and b")
+	fmt.Fprintln(w, "  lang --eval \"2 + 3 * 4\"             print 14")
+	fmt.Fprintln(w, "  lang --explain sign-compare         describe a warning, with an example")
+	fmt.Fprintln(w, "  lang --explain E0003                describe an error")
+}
+
+// DiagReporter prints diagnostics for one source file to stderr, quoting
+// the offending line with a caret under the reported column.
+type DiagReporter struct {
+	File string
+	// MaxErrors caps how many errors are shown; 0 means no limit.
+	MaxErrors int
+	// Color enables ANSI colors for the severity and caret.
+	Color bool
+	// TabWidth must match the Lexer's so columns map back to the line.
+	TabWidth int
+
+	lines []string
+}
+
+func NewDiagReporter(file, code string) *DiagReporter {
+	return &DiagReporter{File: file, lines: strings.Split(code, "\n")}
+}
+
+const (
+	ansiReset   = "\x1b[0m"
+	ansiBold    = "\x1b[1m"
+	ansiRed     = "\x1b[1;31m"
+	ansiMagenta = "\x1b[1;35m"
+	ansiGreen   = "\x1b[1;32m"
+)
+
+// Report prints diags in source order. Once MaxErrors errors have been
+// shown the rest are summarised in a single line.
+func (r *DiagReporter) Report(diags []Diagnostic) {
+	diags = append([]Diagnostic(nil), diags...)
+	sortDiagnostics(diags)
+	errors := 0
+	for i, d := range diags {
+		if d.Severity == Error {
+			if r.MaxErrors > 0 && errors == r.MaxErrors {
+				rest := 0
+				for _, d := range diags[i:] {
+					if d.Severity == Error {
+						rest++
+					}
+				}
+				fmt.Fprintf(os.Stderr, "...and %d more errors\n", rest)
+				return
+			}
+			errors++
+		}
+		fmt.Fprint(os.Stderr, r.format(d))
+	}
+}
+
+func (r *DiagReporter) format(d Diagnostic) string {
+	severity := d.Severity.String()
+	caret := "^"
+	if r.Color {
+		color := ansiMagenta
+		if d.Severity == Error {
+			color = ansiRed
+		}
+		severity = color + severity + ansiReset
+		caret = ansiGreen + caret + ansiReset
+	}
+	out := fmt.Sprintf("%s:%s: %s: %s%s\n", r.File, d.Pos, severity, d.Message, d.categorySuffix())
+	if d.Pos.Line < 1 || d.Pos.Line > len(r.lines) {
+		return out
+	}
+	line := r.lines[d.Pos.Line-1]
+	// Keep tabs in the indent so the caret lines up however they render.
+	indent := ""
+	pos := Pos{Line: 1, Col: 1}
+	for _, c := range line {
+		if pos.Col >= d.Pos.Col {
+			break
+		}
+		pos = advance(pos, string(c), r.TabWidth)
+		if c == '\t' {
+			indent += "\t"
+		} else {
+			indent += " "
+		}
+	}
+	return out + line + "\n" + indent + caret + "\n"
+}
+
+// useColor decides whether diagnostics on f should be colored: always with
+// --color, never with --no-color or NO_COLOR set, otherwise when f is a
+// terminal.
+func useColor(mode string, f *os.File) bool {
+	switch mode {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// gccArgs builds the gcc command line compiling srcs into exe and linking
+// it with libs.
+func gccArgs(opts *Options, exe string, srcs, libs []string) []string {
+	args := append(gccFlags(opts), srcs...)
+	for _, lib := range libs {
+		args = append(args, "-l"+lib)
+	}
+	return append(args, "-o", exe)
+}
+
+// buildC compiles each C file in srcs, generated from the lang file at
+// the same index in files, to an object beside it, then links the objects
+// into exe. gcc's output goes to stderr. A failure is a CompilerError in
+// the compile phase, naming the lang file, or in the link phase, naming
+// input. A dry run prints the gcc commands instead of running them.
+func buildC(opts *Options, input, exe string, files, srcs, libs []string) error {
+	var cmds [][]string
+	var objs []string
+	for _, src := range srcs {
+		obj := strings.TrimSuffix(src, ".c") + ".o"
+		cmds = append(cmds, append(gccFlags(opts), "-c", src, "-o", obj))
+		objs = append(objs, obj)
+	}
+	cmds = append(cmds, gccArgs(opts, exe, objs, libs))
+	for i, args := range cmds {
+		if opts.DryRun {
+			fmt.Println(shellJoin(append([]string{"gcc"}, args...)))
+			continue
+		}
+		out, err := runGCC(opts, args)
+		// gcc's warnings are worth seeing even when it succeeds
+		os.Stderr.Write(out)
+		if err != nil && i < len(files) {
+			return &CompilerError{Phase: "compile", File: files[i], Err: err}
+		}
+		if err != nil {
+			return &CompilerError{Phase: "link", File: input, Err: err}
+		}
+	}
+	return nil
+}
+
+// gccFlags returns the options gcc is given besides its files.
+func gccFlags(opts *Options) []string {
+	args := []string{"-std=" + opts.Std, "-O" + opts.OptLevel}
+	args = append(args, gccWarnings[opts.Warnings]...)
+	if opts.Debug {
+		args = append(args, "-g")
+	}
+	if opts.NoAssert {
+		args = append(args, "-DNDEBUG")
+	}
+	if opts.Emit == "lib" {
+		args = append(args, "-shared", "-fPIC")
+	}
+	return args
+}
+
+// sharedLibExtension is the file extension of shared libraries on the
+// host platform.
+func sharedLibExtension() string {
+	switch runtime.GOOS {
+	case "darwin":
+		return ".dylib"
+	case "windows":
+		return ".dll"
+	}
+	return ".so"
+}
+
+// shellJoin renders args as a command line that a POSIX shell would split
+// back into the same arguments.
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg != "" && strings.Trim(arg, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_=+./:,@%") == "" {
+			quoted[i] = arg
+		} else {
+			quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+// shellSplit splits s into words the way a POSIX shell would, honouring
+// single and double quotes and backslash escapes, but without expansions.
+func shellSplit(s string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	for i := 0; i < len(s); i++ {
+		switch ch := s[i]; {
+		case ch == ' ' || ch == '\t' || ch == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+			continue
+		case ch == '\\':
+			i++
+			if i == len(s) {
+				return nil, fmt.Errorf("trailing backslash")
+			}
+			word.WriteByte(s[i])
+		case ch == '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated single quote")
+			}
+			word.WriteString(s[i+1 : i+1+end])
+			i += end + 1
+		case ch == '"':
+			for i++; ; i++ {
+				if i == len(s) {
+					return nil, fmt.Errorf("unterminated double quote")
+				}
+				if s[i] == '"' {
+					break
+				}
+				// Within double quotes a backslash only escapes these.
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte("\"\\$`", s[i+1]) >= 0 {
+					i++
+				}
+				word.WriteByte(s[i])
+			}
+		default:
+			word.WriteByte(ch)
+		}
+		inWord = true
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// runForStatus runs exe with args and the standard streams passed through
+// and returns the exit status it finished with.
+func runForStatus(exe string, args ...string) (int, error) {
+	path, err := filepath.Abs(exe)
+	if err != nil {
+		return 0, err
+	}
+	cmd := exec.Command(path, args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	err = cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode(), nil
+	}
+	return 0, err
+}
+
+// runGCC runs gcc with args and returns its combined output, killing it
+// once opts.Timeout passes.
+func runGCC(opts *Options, args []string) ([]byte, error) {
+	ctx := context.Background()
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	out, err := exec.CommandContext(ctx, "gcc", args...).CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return out, fmt.Errorf("gcc timed out after %v", opts.Timeout)
+	}
+	if err != nil {
+		return out, fmt.Errorf("gcc: %v", err)
+	}
+	return out, nil
+}
+
+// writeSourceMap writes mappings from generated to source as JSON to path.
+func writeSourceMap(path, source, generated string, mappings []Mapping) error {
+	data, err := json.MarshalIndent(SourceMapFile{
+		Version:   1,
+		Source:    source,
+		Generated: generated,
+		Mappings:  mappings,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// evalSource wraps an --eval expression in a program that prints it. The
+// format is print's rather than print_int's, which only takes an int, so
+// that printEvalFloat can adapt it to the expression's type.
+func evalSource(expr string) string {
+	return "int main() {\n  print(\"%d\\n\", (" + expr + "));\n  return 0;\n}\n"
+}
+
+// CompilerError reports that compiling File failed in Phase: "lex",
+// "parse", "sema", "codegen" or "link". For the phases that report
+// diagnostics, Err only counts the errors already shown.
+type CompilerError struct {
+	Phase string
+	File  string
+	Err   error
+}
+
+func (e *CompilerError) Error() string {
+	return fmt.Sprintf("%s: %s failed: %v", e.File, e.Phase, e.Err)
+}
+
+func (e *CompilerError) Unwrap() error {
+	return e.Err
+}
+
+// errorCount summarises the errors among diags for a CompilerError.
+func errorCount(diags []Diagnostic) error {
+	n := 0
+	for _, d := range diags {
+		if d.Severity == Error {
+			n++
+		}
+	}
+	if n == 1 {
+		return errors.New("1 error")
+	}
+	return fmt.Errorf("%d errors", n)
+}
+
+// exitWith prints err and exits with status 1.
+func exitWith(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
+
+// findSources lists the .lang files under dir, skipping hidden
+// directories and files whose name or path relative to dir matches the
+// glob exclude.
+func findSources(dir, exclude string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != dir && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if filepath.Ext(path) != ".lang" {
+			return nil
+		}
+		if exclude != "" {
+			rel, _ := filepath.Rel(dir, path)
+			if ok, _ := filepath.Match(exclude, d.Name()); ok {
+				return nil
+			}
+			if ok, _ := filepath.Match(exclude, rel); ok {
+				return nil
+			}
+		}
+		files = append(files, path)
+		return nil
+	})
+	return files, err
+}
+
+// compileFile runs the front end and the C backend on one file of a
+// directory build, reporting its diagnostics, and returns the C source
+// and the libraries it must be linked with.
+func compileFile(file string, opts *Options) (string, []string, error) {
+	code, err := os.ReadFile(file)
+	if err != nil {
+		return "", nil, err
+	}
+	reporter := NewDiagReporter(file, string(code))
+	reporter.MaxErrors = opts.MaxErrors
+	reporter.Color = useColor(opts.Color, os.Stderr)
+	reporter.TabWidth = opts.TabWidth
+
+	lexer := NewLexer(string(code))
+	lexer.UseScanner = opts.UseScanner
+	lexer.TabWidth = opts.TabWidth
+	ast, err := Parse(lexer)
+	if err != nil {
+		diags := parseDiagnostics(err)
+		reporter.Report(diags)
+		phase := "parse"
+		if lexer.Err() != nil {
+			phase = "lex"
+		}
+		return "", nil, &CompilerError{Phase: phase, File: file, Err: errorCount(diags)}
+	}
+	checker := &Checker{NoPrelude: opts.NoPrelude, Werror: opts.Werror, ErrorCategories: opts.WerrorCategories, MaxIdentLen: opts.MaxIdentLen, LabeledLoops: opts.LabeledLoops}
+	checker.Check(ast)
+	if opts.OptLevel != "0" && !checker.HasErrors() {
+		checker.Fold(ast)
+	}
+	checker.Diagnostics = suppress(checker.Diagnostics, lexer.Pragmas)
+	reporter.Report(append(pragmaDiagnostics(lexer.Pragmas), checker.Diagnostics...))
+	if checker.HasErrors() {
+		return "", nil, &CompilerError{Phase: "sema", File: file, Err: errorCount(checker.Diagnostics)}
+	}
+
+	fileOpts := *opts
+	fileOpts.Input = file
+	gen, _ := LookupBackend("c", &fileOpts)
+	output, err := gen.Generate(ast)
+	if err != nil {
+		return "", nil, &CompilerError{Phase: "codegen", File: file, Err: err}
+	}
+	cgen := gen.(*C99Generator)
+	cgen.Diagnostics = suppress(cgen.Diagnostics, lexer.Pragmas)
+	failed := false
+	for i, d := range cgen.Diagnostics {
+		if opts.Werror || opts.WerrorCategories[d.Category] {
+			cgen.Diagnostics[i].Severity = Error
+			failed = true
+		}
+	}
+	reporter.Report(cgen.Diagnostics)
+	if failed {
+		return "", nil, &CompilerError{Phase: "codegen", File: file, Err: errorCount(cgen.Diagnostics)}
+	}
+	return output, cgen.Libs, nil
+}
+
+// singleFileMode names the option in opts, if any, that only works on a
+// single file: the ones that stop after a phase to print what it found,
+// and the profiles, which main writes around a single compilation.
+func singleFileMode(opts *Options) string {
+	switch {
+	case opts.Lint:
+		return "lint"
+	case opts.ASTOnly:
+		return "--ast-only"
+	case opts.DumpSymbols:
+		return "--dump-symbols"
+	case opts.CPUProfile != "":
+		return "--cpuprofile"
+	case opts.MemProfile != "":
+		return "--memprofile"
+	}
+	return ""
+}
+
+// buildDir compiles every .lang file under opts.Input, each as its own C
+// translation unit, and links them into one executable or library named
+// after the directory. Files call each other's functions through extern
+// declarations, and exactly one of them defines main. It returns the exit
+// status.
+func buildDir(opts *Options) int {
+	if opts.Emit != "bin" && opts.Emit != "lib" {
+		fmt.Fprintf(os.Stderr, "--emit=%s takes a single file, not a directory\n", opts.Emit)
+		return 1
+	}
+	if mode := singleFileMode(opts); mode != "" {
+		fmt.Fprintf(os.Stderr, "%s takes a single file, not a directory\n", mode)
+		return 1
+	}
+	files, err := findSources(opts.Input, opts.Exclude)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if len(files) == 0 {
+		fmt.Fprintf(os.Stderr, "no .lang files in %s\n", opts.Input)
+		return 1
+	}
+	// A dry run only names the files it would write, in a directory
+	// standing in for the random one.
+	tmpDir := filepath.Join(os.TempDir(), "lang-build-XXXXXX")
+	if !opts.DryRun {
+		var err error
+		tmpDir, err = os.MkdirTemp("", "lang-build-")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer os.RemoveAll(tmpDir)
+	}
+	var srcs, libs []string
+	linked := map[string]bool{}
+	failed := false
+	for i, file := range files {
+		output, fileLibs, err := compileFile(file, opts)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed = true
+			continue
+		}
+		// Files in different subdirectories may share a name.
+		name := strings.TrimSuffix(filepath.Base(file), ".lang")
+		src := filepath.Join(tmpDir, fmt.Sprintf("%d-%s.c", i, name))
+		if !opts.DryRun {
+			if err := os.WriteFile(src, []byte(output), 0644); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+		}
+		srcs = append(srcs, src)
+		for _, lib := range fileLibs {
+			if !linked[lib] {
+				linked[lib] = true
+				libs = append(libs, lib)
+			}
+		}
+	}
+	if failed {
+		return 1
+	}
+
+	abs, err := filepath.Abs(opts.Input)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	exe := filepath.Join(opts.OutDir, filepath.Base(abs))
+	if opts.Emit == "lib" {
+		exe += sharedLibExtension()
+	}
+	if opts.Run {
+		exe = filepath.Join(tmpDir, "a.out")
+	} else if info, err := os.Stat(exe); err == nil && info.IsDir() {
+		fmt.Fprintf(os.Stderr, "%s is a directory; build it from elsewhere or pass --out-dir\n", exe)
+		return 1
+	}
+	if !opts.DryRun {
+		if err := os.MkdirAll(opts.OutDir, 0755); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	if err := buildC(opts, opts.Input, exe, files, srcs, libs); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if opts.DryRun {
+		return 0
+	}
+	if opts.Run || opts.PrintReturn {
+		status, err := runForStatus(exe, opts.RunArgs...)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if opts.Run {
+			return status
+		}
+		fmt.Println(status)
+	}
+	return 0
+}
+
+// emitMakefile writes to w a Makefile that builds the program in
+// opts.Inputs, one or more .lang files or a directory of them: one rule
+// per file runs lang to produce its C, and one links the C files with gcc
+// and the flags a build would use. Every input is checked first, which
+// also finds the libraries to link. It returns the exit status.
+func emitMakefile(w io.Writer, opts *Options) int {
+	files, name := opts.Inputs, ""
+	if info, err := os.Stat(files[0]); err == nil && info.IsDir() {
+		if len(files) > 1 {
+			fmt.Fprintln(os.Stderr, "--emit=makefile takes one directory or a list of files")
+			return 1
+		}
+		abs, err := filepath.Abs(files[0])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		name = filepath.Base(abs)
+		if files, err = findSources(files[0], opts.Exclude); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if len(files) == 0 {
+			fmt.Fprintf(os.Stderr, "no .lang files in %s\n", opts.Inputs[0])
+			return 1
+		}
+	} else {
+		name = strings.TrimSuffix(filepath.Base(files[0]), ".lang")
+	}
+	target := filepath.Join(opts.OutDir, name)
+	if info, err := os.Stat(target); err == nil && info.IsDir() {
+		fmt.Fprintf(os.Stderr, "%s is a directory; pass --out-dir to build elsewhere\n", target)
+		return 1
+	}
+
+	var srcs, libs []string
+	linked := map[string]bool{}
+	failed := false
+	for _, file := range files {
+		_, fileLibs, err := compileFile(file, opts)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed = true
+			continue
+		}
+		srcs = append(srcs, strings.TrimSuffix(file, ".lang")+".c")
+		for _, lib := range fileLibs {
+			if !linked[lib] {
+				linked[lib] = true
+				libs = append(libs, "-l"+lib)
+			}
+		}
+	}
+	if failed {
+		return 1
+	}
+
+	var sb strings.Builder
+	set := func(name string, values ...string) {
+		sb.WriteString(strings.TrimSpace(name+" = "+strings.Join(values, " ")) + "\n")
+	}
+	sb.WriteString("# Generated by lang --emit=makefile.\n")
+	// LANG is taken by the locale.
+	set("LANGC", "lang")
+	set("LANGFLAGS", langFlags(opts)...)
+	set("CC", "gcc")
+	set("CFLAGS", gccFlags(opts)...)
+	set("LDLIBS", libs...)
+	set("TARGET", target)
+	set("SRCS", srcs...)
+	sb.WriteString("\nall: $(TARGET)\n\n")
+	sb.WriteString("$(TARGET): $(SRCS)\n\t@mkdir -p $(@D)\n\t$(CC) $(CFLAGS) -o $@ $(SRCS) $(LDLIBS)\n\n")
+	for i, file := range files {
+		fmt.Fprintf(&sb, "%s: %s\n\t$(LANGC) $(LANGFLAGS) --emit=c --out-dir $(@D) $<\n\n", srcs[i], file)
+	}
+	sb.WriteString("clean:\n\trm -f $(TARGET) $(SRCS)\n\n")
+	sb.WriteString(".PHONY: all clean\n")
+	if _, err := io.WriteString(w, sb.String()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// langFlags returns the flags that change the C lang generates from a
+// file, for a Makefile to pass back to lang.
+func langFlags(opts *Options) []string {
+	var flags []string
+	if opts.OptLevel != "0" {
+		flags = append(flags, "-O"+opts.OptLevel)
+	}
+	if opts.Debug {
+		flags = append(flags, "--debug")
+	}
+	if opts.NoPrelude {
+		flags = append(flags, "--no-prelude")
+	}
+	if opts.ImplicitReturn {
+		flags = append(flags, "--implicit-return")
+	}
+	if opts.LabeledLoops {
+		flags = append(flags, "--enable-labeled-loops")
+	}
+	return flags
+}
+
+// formatFiles runs the fmt subcommand on opts.Inputs and returns the exit
+// status: 1 if a file did not parse or, with FmtCheck, was not formatted.
+func formatFiles(opts *Options) int {
+	status := 0
+	for _, file := range opts.Inputs {
+		code, err := os.ReadFile(file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+			continue
+		}
+		lexer := NewLexer(string(code))
+		lexer.UseScanner = opts.UseScanner
+		lexer.TabWidth = opts.TabWidth
+		ast, err := Parse(lexer)
+		if err != nil {
+			reporter := NewDiagReporter(file, string(code))
+			reporter.MaxErrors = opts.MaxErrors
+			reporter.Color = useColor(opts.Color, os.Stderr)
+			reporter.TabWidth = opts.TabWidth
+			reporter.Report(parseDiagnostics(err))
+			status = 1
+			continue
+		}
+		formatted := Format(ast, lexer.Comments)
+		if formatted == string(code) {
+			continue
+		}
+		if opts.FmtCheck {
+			fmt.Println(file)
+			status = 1
+			continue
+		}
+		info, err := os.Stat(file)
+		if err == nil {
+			err = os.WriteFile(file, []byte(formatted), info.Mode().Perm())
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+		}
+	}
+	return status
+}
+
+// printEvalFloat switches the print call evalSource wraps the expression
+// in to the %g format when the checker typed the expression as
+// floating-point, so that --eval "7.0 / 2" prints 3.5.
+func printEvalFloat(ast Node) {
+	var call *Call
+	if prog, ok := ast.(*Program); ok && len(prog.Decls) > 0 {
+		if fn, ok := prog.Decls[0].(*Function); ok && len(fn.Body) > 0 {
+			if stmt, ok := fn.Body[0].(*ExprStmt); ok {
+				call, _ = stmt.Expr.(*Call)
+			}
+		}
+	}
+	if call == nil || call.Name != "print" || len(call.Args) != 2 || !floatTypes[exprType(call.Args[1])] {
+		return
+	}
+	call.Args[0] = &StringLit{Value: `%g\n`, Pos: call.Pos}
+}
+
+// exprType returns the type the checker recorded for n, for the nodes
+// that record one, treating other expressions as int.
+func exprType(n Node) string {
+	switch n := n.(type) {
+	case *Number:
+		return intSuffixTypes[n.Suffix]
+	case *FloatLit:
+		if n.Type == "" {
+			return "double"
+		}
+		return n.Type
+	case *BinOp:
+		return n.Type
+	case *Ternary:
+		return n.Type
+	case *Unary:
+		return n.Type
+	case *Comma:
+		return exprType(n.Exprs[len(n.Exprs)-1])
+	}
+	return "int"
+}
+
+// writeMemProfile writes a heap profile to path.
+func writeMemProfile(path string) {
+	f, err := os.Create(path)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	runtime.GC() // get up-to-date statistics
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		panic(err)
+	}
+}
+
+// tempCPath returns the path createTempC would use for code. A random
+// directory has no name until it is made, so its random part is shown as
+// XXXXXX.
+func tempCPath(code string, reproducible bool) string {
+	dir, name := tempCName(code, reproducible)
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "lang-XXXXXX")
+	}
+	return filepath.Join(dir, name)
+}
+
+// tempCName returns the directory and file name of the .c file handed to
+// gcc. The directory is "" when it is to be random.
+func tempCName(code string, reproducible bool) (dir, name string) {
+	if !reproducible {
+		return "", "out.c"
+	}
+	sum := sha256.Sum256([]byte(code))
+	return filepath.Join(os.TempDir(), fmt.Sprintf("lang-%d-%x", os.Getuid(), sum[:8])), fmt.Sprintf("out-%x.c", sum[:8])
+}
+
+// createTempC creates the .c file handed to gcc in a new private
+// directory, which the caller removes. Normally the directory has a random
+// name and the file is out.c. With reproducible set both are named after
+// the source hash, so that gcc, and any debug information it records, sees
+// the same path on every build. The directory is then predictable, so it
+// is created afresh with Mkdir, failing rather than reusing one that
+// someone else made first.
+func createTempC(code string, reproducible bool) (*os.File, error) {
+	dir, name := tempCName(code, reproducible)
+	var err error
+	if dir == "" {
+		dir, err = os.MkdirTemp("", "lang-")
+	} else {
+		err = os.Mkdir(dir, 0700)
+	}
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		os.Remove(dir)
+	}
+	return f, err
+}
+
+func main() {
+    config, err := findConfig(".")
+    if err != nil {
+        fmt.Println(err)
+        return
+    }
+    opts, err := parseArgs(os.Args[1:], config, os.Getenv("LANG_FLAGS"))
+    if err == flag.ErrHelp {
+        printHelp(os.Stdout)
+        return
+    }
+    if err != nil {
+        // exit 2 for usage errors, as the flag package does
+        fmt.Fprintln(os.Stderr, err)
+        printUsage(os.Stderr)
+        os.Exit(2)
+    }
+    inputFile := opts.Input
+    if opts.Explain != "" {
+        os.Exit(explain(os.Stdout, opts.Explain))
+    }
+    if opts.Fmt {
+        os.Exit(formatFiles(opts))
+    }
+    if opts.Emit == "makefile" {
+        os.Exit(emitMakefile(os.Stdout, opts))
+    }
+    if info, err := os.Stat(inputFile); err == nil && info.IsDir() {
+        os.Exit(buildDir(opts))
+    }
+
+    if opts.CPUProfile != "" {
+        f, err := os.Create(opts.CPUProfile)
+        if err != nil {
+            panic(err)
+        }
+        defer f.Close()
+        if err := pprof.StartCPUProfile(f); err != nil {
+            panic(err)
+        }
+        defer pprof.StopCPUProfile()
+    }
+    if opts.MemProfile != "" {
+        defer writeMemProfile(opts.MemProfile)
+    }
+
+    var code string
+    if opts.Eval != "" {
+        code = evalSource(opts.Eval)
+    } else {
+        codeBytes, err := os.ReadFile(inputFile)
+        if err != nil {
+            exitWith(&CompilerError{Phase: "read", File: inputFile, Err: err})
+        }
+        code = string(codeBytes)
+    }
+
+    reporter := NewDiagReporter(inputFile, code)
+    reporter.MaxErrors = opts.MaxErrors
+    reporter.Color = useColor(opts.Color, os.Stderr)
+    reporter.TabWidth = opts.TabWidth
+
+    lexer := NewLexer(code)
+    lexer.UseScanner = opts.UseScanner
+    lexer.TabWidth = opts.TabWidth
+    if opts.legacyMode != "" {
+        fmt.Fprintf(os.Stderr, "warning: the '%s' argument is deprecated, use --emit=%s\n", opts.legacyMode, opts.Emit)
+    }
+    if opts.Emit == "tokens" {
+        tokens, err := lexer.Tokenize()
+        if err != nil {
+            diags := []Diagnostic{parseDiagnostic(err)}
+            reporter.Report(diags)
+            exitWith(&CompilerError{Phase: "lex", File: inputFile, Err: errorCount(diags)})
+        }
+        for _, tok := range tokens {
+            fmt.Printf("%s\t%s\t%s\n", tok.Pos, tok.Kind, tok.Value)
+        }
+        return
+    }
+    ast, err := Parse(lexer)
+    if err != nil {
+        diags := parseDiagnostics(err)
+        reporter.Report(diags)
+        phase := "parse"
+        if lexer.Err() != nil {
+            phase = "lex"
+        }
+        exitWith(&CompilerError{Phase: phase, File: inputFile, Err: errorCount(diags)})
+    }
+    if opts.Emit == "lang" {
+        fmt.Print(Format(ast, lexer.Comments))
+        return
+    }
+    // Pragma warnings are reported along with the next phase's so that
+    // everything comes out in source order.
+    pragmaDiags := pragmaDiagnostics(lexer.Pragmas)
+    if opts.Lint {
+        // The checker records the types constant conditions are folded
+        // in; its warnings overlap the lint checks, so only errors show.
+        checker := &Checker{NoPrelude: opts.NoPrelude, LabeledLoops: opts.LabeledLoops}
+        checker.Check(ast)
+        if checker.HasErrors() {
+            var errs []Diagnostic
+            for _, d := range checker.Diagnostics {
+                if d.Severity == Error {
+                    errs = append(errs, d)
+                }
+            }
+            reporter.Report(append(pragmaDiags, errs...))
+            exitWith(&CompilerError{Phase: "sema", File: inputFile, Err: errorCount(errs)})
+        }
+        linter := &Linter{Disabled: opts.LintDisable, Enabled: opts.LintEnable, ErrorCategories: opts.WerrorCategories}
+        linter.Lint(ast)
+        linter.Diagnostics = suppress(linter.Diagnostics, lexer.Pragmas)
+        reporter.Report(append(pragmaDiags, linter.Diagnostics...))
+        if len(linter.Diagnostics) > 0 {
+            os.Exit(1)
+        }
+        return
+    }
+    if opts.ASTOnly {
+        reporter.Report(pragmaDiags)
+        return
+    }
+    checker := &Checker{NoPrelude: opts.NoPrelude, Werror: opts.Werror, ErrorCategories: opts.WerrorCategories, MaxIdentLen: opts.MaxIdentLen, LabeledLoops: opts.LabeledLoops}
+    checker.Check(ast)
+    if opts.Eval != "" {
+        printEvalFloat(ast)
+    }
+    if opts.OptLevel != "0" && !checker.HasErrors() {
+        checker.Fold(ast)
+    }
+    checker.Diagnostics = suppress(checker.Diagnostics, lexer.Pragmas)
+    reporter.Report(append(pragmaDiags, checker.Diagnostics...))
+    if checker.HasErrors() {
+        exitWith(&CompilerError{Phase: "sema", File: inputFile, Err: errorCount(checker.Diagnostics)})
+    }
+    if opts.DumpSymbols {
+        fmt.Print(DumpSymbols(checker.Symbols))
+        return
+    }
+    if opts.Emit == "ast" {
+        fmt.Print(DumpAST(ast, opts.Hex))
+        return
+    }
+
+    // derive output names from input file name
+    base := filepath.Base(inputFile)           // e.g. "sample.lang"
+    name := strings.TrimSuffix(base, filepath.Ext(base)) // "sample"
+    if opts.Eval != "" {
+        name = "eval"
+    } else if !opts.DryRun {
+        if err := os.MkdirAll(opts.OutDir, 0755); err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            os.Exit(1)
+        }
+    }
+    outBase := filepath.Join(opts.OutDir, name) // e.g. "build/sample"
+
+    // executables and libraries are built from the C backend's output
+    backend := opts.Emit
+    if backend == "bin" || backend == "lib" {
+        backend = "c"
+    }
+    gen, err := LookupBackend(backend, opts)
+    if err != nil {
+        exitWith(&CompilerError{Phase: "codegen", File: inputFile, Err: err})
+    }
+    output, err := gen.Generate(ast)
+    if err != nil {
+        exitWith(&CompilerError{Phase: "codegen", File: inputFile, Err: err})
+    }
+    if cgen, ok := gen.(*C99Generator); ok {
+        cgen.Diagnostics = suppress(cgen.Diagnostics, lexer.Pragmas)
+    }
+    if cgen, ok := gen.(*C99Generator); ok && len(cgen.Diagnostics) > 0 {
+        failed := false
+        for i, d := range cgen.Diagnostics {
+            if opts.Werror || opts.WerrorCategories[d.Category] {
+                cgen.Diagnostics[i].Severity = Error
+                failed = true
+            }
+        }
+        reporter.Report(cgen.Diagnostics)
+        if failed {
+            exitWith(&CompilerError{Phase: "codegen", File: inputFile, Err: errorCount(cgen.Diagnostics)})
+        }
+    }
+
+    if opts.Emit != "bin" && opts.Emit != "lib" {
+        if opts.DryRun {
+            // report the files instead of writing them
+            fmt.Println(outBase + gen.FileExtension())
+            if opts.SourceMap {
+                fmt.Println(outBase + ".c.map")
+            }
+            return
+        }
+        if err := os.WriteFile(outBase+gen.FileExtension(), []byte(output), 0644); err != nil {
+            panic(err)
+        }
+        if opts.SourceMap {
+            if err := writeSourceMap(outBase+".c.map", inputFile, name+".c", gen.(*C99Generator).SourceMap); err != nil {
+                panic(err)
+            }
+        }
+        return
+    }
+
+    exeFile := outBase
+    if opts.Emit == "lib" {
+        exeFile += sharedLibExtension()
+    }
+
+    // print the gcc command with the temporary .c file it would be given,
+    // without creating it
+    if opts.DryRun {
+        tmpName := tempCPath(code, opts.Reproducible)
+        if opts.Eval != "" || opts.Run {
+            exeFile = strings.TrimSuffix(tmpName, ".c")
+        }
+        buildC(opts, inputFile, exeFile, []string{inputFile}, []string{tmpName}, gen.(*C99Generator).Libs)
+        return
+    }
+
+    // write generated C code to a temporary .c file
+    tmpFile, err := createTempC(code, opts.Reproducible)
+    if err != nil {
+        panic(err)
+    }
+    tmpDir := filepath.Dir(tmpFile.Name())
+    defer os.RemoveAll(tmpDir)
+
+    _, err = tmpFile.WriteString(output)
+    if err != nil {
+        panic(err)
+    }
+    tmpFile.Close()
+
+    if opts.Eval != "" || opts.Run {
+        // --eval and run leave nothing behind
+        exeFile = strings.TrimSuffix(tmpFile.Name(), ".c")
+    }
+
+    // compile with gcc into current working dir
+    if err := buildC(opts, inputFile, exeFile, []string{inputFile}, []string{tmpFile.Name()}, gen.(*C99Generator).Libs); err != nil {
+        // os.Exit skips the deferred cleanup
+        os.RemoveAll(tmpDir)
+        exitWith(err)
+    }
+
+    if opts.Eval != "" {
+        if _, err := runForStatus(exeFile); err != nil {
+            panic(err)
+        }
+        return
+    }
+    if opts.Run {
+        status, err := runForStatus(exeFile, opts.RunArgs...)
+        if err != nil {
+            panic(err)
+        }
+        if status != 0 {
+            // os.Exit skips the deferred cleanup
+            os.RemoveAll(tmpDir)
+            os.Exit(status)
+        }
+        return
+    }
+    if opts.PrintReturn {
+        status, err := runForStatus(exeFile)
+        if err != nil {
+            panic(err)
+        }
+        fmt.Println(status)
     }
 }
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// options parses flags as the command line would for an input file named
+// test.lang.
+func options(t testing.TB, flags ...string) *Options {
+	t.Helper()
+	opts, err := parseArgs(append(flags, "test.lang"), nil, "")
+	if err != nil {
+		t.Fatalf("parseArgs(%q): %v", flags, err)
+	}
+	return opts
+}
+
+// parse lexes and parses src, failing the test on a syntax error.
+func parse(t testing.TB, src string) *Program {
+	t.Helper()
+	prog, err := Parse(NewLexer(src))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	return prog
+}
+
+// check parses src and checks it as the driver would with opts, folding
+// constants when opts asks for optimization.
+func check(t testing.TB, src string, opts *Options) (*Program, *Checker) {
+	t.Helper()
+	prog := parse(t, src)
+	checker := &Checker{NoPrelude: opts.NoPrelude, Werror: opts.Werror, ErrorCategories: opts.WerrorCategories, MaxIdentLen: opts.MaxIdentLen, LabeledLoops: opts.LabeledLoops}
+	checker.Check(prog)
+	if opts.OptLevel != "0" && !checker.HasErrors() {
+		checker.Fold(prog)
+	}
+	return prog, checker
+}
+
+// compile translates src to C with the C backend configured from opts,
+// failing the test on any error.
+func compile(t testing.TB, src string, opts *Options) string {
+	t.Helper()
+	out, _ := generate(t, src, opts)
+	return out
+}
+
+// generate is compile, also returning the generator for what it recorded
+// besides the code.
+func generate(t testing.TB, src string, opts *Options) (string, *C99Generator) {
+	t.Helper()
+	prog, checker := check(t, src, opts)
+	if checker.HasErrors() {
+		t.Fatalf("check:\n%s", diagnostics(checker.Diagnostics))
+	}
+	gen, err := LookupBackend("c", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := gen.Generate(prog)
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	return out, gen.(*C99Generator)
+}
+
+// diagnostics renders diags one per line, for test failures and for
+// comparing against the expected messages.
+func diagnostics(diags []Diagnostic) string {
+	var lines []string
+	for _, d := range diags {
+		lines = append(lines, d.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// diffAST compares two trees node by node, as an optimization's expected
+// and actual output for instance. It returns "" if they match, and
+// otherwise one line per difference giving the path to it. Nodes compare
+// by their dump labels, so positions and checker-filled types are ignored.
+func diffAST(want, got Node) string {
+	var sb strings.Builder
+	diffNode(&sb, nil, want, got)
+	return sb.String()
+}
+
+func diffNode(sb *strings.Builder, path []string, want, got Node) {
+	wantLabel, wantChildren := describeNode(want, false)
+	gotLabel, gotChildren := describeNode(got, false)
+	if wantLabel != gotLabel {
+		fmt.Fprintf(sb, "%s: want %s, got %s\n", strings.Join(path, " > "), wantLabel, gotLabel)
+		return
+	}
+	path = append(path, wantLabel)
+	if len(wantChildren) != len(gotChildren) {
+		fmt.Fprintf(sb, "%s: want %d children, got %d\n", strings.Join(path, " > "), len(wantChildren), len(gotChildren))
+	}
+	for i := 0; i < len(wantChildren) && i < len(gotChildren); i++ {
+		diffNode(sb, path, wantChildren[i], gotChildren[i])
+	}
+}
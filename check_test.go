@@ -0,0 +1,295 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// checkDiagnostics checks src with the default options and compares the
+// diagnostics, one per line, with want.
+func checkDiagnostics(t *testing.T, src, want string) {
+	t.Helper()
+	_, checker := check(t, src, options(t))
+	if got := diagnostics(checker.Diagnostics); got != want {
+		t.Errorf("got diagnostics:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestExternCalls(t *testing.T) {
+	checkDiagnostics(t, `
+extern int abs(int);
+int main() {
+    return abs(1, 2) + missing(3);
+}`, `4:12: error: 'abs' expects 1 argument, got 2 [E0004]
+4:24: error: call to undeclared function 'missing' [E0003]`)
+}
+
+func TestBuiltinArgs(t *testing.T) {
+	checkDiagnostics(t, `
+int main() {
+    char c = 'a';
+    uint64 big = 1UL;
+    print_int(c);
+    print_int(big);
+    print_int(1.5);
+    print_str("ok");
+    print_str(c);
+    print_int(1, 2);
+    return 0;
+}`, `6:15: error: print_int takes an int, got uint64; use print with a format instead [E0005]
+7:15: error: print_int takes an int, got double; use print with a format instead [E0005]
+9:15: error: print_str takes a string, got char; use print with a format instead [E0005]
+10:5: error: print_int expects 1 argument, got 2 [E0004]`)
+
+	_, checker := check(t, `int main() { print_int(42); return 0; }`, options(t, "--no-prelude"))
+	if got, want := diagnostics(checker.Diagnostics), "1:14: error: call to undeclared function 'print_int' [E0003]"; got != want {
+		t.Errorf("with --no-prelude got %q, want %q", got, want)
+	}
+}
+
+func TestShadowing(t *testing.T) {
+	checkDiagnostics(t, `
+int f(int n) {
+    int x = 1;
+    int x = 2;
+    {
+        int n = x;
+        int y = n;
+    }
+    return x;
+}`, `4:5: error: redeclaration of 'x' (previous declaration at 3:5) [E0002]
+6:9: warning: declaration of 'n' shadows previous declaration at 2:7 [shadow]`)
+}
+
+func TestSignCompare(t *testing.T) {
+	checkDiagnostics(t, `
+int main() {
+    int i = 0 - 1;
+    uint u = 5;
+    uint8 small = 3;
+    if (i < u) {
+        return 1;
+    }
+    if (small < i) {
+        return 2;
+    }
+    return u > 0;
+}`, `6:11: warning: comparison of integers of different signs: 'int' and 'uint' [sign-compare]`)
+}
+
+func TestStringTypes(t *testing.T) {
+	checkDiagnostics(t, `
+string name() {
+    return 1;
+}
+int main() {
+    string s = "x";
+    s[0] = 'y';
+    return name();
+}`, `3:5: error: cannot return int from function 'name' returning string [E0005]
+7:6: error: cannot assign to a character of a string [E0007]
+8:5: error: cannot return string from function 'main' returning int [E0005]`)
+}
+
+func TestMaxIdentLen(t *testing.T) {
+	const src = `
+int abcd(int abcde) {
+    int abc = abcde;
+    return abc;
+}`
+	_, checker := check(t, src, options(t, "--max-ident-len=4"))
+	want := "2:10: warning: identifier 'abcde' is 5 characters long, exceeding the limit of 4 [ident-length]"
+	if got := diagnostics(checker.Diagnostics); got != want {
+		t.Errorf("got diagnostics:\n%s\nwant:\n%s", got, want)
+	}
+	checkDiagnostics(t, src, "")
+}
+
+func TestSelfAssign(t *testing.T) {
+	const src = `
+int main() {
+    int x = 1;
+    x = x;
+    x = x + 1;
+    return x;
+}`
+	checkDiagnostics(t, src, "4:5: warning: self-assignment of 'x' has no effect [self-assign]")
+	_, checker := check(t, src, options(t, "--werror"))
+	if !checker.HasErrors() {
+		t.Errorf("--werror did not make the self-assignment an error:\n%s", diagnostics(checker.Diagnostics))
+	}
+}
+
+func TestLiteralRange(t *testing.T) {
+	checkDiagnostics(t, `
+int main() {
+    int8 a = 127;
+    int8 b = 128;
+    uint8 c = 255;
+    uint8 d = 300;
+    int16 e = 32768;
+    uint32 f = 4294967295;
+    int g = 2147483648;
+    b = 1000;
+    return 0;
+}`, `4:5: error: constant 128 overflows int8 (range -128 to 127) [E0013]
+6:5: error: constant 300 overflows uint8 (range 0 to 255) [E0013]
+7:5: error: constant 32768 overflows int16 (range -32768 to 32767) [E0013]
+9:5: error: constant 2147483648 overflows int (range -2147483648 to 2147483647) [E0013]
+10:5: error: constant 1000 overflows int8 (range -128 to 127) [E0013]`)
+}
+
+func TestStaticAssert(t *testing.T) {
+	checkDiagnostics(t, `
+int main() {
+    static_assert(2 * 3 == 6, "arithmetic");
+    static_assert(1 < 0, "ordering");
+    int x = 1;
+    static_assert(x, "constant");
+    return 0;
+}`, `4:5: error: static assertion failed: "ordering" [E0009]
+6:5: error: static_assert expression is not an integer constant [E0009]`)
+	got := compile(t, `int main() { static_assert(1 << 3 == 8, "shift"); return 0; }`, options(t))
+	if want := `_Static_assert(1 << 3 == 8, "shift");`; !strings.Contains(got, want) {
+		t.Errorf("generated C lacks %q:\n%s", want, got)
+	}
+}
+
+func TestReturnTypes(t *testing.T) {
+	checkDiagnostics(t, `
+string ok() {
+    return "fine";
+}
+int64 widen() {
+    return 1;
+}
+double real() {
+    return 1;
+}
+int bad() {
+    return "string";
+}
+int main() {
+    return ok()[0] + bad();
+}`, `12:5: error: cannot return string from function 'bad' returning int [E0005]`)
+}
+
+func TestPrintFormat(t *testing.T) {
+	checkDiagnostics(t, `
+int main() {
+    int x = 1;
+    string s = "s";
+    print("%d %s %5.2f %% %*d\n", x, s, 1.5, 3, x);
+    print("%d %d\n", x);
+    print("%d\n", x, x);
+    print("%q", x);
+    print("%");
+    print(s);
+    print();
+    return 0;
+}`, `6:5: error: print format "%d %d\n" expects 2 arguments, got 1 [E0012]
+7:5: error: print format "%d\n" expects 1 arguments, got 2 [E0012]
+8:11: error: unknown conversion '%q' in print format [E0012]
+9:11: error: print format ends in an incomplete conversion [E0012]
+10:11: error: print format must be a string literal [E0012]
+11:5: error: print expects a format string [E0012]`)
+	got := compile(t, `int main() { print("%d-%s\n", 4, "two"); return 0; }`, options(t))
+	for _, want := range []string{"#include <stdio.h>", `printf("%d-%s\n", 4, "two");`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("generated C lacks %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestNowarn(t *testing.T) {
+	const src = `
+int main() {
+    int x = 1;
+    // lang:nowarn self-assign
+    x = x;
+    x = x; // lang:nowarn
+    x = x; // lang:nowarn shadow
+    // lang:nowarn bogus
+    return x;
+}`
+	lexer := NewLexer(src)
+	prog, err := Parse(lexer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checker := &Checker{}
+	checker.Check(prog)
+	diags := append(pragmaDiagnostics(lexer.Pragmas), suppress(checker.Diagnostics, lexer.Pragmas)...)
+	want := strings.Join([]string{
+		"8:5: warning: unknown warning category in lang:nowarn: bogus",
+		"7:5: warning: self-assignment of 'x' has no effect [self-assign]",
+	}, "\n")
+	if got := diagnostics(diags); got != want {
+		t.Errorf("got diagnostics:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestDumpSymbols(t *testing.T) {
+	_, checker := check(t, `typedef int count;
+extern int abs(int x);
+int twice(count n) {
+    int r = n * 2;
+    if (r > 10) {
+        int big = 1;
+        return big;
+    }
+    return r;
+}
+int main() { return twice(3); }`, options(t))
+	want := strings.Join([]string{
+		"1:1\ttype\tcount\tint\tglobal",
+		"2:1\textern\tabs\tint(int)\tglobal",
+		"3:1\tfunction\ttwice\tint(int)\tglobal",
+		"11:1\tfunction\tmain\tint()\tglobal",
+		"3:11\tparam\tn\tint\ttwice",
+		"4:5\tvar\tr\tint\ttwice",
+		"6:9\tvar\tbig\tint\ttwice block 1",
+	}, "\n") + "\n"
+	if got := DumpSymbols(checker.Symbols); got != want {
+		t.Errorf("got symbols:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestConst(t *testing.T) {
+	checkDiagnostics(t, `extern const int* cp();
+extern int* mp();
+extern int takes(int* p);
+typedef int* iptr;
+const int* widen(int* m) { return m; }
+int* narrow(const int* c) { return c; }
+int main() {
+    const int k = 1;
+    const int* p = mp();
+    int*const q = mp();
+    const iptr a = mp();
+    int* r = cp();
+    const int arr[2] = {1, 2};
+    k = 3;
+    p[0] = 4;
+    q[0] = 5;
+    p = q;
+    q = p;
+    a = q;
+    arr[0] = 1;
+    takes(p);
+    const string s = "z";
+    s = "y";
+    return k + 1;
+}`, strings.Join([]string{
+		"6:29: error: cannot return const int* from function 'narrow' returning int* [E0005]",
+		"12:14: error: initializing 'r' of type int* with const int* discards const [E0006]",
+		"14:5: error: cannot assign to 'k', which is const int [E0007]",
+		"15:6: error: cannot assign through const int*, a pointer to const [E0007]",
+		"18:5: error: cannot assign to 'q', which is int*const [E0007]",
+		"18:5: error: assigning const int* to int* discards const [E0006]",
+		"19:5: error: cannot assign to 'a', which is int*const [E0007]",
+		"20:8: error: cannot assign to an element of const int[], a const array [E0007]",
+		"21:11: error: passing const int* as argument 1 of 'takes', which takes int*, discards const [E0006]",
+		"23:5: error: cannot assign to 's', which is const string [E0007]",
+	}, "\n"))
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLineDirectives(t *testing.T) {
+	const src = `int main() {
+    int x = 1;
+
+    return x;
+}
+`
+	got := compile(t, src, options(t))
+	want := `#line 1 "test.lang"
+int main(void) {
+#line 2 "test.lang"
+    int x = 1;
+#line 4 "test.lang"
+    return x;
+}
+`
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	opts := options(t)
+	opts.Input = ""
+	if got := compile(t, src, opts); strings.Contains(got, "#line") {
+		t.Errorf("#line emitted without a file name:\n%s", got)
+	}
+}
+
+func TestLineDirectivesGCCError(t *testing.T) {
+	requireGCC(t)
+	// The declaration clashes with the printf <stdio.h> declares for
+	// print_int, which gcc reports at the extern.
+	dir := writeFiles(t, map[string]string{"test.lang": `
+extern int printf(int x);
+
+int main() {
+    print_int(1);
+    return 0;
+}
+`})
+	_, stderr, status := lang(t, dir, "test.lang")
+	if status != 1 || !strings.HasPrefix(stderr, "test.lang:2:") {
+		t.Errorf("got status %d and stderr:\n%s\nwant 1 and an error at test.lang:2", status, stderr)
+	}
+}
+
+func TestIntWidths(t *testing.T) {
+	got := compile(t, `
+int main() {
+    int8 a = 1;
+    int16 b = 2;
+    int32 c = 3;
+    int64 d = 4;
+    return a + b + c + d;
+}`, options(t))
+	for _, want := range []string{"#include <stdint.h>", "int8_t a = 1;", "int16_t b = 2;", "int32_t c = 3;", "int64_t d = 4;"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("generated C lacks %q:\n%s", want, got)
+		}
+	}
+}
+
+// genExpr compiles expr, which may use the int variables a, b and c, and
+// returns its C rendering.
+func genExpr(t *testing.T, expr string, opts *Options) string {
+	t.Helper()
+	opts.Input = ""
+	code := compile(t, "int main() { int a = 1; int b = 2; int c = 3; return "+expr+"; }", opts)
+	start := strings.Index(code, "return ") + len("return ")
+	return code[start : start+strings.Index(code[start:], ";\n")]
+}
+
+func TestParenthesization(t *testing.T) {
+	for _, tt := range []struct {
+		expr, want string
+	}{
+		{"a + b * c", "a + b * c"},
+		{"(a + b) * c", "(a + b) * c"},
+		{"a - (b - c)", "a - (b - c)"},
+		{"(a - b) - c", "a - b - c"},
+		{"a * (b / c)", "a * (b / c)"},
+		{"(a << 1) + b", "(a << 1) + b"},
+		{"a << (1 + b)", "a << 1 + b"},
+		{"(a == b) == c", "a == b == c"},
+		{"a == (b == c)", "a == (b == c)"},
+		{"(a && b) || c", "a && b || c"},
+		{"((a))", "a"},
+	} {
+		if got := genExpr(t, tt.expr, options(t)); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestImplicitReturn(t *testing.T) {
+	const src = `
+int f() {
+    return 1;
+}
+int main() {
+    f();
+}`
+	got := compile(t, src, options(t, "--implicit-return"))
+	if want := "    f();\n    return 0;\n}"; !strings.Contains(got, want) {
+		t.Errorf("main lacks the implicit return:\n%s", got)
+	}
+	if n := strings.Count(got, "return"); n != 2 {
+		t.Errorf("got %d returns, want one each for f and main:\n%s", n, got)
+	}
+	if got := compile(t, src, options(t)); strings.Count(got, "return") != 1 {
+		t.Errorf("return added without --implicit-return:\n%s", got)
+	}
+	got = compile(t, "int main() { return 3; }", options(t, "--implicit-return"))
+	if n := strings.Count(got, "return"); n != 1 {
+		t.Errorf("got %d returns in a main that already returns:\n%s", n, got)
+	}
+}
+
+// upperGenerator is a toy backend listing the program's functions in upper
+// case, registered to exercise --emit with a backend main knows nothing of.
+type upperGenerator struct{}
+
+func (upperGenerator) Generate(n Node) (string, error) {
+	var out string
+	for _, decl := range n.(*Program).Decls {
+		if fn, ok := decl.(*Function); ok {
+			out += strings.ToUpper(fn.Name) + "\n"
+		}
+	}
+	return out, nil
+}
+
+func (upperGenerator) FileExtension() string { return ".up" }
+
+func init() {
+	RegisterBackend("upper", func(*Options) Generator { return upperGenerator{} })
+}
+
+func TestBackendRegistry(t *testing.T) {
+	gen, err := LookupBackend("upper", options(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := gen.(upperGenerator); !ok {
+		t.Errorf("got %T, want upperGenerator", gen)
+	}
+	if _, err := LookupBackend("nope", options(t)); err == nil || !strings.Contains(err.Error(), "c, dot, upper, wasm") {
+		t.Errorf("got error %v, want one listing the backends", err)
+	}
+	dir := writeFiles(t, map[string]string{"p.lang": "int helper() { return 1; }\nint main() { return helper(); }\n"})
+	if _, stderr, status := lang(t, dir, "--emit=upper", "p.lang"); status != 0 {
+		t.Fatalf("exit status %d:\n%s", status, stderr)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "p.up"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "HELPER\nMAIN\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+// TestGenerators drives every registered backend through the Generator
+// interface alone, as main does.
+func TestGenerators(t *testing.T) {
+	prog, _ := check(t, "int main() { return 1 + 2; }", options(t))
+	for name := range backends {
+		gen, err := LookupBackend(name, options(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ext := gen.FileExtension(); !strings.HasPrefix(ext, ".") {
+			t.Errorf("%s: extension %q does not start with a dot", name, ext)
+		}
+		if name == "wasm" {
+			// Generating WebAssembly needs clang.
+			continue
+		}
+		if out, err := gen.Generate(prog); err != nil || out == "" {
+			t.Errorf("%s: got %q, %v", name, out, err)
+		}
+	}
+}
+
+func TestDocComments(t *testing.T) {
+	opts := options(t)
+	opts.Input = ""
+	got := compile(t, `
+/// twice doubles n.
+///
+/// It never overflows.
+int twice(int n) {
+    /// not a doc comment here
+    return n * 2;
+}
+// a plain comment
+int main() {
+    return twice(2);
+}`, opts)
+	want := "// twice doubles n.\n//\n// It never overflows.\nint twice(int n) {\n    return n * 2;\n}\n"
+	if !strings.Contains(got, want) {
+		t.Errorf("doc comment not carried over:\n%s", got)
+	}
+	if strings.Contains(got, "not a doc comment") || strings.Contains(got, "plain comment") {
+		t.Errorf("non-doc comment emitted:\n%s", got)
+	}
+}
+
+func TestWasm(t *testing.T) {
+	prog, _ := check(t, "int main() { return 0; }", options(t))
+	gen, err := LookupBackend("wasm", options(t, "--emit=wasm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The C it compiles is generated as for the c backend.
+	opts := options(t, "--emit=wasm", "--debug", "--max-c-line=40")
+	want, err := LookupBackend("c", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wasm, err := LookupBackend("wasm", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := wasm.(*WasmGenerator).C; !reflect.DeepEqual(got, want) {
+		t.Errorf("wasm backend's C generator is %+v, want %+v", got, want)
+	}
+
+	// Without clang on the PATH the error says what is missing.
+	path := os.Getenv("PATH")
+	t.Setenv("PATH", t.TempDir())
+	if _, err := gen.Generate(prog); err == nil || !strings.Contains(err.Error(), "--emit=wasm needs clang") {
+		t.Errorf("got error %v without clang", err)
+	}
+	t.Setenv("PATH", path)
+
+	if _, err := exec.LookPath("clang"); err != nil {
+		t.Skip("clang not found")
+	}
+	out, err := gen.Generate(prog)
+	if err != nil {
+		t.Skipf("clang cannot target wasm32-wasi: %v", err)
+	}
+	if !strings.HasPrefix(out, "\x00asm") {
+		t.Errorf("output of %d bytes is not a wasm module", len(out))
+	}
+}
+
+func TestSourceMap(t *testing.T) {
+	const src = `int main() {
+    int x = 1;
+    if (x) {
+        x = 2;
+    }
+    return x;
+}
+`
+	_, gen := generate(t, src, options(t, "--emit=c", "--sourcemap"))
+	want := []Mapping{
+		{CLine: 2, CEndLine: 2, Line: 1, Col: 1},
+		{CLine: 4, CEndLine: 4, Line: 2, Col: 5},
+		{CLine: 6, CEndLine: 6, Line: 3, Col: 5},
+		{CLine: 8, CEndLine: 9, Line: 4, Col: 9},
+		{CLine: 11, CEndLine: 12, Line: 6, Col: 5},
+	}
+	if !reflect.DeepEqual(gen.SourceMap, want) {
+		t.Errorf("got mappings %+v, want %+v", gen.SourceMap, want)
+	}
+
+	dir := writeFiles(t, map[string]string{"p.lang": src})
+	if _, stderr, status := lang(t, dir, "--emit=c", "--sourcemap", "p.lang"); status != 0 {
+		t.Fatalf("exit status %d:\n%s", status, stderr)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "p.c.map"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var file SourceMapFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		t.Fatal(err)
+	}
+	if file.Source != "p.lang" || file.Generated != "p.c" || !reflect.DeepEqual(file.Mappings, want) {
+		t.Errorf("got source map %+v", file)
+	}
+}
+
+func TestLiteralInference(t *testing.T) {
+	opts := options(t)
+	opts.Input = ""
+	got := compile(t, `
+float half(float f) {
+    return f / 2;
+}
+int main() {
+    float x = 5;
+    double d = 5;
+    float y = x + 1;
+    x = 3;
+    print("%g\n", half(7));
+    return 0;
+}`, opts)
+	for _, want := range []string{"float x = 5.0f;", "double d = 5.0;", "float y = x + 1;", "x = 3.0f;"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("generated C lacks %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestDot(t *testing.T) {
+	out, err := (&DotGenerator{}).Generate(parse(t, `
+int main() {
+    int x = 1 + f(2);
+    return x;
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out, "digraph AST {\n") || !strings.HasSuffix(out, "}\n") {
+		t.Errorf("not a digraph:\n%s", out)
+	}
+	// Program, Function, VarDecl, BinOp, Number, Call, Number, Return and
+	// Ident: a tree of 9 nodes has 8 edges.
+	if nodes, edges := strings.Count(out, " [label="), strings.Count(out, " -> n"); nodes != 9 || edges != 8 {
+		t.Errorf("got %d nodes and %d edges, want 9 and 8:\n%s", nodes, edges, out)
+	}
+	if want := `n3 [label="BinOp(+)"];`; !strings.Contains(out, want) {
+		t.Errorf("output lacks %q:\n%s", want, out)
+	}
+}
+
+func TestMaxCLineLen(t *testing.T) {
+	const src = `int main() {
+    int short = 1;
+    return short + 200000;
+}`
+	// "    return short + 200000;" is 26 characters long.
+	for _, tt := range []struct {
+		max  string
+		want string
+	}{
+		{"0", ""},
+		{"26", ""},
+		{"25", "3:5: warning: generated C line 6 is 26 characters long, exceeding 25 [line-length]"},
+		{"17", "2:5: warning: generated C line 4 is 18 characters long, exceeding 17 [line-length]\n3:5: warning: generated C line 6 is 26 characters long, exceeding 17 [line-length]"},
+	} {
+		_, gen := generate(t, src, options(t, "--max-c-line="+tt.max))
+		if got := diagnostics(gen.Diagnostics); got != tt.want {
+			t.Errorf("--max-c-line=%s: got diagnostics:\n%s\nwant:\n%s", tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestIntSuffixes(t *testing.T) {
+	for _, tt := range []struct {
+		lit, typ, c string
+	}{
+		{"5", "int", "5"},
+		{"5u", "uint", "5U"},
+		{"100L", "int64", "100LL"},
+		{"0xffUL", "uint64", "0xffULL"},
+		{"0b101lu", "uint64", "0x5ULL"},
+	} {
+		prog, _ := check(t, "int main() { return "+tt.lit+" == 0; }", options(t))
+		var typ string
+		Walk(prog, visitFunc(func(n Node) {
+			if num, ok := n.(*Number); ok && typ == "" {
+				typ = exprType(num)
+			}
+		}))
+		if typ != tt.typ {
+			t.Errorf("%s: got type %s, want %s", tt.lit, typ, tt.typ)
+		}
+		if got := genExpr(t, tt.lit+" == 0", options(t)); got != tt.c+" == 0" {
+			t.Errorf("%s: got C %q, want %q", tt.lit, got, tt.c+" == 0")
+		}
+	}
+}
+
+func TestConstDecls(t *testing.T) {
+	opts := options(t)
+	opts.Input = ""
+	got := compile(t, "extern int* mp();\nint main() { const int* p = mp(); int*const q = mp(); const string s = \"a\"; const int k = 2; return k + p[0] + q[0]; }", opts)
+	for _, want := range []string{"const int *p = mp();", "int *const q = mp();", "const char *const s = \"a\";", "const int k = 2;"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("generated C lacks %q:\n%s", want, got)
+		}
+	}
+}
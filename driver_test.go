@@ -0,0 +1,1083 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCreateTempCReproducible(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	const code = "int main() { return 0; }\n"
+	var paths []string
+	for i := 0; i < 2; i++ {
+		f, err := createTempC(code, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		if filepath.Dir(f.Name()) == os.TempDir() {
+			t.Errorf("%s is directly in the shared temp directory", f.Name())
+		}
+		if _, err := createTempC(code, true); err == nil {
+			t.Errorf("%s was reused while still in use", f.Name())
+		}
+		os.RemoveAll(filepath.Dir(f.Name()))
+		paths = append(paths, f.Name())
+	}
+	if paths[0] != paths[1] {
+		t.Errorf("paths differ between builds: %s and %s", paths[0], paths[1])
+	}
+	f, err := createTempC("int main() { return 1; }\n", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.RemoveAll(filepath.Dir(f.Name()))
+	if f.Name() == paths[0] {
+		t.Errorf("different sources share the path %s", paths[0])
+	}
+}
+
+func TestBuildReproducible(t *testing.T) {
+	requireGCC(t)
+	if runtime.GOOS == "windows" {
+		t.Skip("the gcc wrapper is a shell script")
+	}
+	gcc, err := exec.LookPath("gcc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The wrapper records the C file gcc is given before running it.
+	bin := writeFiles(t, map[string]string{
+		"gcc": "#!/bin/sh\nfor arg; do case $arg in *.c) echo \"$arg\" >>\"$GCC_LOG\";; esac; done\nexec " + gcc + " \"$@\"\n",
+	})
+	if err := os.Chmod(filepath.Join(bin, "gcc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("GCC_LOG", filepath.Join(bin, "log"))
+	t.Setenv("TMPDIR", t.TempDir())
+	dir := writeFiles(t, map[string]string{"a.lang": "int main() { return 0; }\n"})
+	var exes [][]byte
+	for i := 0; i < 2; i++ {
+		if _, stderr, status := lang(t, dir, "--reproducible", "--debug", "a.lang"); status != 0 {
+			t.Fatalf("build %d failed with status %d: %s", i+1, status, stderr)
+		}
+		exe, err := os.ReadFile(filepath.Join(dir, "a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		exes = append(exes, exe)
+	}
+	log, err := os.ReadFile(filepath.Join(bin, "log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srcs := strings.Fields(string(log))
+	if len(srcs) != 2 || srcs[0] != srcs[1] {
+		t.Errorf("gcc was given different sources: %q", srcs)
+	}
+	if !bytes.Equal(exes[0], exes[1]) {
+		t.Error("the binaries differ between builds")
+	}
+}
+
+func TestGenerateReproducible(t *testing.T) {
+	const src = `
+int main() {
+    int x = 1;
+    return x;
+}`
+	opts := options(t, "--reproducible")
+	first, second := compile(t, src, opts), compile(t, src, opts)
+	if first != second {
+		t.Errorf("generated C differs between runs:\n%s\n---\n%s", first, second)
+	}
+	if want := `#line 2 "test.lang"`; !strings.Contains(first, want) {
+		t.Errorf("generated C lacks %s:\n%s", want, first)
+	}
+}
+
+func TestOptLevel(t *testing.T) {
+	for _, tt := range []struct {
+		flags []string
+		want  string
+	}{
+		{nil, "-O0"},
+		{[]string{"-O2"}, "-O2"},
+		{[]string{"-O1", "-O3"}, "-O3"},
+	} {
+		args := gccArgs(options(t, tt.flags...), "test", []string{"test.c"}, nil)
+		if !hasArg(args, tt.want) {
+			t.Errorf("%q: gcc args %q lack %s", tt.flags, args, tt.want)
+		}
+	}
+
+	// Levels above 0 also fold constants.
+	const src = "int main() { return 2 * 3; }"
+	if got := compile(t, src, options(t, "-O1")); !strings.Contains(got, "return 6;") {
+		t.Errorf("-O1 did not fold 2 * 3:\n%s", got)
+	}
+	if got := compile(t, src, options(t)); !strings.Contains(got, "return 2 * 3;") {
+		t.Errorf("-O0 changed 2 * 3:\n%s", got)
+	}
+}
+
+// hasArg reports whether args holds arg.
+func hasArg(args []string, arg string) bool {
+	for _, a := range args {
+		if a == arg {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDebug(t *testing.T) {
+	if args := gccArgs(options(t, "--debug"), "test", []string{"test.c"}, nil); !hasArg(args, "-g") {
+		t.Errorf("--debug: gcc args %q lack -g", args)
+	}
+	if args := gccArgs(options(t), "test", []string{"test.c"}, nil); hasArg(args, "-g") {
+		t.Errorf("gcc args %q have -g without --debug", args)
+	}
+}
+
+func TestMain(m *testing.M) {
+	if os.Getenv("LANG_TEST_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// lang runs the compiler in dir with args, as the lang command would be
+// run, by starting the test binary again with LANG_TEST_MAIN set. It
+// returns what was written to stdout and stderr and the exit status.
+func lang(t *testing.T, dir string, args ...string) (string, string, int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "LANG_TEST_MAIN=1", "LANG_FLAGS=", "NO_COLOR=")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return stdout.String(), stderr.String(), exitErr.ExitCode()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stdout.String(), stderr.String(), 0
+}
+
+// writeFiles creates a temporary directory holding files, which maps
+// names to contents, and returns its path.
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestPrintReturn(t *testing.T) {
+	requireGCC(t)
+	dir := writeFiles(t, map[string]string{"p.lang": "int main() { print_int(1); return 7; }\n"})
+	stdout, stderr, status := lang(t, dir, "--print-return", "p.lang")
+	if stdout != "1\n7\n" || status != 0 {
+		t.Errorf("got stdout %q and status %d, want %q and 0\n%s", stdout, status, "1\n7\n", stderr)
+	}
+}
+
+func TestMaxErrors(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"e.lang": `int main() {
+    return a() + b() + c();
+}
+`})
+	_, stderr, status := lang(t, dir, "--max-errors=2", "e.lang")
+	if status != 1 || strings.Count(stderr, ": error: ") != 2 || !strings.Contains(stderr, "...and 1 more errors\n") {
+		t.Errorf("got status %d and stderr:\n%s", status, stderr)
+	}
+	_, stderr, _ = lang(t, dir, "--max-errors=0", "e.lang")
+	if strings.Count(stderr, ": error: ") != 3 {
+		t.Errorf("--max-errors=0 did not show every error:\n%s", stderr)
+	}
+}
+
+func TestColor(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"e.lang": "int main() { return a(); }\n"})
+	for _, tt := range []struct {
+		flags []string
+		color bool
+	}{
+		{nil, false},
+		{[]string{"--color"}, true},
+		{[]string{"--color", "--no-color"}, false},
+	} {
+		_, stderr, _ := lang(t, dir, append(tt.flags, "e.lang")...)
+		if got := strings.Contains(stderr, ansiRed+"error"+ansiReset); got != tt.color {
+			t.Errorf("%q: got colored %v, want %v:\n%q", tt.flags, got, tt.color, stderr)
+		}
+		if !tt.color && strings.Contains(stderr, "\x1b[") {
+			t.Errorf("%q: stray ANSI codes:\n%q", tt.flags, stderr)
+		}
+	}
+}
+
+func TestUseColor(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	t.Setenv("NO_COLOR", "")
+	if !useColor("always", w) || useColor("never", w) || useColor("auto", w) {
+		t.Error("wrong color decision for a pipe")
+	}
+	t.Setenv("NO_COLOR", "1")
+	if !useColor("always", w) {
+		t.Error("NO_COLOR overrode --color")
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"p.lang": "int main() { return 1 + 2; }\n"})
+	_, stderr, status := lang(t, dir, "--ast-only", "--cpuprofile=cpu.out", "--memprofile=mem.out", "p.lang")
+	if status != 0 {
+		t.Fatalf("exit status %d:\n%s", status, stderr)
+	}
+	for _, name := range []string{"cpu.out", "mem.out"} {
+		fi, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Error(err)
+		} else if fi.Size() == 0 {
+			t.Errorf("%s is empty", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "p")); err == nil {
+		t.Error("--ast-only built an executable")
+	}
+}
+
+func TestEmit(t *testing.T) {
+	const src = "int main() { return 1 + 2; }\n"
+	for _, tt := range []struct {
+		args   []string
+		stdout string // a line of the expected output, or "" for none
+		file   string // the file written, with content, or "" for none
+		want   string
+		stderr string
+	}{
+		{args: []string{"--emit=tokens", "p.lang"}, stdout: "1:1\tINT\tint\n"},
+		{args: []string{"--emit=ast", "p.lang"}, stdout: "Program\n  Function main() -> int\n"},
+		{args: []string{"--emit=lang", "p.lang"}, stdout: "int main() {\n    return 1 + 2;\n}\n"},
+		{args: []string{"--emit=c", "p.lang"}, file: "p.c", want: "int main(void) {"},
+		{args: []string{"--emit=dot", "p.lang"}, file: "p.dot", want: "digraph"},
+		{args: []string{"--emit=bin", "p.lang"}, file: "p", want: "\x7fELF"},
+		{args: []string{"p.lang", "lex"}, stdout: "1:1\tINT\tint\n", stderr: "warning: the 'lex' argument is deprecated, use --emit=tokens\n"},
+		{args: []string{"p.lang", "ast"}, stdout: "Program\n", stderr: "warning: the 'ast' argument is deprecated, use --emit=ast\n"},
+	} {
+		if tt.file == "p" {
+			if _, err := exec.LookPath("gcc"); err != nil {
+				continue
+			}
+		}
+		dir := writeFiles(t, map[string]string{"p.lang": src})
+		stdout, stderr, status := lang(t, dir, tt.args...)
+		if status != 0 || stderr != tt.stderr {
+			t.Errorf("%q: got status %d and stderr %q, want 0 and %q", tt.args, status, stderr, tt.stderr)
+		}
+		if !strings.Contains(stdout, tt.stdout) || tt.stdout == "" && stdout != "" {
+			t.Errorf("%q: got stdout:\n%s\nwant it to contain:\n%s", tt.args, stdout, tt.stdout)
+		}
+		if tt.file == "" {
+			continue
+		}
+		got, err := os.ReadFile(filepath.Join(dir, tt.file))
+		if err != nil {
+			t.Errorf("%q: %v", tt.args, err)
+		} else if !strings.Contains(string(got), tt.want) {
+			t.Errorf("%q: %s lacks %q:\n%s", tt.args, tt.file, tt.want, got)
+		}
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	for _, tt := range []struct {
+		args []string
+		want func(*Options) bool
+	}{
+		{[]string{"a.lang"}, func(o *Options) bool { return o.Input == "a.lang" && o.Emit == "bin" && o.OptLevel == "0" }},
+		{[]string{"-O2", "a.lang", "--emit=c"}, func(o *Options) bool { return o.Input == "a.lang" && o.Emit == "c" && o.OptLevel == "2" }},
+		{[]string{"--std=c11", "--debug", "a.lang"}, func(o *Options) bool { return o.Std == "c11" && o.Debug }},
+		{[]string{"--out-dir", "build", "a.lang"}, func(o *Options) bool { return o.OutDir == "build" }},
+		{[]string{"--color", "--no-color", "a.lang"}, func(o *Options) bool { return o.Color == "never" }},
+		{[]string{"a.lang", "ast"}, func(o *Options) bool { return o.Emit == "ast" && o.legacyMode == "ast" }},
+		{[]string{"run", "a.lang", "--", "-x", "y"}, func(o *Options) bool {
+			return o.Run && o.Input == "a.lang" && reflect.DeepEqual(o.RunArgs, []string{"-x", "y"})
+		}},
+		{[]string{"--eval", "1 + 2"}, func(o *Options) bool { return o.Eval == "1 + 2" && o.Input == "<eval>" }},
+	} {
+		opts, err := parseArgs(tt.args, nil, "")
+		if err != nil {
+			t.Errorf("%q: %v", tt.args, err)
+		} else if !tt.want(opts) {
+			t.Errorf("%q: got %+v", tt.args, *opts)
+		}
+	}
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{nil, "missing input file"},
+		{[]string{"a.lang", "tree"}, "unknown mode: tree"},
+		{[]string{"--std=c89", "a.lang"}, "unsupported C standard: c89"},
+		{[]string{"--max-errors=-1", "a.lang"}, "numeric flags must not be negative"},
+		{[]string{"--eval", "1", "a.lang"}, "--eval takes no input file"},
+		{[]string{"--bogus", "a.lang"}, "flag provided but not defined: -bogus"},
+	} {
+		if _, err := parseArgs(tt.args, nil, ""); err == nil || err.Error() != tt.want {
+			t.Errorf("%q: got error %v, want %q", tt.args, err, tt.want)
+		}
+	}
+	opts, err := parseArgs([]string{"-O1", "a.lang"}, nil, "-O3 --debug")
+	if err != nil || opts.OptLevel != "1" || !opts.Debug {
+		t.Errorf("LANG_FLAGS: got %+v, %v; want -O1 from the command line and --debug from the environment", opts, err)
+	}
+}
+
+func TestHelp(t *testing.T) {
+	for _, flag := range []string{"-h", "--help"} {
+		stdout, stderr, status := lang(t, t.TempDir(), flag)
+		if status != 0 || stderr != "" {
+			t.Errorf("%s: got status %d and stderr %q", flag, status, stderr)
+		}
+		for _, want := range []string{"Usage: lang", "-emit", "-O2", "-std", "-out-dir", "Emit modes", "tokens", "Examples:", "lang run sample.lang"} {
+			if !strings.Contains(stdout, want) {
+				t.Errorf("%s: help lacks %q:\n%s", flag, want, stdout)
+			}
+		}
+	}
+}
+
+func TestUsageError(t *testing.T) {
+	for _, args := range [][]string{{"--bogus", "a.lang"}, {"-O9", "a.lang"}, {}} {
+		stdout, stderr, status := lang(t, t.TempDir(), args...)
+		if status != 2 || stdout != "" {
+			t.Errorf("%q: got status %d and stdout %q, want 2 and nothing", args, status, stdout)
+		}
+		if !strings.Contains(stderr, "Usage: lang") {
+			t.Errorf("%q: stderr lacks the usage:\n%s", args, stderr)
+		}
+	}
+}
+
+func TestStd(t *testing.T) {
+	for _, tt := range []struct {
+		flags []string
+		want  string
+	}{
+		{nil, "-std=c99"},
+		{[]string{"--std=c11"}, "-std=c11"},
+		{[]string{"--std=c17"}, "-std=c17"},
+	} {
+		if args := gccArgs(options(t, tt.flags...), "test", []string{"test.c"}, nil); !hasArg(args, tt.want) {
+			t.Errorf("%q: gcc args %q lack %s", tt.flags, args, tt.want)
+		}
+	}
+	dir := writeFiles(t, map[string]string{"p.lang": "int main() { return 0; }\n"})
+	stdout, stderr, status := lang(t, dir, "--dry-run", "--std=c11", "p.lang")
+	if status != 0 || !strings.Contains(stdout, " -std=c11 ") {
+		t.Errorf("got status %d and stdout %q, want the gcc command with -std=c11\n%s", status, stdout, stderr)
+	}
+}
+
+func TestEval(t *testing.T) {
+	requireGCC(t)
+	for _, tt := range []struct {
+		expr, want string
+	}{
+		{"2 + 3 * 4", "14\n"},
+		{"(2 + 3) * 4", "20\n"},
+		{"10 - 4 - 3", "3\n"},
+		{"1 << 4 + 1", "32\n"},
+		{"2 ** 10", "1024\n"},
+		{"7 / 2", "3\n"},
+		{"7.0 / 2", "3.5\n"},
+		{"'a'", "97\n"},
+	} {
+		stdout, stderr, status := lang(t, t.TempDir(), "--eval", tt.expr)
+		if stdout != tt.want || status != 0 {
+			t.Errorf("%s: got stdout %q and status %d, want %q and 0\n%s", tt.expr, stdout, status, tt.want, stderr)
+		}
+	}
+	if _, err := parseArgs([]string{"--no-prelude", "--eval", "1"}, nil, ""); err == nil || err.Error() != "--eval cannot be combined with --no-prelude" {
+		t.Errorf("--eval with --no-prelude: got error %v", err)
+	}
+}
+
+func TestOutDir(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"p.lang": "int main() { return 0; }\n"})
+	if _, stderr, status := lang(t, dir, "--emit=c", "--sourcemap", "--out-dir=build/c", "p.lang"); status != 0 {
+		t.Fatalf("exit status %d:\n%s", status, stderr)
+	}
+	for _, name := range []string{"build/c/p.c", "build/c/p.c.map"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "p.c")); err == nil {
+		t.Error("p.c written to the current directory")
+	}
+	if _, err := exec.LookPath("gcc"); err != nil {
+		return
+	}
+	if _, stderr, status := lang(t, dir, "--out-dir", "bin", "p.lang"); status != 0 {
+		t.Fatalf("exit status %d:\n%s", status, stderr)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "bin", "p")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	dir := writeFiles(t, map[string]string{"p.lang": "int main() { return 0; }\n"})
+	stdout, stderr, status := lang(t, dir, "--dry-run", "-O2", "--debug", "p.lang")
+	if status != 0 {
+		t.Fatalf("exit status %d:\n%s", status, stderr)
+	}
+	args := strings.Fields(stdout)
+	if len(args) == 0 || args[0] != "gcc" {
+		t.Fatalf("got %q, want a gcc command", stdout)
+	}
+	for _, want := range []string{"-O2", "-g", "-std=c99", "-o", "p"} {
+		if !hasArg(args, want) {
+			t.Errorf("command lacks %s: %s", want, stdout)
+		}
+	}
+	if tmp, _ := os.ReadDir(os.TempDir()); len(tmp) != 0 {
+		t.Errorf("--dry-run created %s in the temp directory", tmp[0].Name())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "p")); err == nil {
+		t.Error("--dry-run built an executable")
+	}
+
+	// Building a directory writes nothing either.
+	if err := os.Mkdir(filepath.Join(dir, "app"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, "p.lang"), filepath.Join(dir, "app", "p.lang")); err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr, status = lang(t, dir, "--dry-run", "--out-dir=bin", "app")
+	if status != 0 || !strings.HasPrefix(stdout, "gcc ") {
+		t.Errorf("got status %d and stdout %q, want a gcc command\n%s", status, stdout, stderr)
+	}
+	if tmp, _ := os.ReadDir(os.TempDir()); len(tmp) != 0 {
+		t.Errorf("--dry-run created %s in the temp directory", tmp[0].Name())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "bin")); err == nil {
+		t.Error("--dry-run created the output directory")
+	}
+}
+
+func TestDryRunEmit(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"a.lang": "int main() { return 0; }\n"})
+	stdout, stderr, status := lang(t, dir, "--dry-run", "--emit=c", "--sourcemap", "--out-dir", "newdir", "a.lang")
+	if status != 0 {
+		t.Fatalf("exit status %d:\n%s", status, stderr)
+	}
+	want := filepath.Join("newdir", "a.c") + "\n" + filepath.Join("newdir", "a.c.map") + "\n"
+	if stdout != want {
+		t.Errorf("got %q, want %q", stdout, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "newdir")); err == nil {
+		t.Error("--dry-run created the output directory")
+	}
+
+	// Nor is anything written to a directory that exists.
+	if _, _, status := lang(t, dir, "--dry-run", "--emit=c", "a.lang"); status != 0 {
+		t.Fatalf("exit status %d", status)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.c")); err == nil {
+		t.Error("--dry-run wrote a.c")
+	}
+}
+
+func TestShellSplit(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{"  -O2\t--debug\n", []string{"-O2", "--debug"}},
+		{`--out-dir 'my build'`, []string{"--out-dir", "my build"}},
+		{`--out-dir "a \"b\" \c"`, []string{"--out-dir", `a "b" \c`}},
+		{`a\ b c''d ""`, []string{"a b", "cd", ""}},
+	} {
+		got, err := shellSplit(tt.in)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("shellSplit(%q) = %q, %v; want %q", tt.in, got, err, tt.want)
+		}
+	}
+	for _, in := range []string{`'open`, `"open`, `trailing\`} {
+		if _, err := shellSplit(in); err == nil {
+			t.Errorf("shellSplit(%q) did not fail", in)
+		}
+	}
+}
+
+func TestEnvFlags(t *testing.T) {
+	opts, err := parseArgs([]string{"a.lang"}, nil, "-O2 --out-dir 'my build' --std=c11")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.OptLevel != "2" || opts.OutDir != "my build" || opts.Std != "c11" {
+		t.Errorf("LANG_FLAGS not applied: %+v", *opts)
+	}
+	opts, err = parseArgs([]string{"-O0", "--std=c17", "a.lang"}, nil, "-O2 --std=c11")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.OptLevel != "0" || opts.Std != "c17" {
+		t.Errorf("command line did not override LANG_FLAGS: %+v", *opts)
+	}
+	for _, tt := range []struct {
+		env, want string
+	}{
+		{"a.lang", "LANG_FLAGS: unexpected argument a.lang"},
+		{"'-O2", "LANG_FLAGS: unterminated single quote"},
+	} {
+		if _, err := parseArgs([]string{"a.lang"}, nil, tt.env); err == nil || err.Error() != tt.want {
+			t.Errorf("LANG_FLAGS=%q: got error %v, want %q", tt.env, err, tt.want)
+		}
+	}
+
+	dir := writeFiles(t, map[string]string{"p.lang": "int main() { return 0; }\n"})
+	cmd := exec.Command(os.Args[0], "p.lang")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "LANG_TEST_MAIN=1", "LANG_FLAGS=--emit=c")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "p.c")); err != nil {
+		t.Errorf("LANG_FLAGS=--emit=c did not write p.c: %v", err)
+	}
+}
+
+func TestRunCommand(t *testing.T) {
+	requireGCC(t)
+	dir := writeFiles(t, map[string]string{"echo.lang": `
+int main(int argc, char** argv) {
+    int i = 1;
+    while (i < argc) {
+        print_str(argv[i]);
+        i = i + 1;
+    }
+    return argc;
+}
+`})
+	stdout, stderr, status := lang(t, dir, "run", "echo.lang", "--", "one", "two words", "--three")
+	if stdout != "one\ntwo words\n--three\n" || status != 4 {
+		t.Errorf("got stdout %q and status %d, want the arguments and 4\n%s", stdout, status, stderr)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "echo")); err == nil {
+		t.Error("run left the executable behind")
+	}
+	if _, err := parseArgs([]string{"run", "--emit=c", "a.lang"}, nil, ""); err == nil {
+		t.Error("run accepted --emit")
+	}
+}
+
+func TestConfig(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		".langrc":         `{"std": "c11", "O2": true, "emit": "c", "max-errors": 5}`,
+		"src/a/.keep":     "",
+		"other/.git/HEAD": "",
+		"other/sub/.keep": "",
+	})
+	config, err := findConfig(filepath.Join(dir, "src", "a"))
+	if err != nil || config == nil || config.Path != filepath.Join(dir, ".langrc") {
+		t.Fatalf("got config %+v, %v; want the one in %s", config, err, dir)
+	}
+	opts, err := parseArgs([]string{"a.lang"}, config, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Std != "c11" || opts.OptLevel != "2" || opts.Emit != "c" || opts.MaxErrors != 5 {
+		t.Errorf(".langrc not applied: %+v", *opts)
+	}
+	opts, err = parseArgs([]string{"--std=c17", "a.lang"}, config, "--emit=ast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Std != "c17" || opts.Emit != "ast" || opts.OptLevel != "2" {
+		t.Errorf("flags did not override .langrc: %+v", *opts)
+	}
+
+	// The search stops at the project root.
+	if config, err := findConfig(filepath.Join(dir, "other", "sub")); config != nil || err != nil {
+		t.Errorf("found %+v, %v past the .git directory", config, err)
+	}
+
+	for _, tt := range []struct {
+		langrc, want string
+	}{
+		{`{"std": `, "unexpected end of JSON input"},
+		{`{"std": ["c11"]}`, "std must be a string, number or boolean"},
+		{`{"std": "c89"}`, "unsupported C standard: c89"},
+		{`{"bogus": 1}`, "bogus: no such flag -bogus"},
+	} {
+		dir := writeFiles(t, map[string]string{".langrc": tt.langrc})
+		config, err := findConfig(dir)
+		if err == nil {
+			_, err = parseArgs([]string{"a.lang"}, config, "")
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got error %v, want %q", tt.langrc, err, tt.want)
+		}
+	}
+}
+
+func TestWerror(t *testing.T) {
+	for _, tt := range []struct {
+		flags      []string
+		all        bool
+		categories map[string]bool
+	}{
+		{nil, false, nil},
+		{[]string{"--werror"}, true, nil},
+		{[]string{"-werror"}, true, nil},
+		{[]string{"--werror=unused"}, false, map[string]bool{"unused": true}},
+		{[]string{"--werror=shadow,sign-compare", "--werror=unused"}, false, map[string]bool{"shadow": true, "sign-compare": true, "unused": true}},
+		{[]string{"--werror", "--werror=false"}, false, nil},
+	} {
+		opts := options(t, tt.flags...)
+		if opts.Werror != tt.all || !reflect.DeepEqual(opts.WerrorCategories, tt.categories) {
+			t.Errorf("%q: got all %v and categories %v, want %v and %v", tt.flags, opts.Werror, opts.WerrorCategories, tt.all, tt.categories)
+		}
+	}
+	for _, tt := range []struct {
+		flag, want string
+	}{
+		{"--werror=unused,bogus", "unknown warning category: bogus"},
+		{"-Werror", "flag provided but not defined: -Werror"},
+	} {
+		if _, err := parseArgs([]string{tt.flag, "a.lang"}, nil, ""); err == nil || err.Error() != tt.want {
+			t.Errorf("%s: got error %v, want %q", tt.flag, err, tt.want)
+		}
+	}
+
+	const src = `
+int main(int n) {
+    int x = 1;
+    {
+        int x = 2;
+        x = x;
+    }
+    return x;
+}`
+	for _, tt := range []struct {
+		flag string
+		want string
+	}{
+		{"--werror=shadow", "5:9: error: declaration of 'x' shadows previous declaration at 3:5 [shadow]\n6:9: warning: self-assignment of 'x' has no effect [self-assign]"},
+		{"--werror", "5:9: error: declaration of 'x' shadows previous declaration at 3:5 [shadow]\n6:9: error: self-assignment of 'x' has no effect [self-assign]"},
+	} {
+		_, checker := check(t, src, options(t, tt.flag))
+		if got := diagnostics(checker.Diagnostics); !strings.HasSuffix(got, tt.want) {
+			t.Errorf("%s: got diagnostics:\n%s\nwant them to end:\n%s", tt.flag, got, tt.want)
+		}
+	}
+}
+
+func TestDiagnosticOrder(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"d.lang": `int main() {
+    int x = 1;
+    x = x;
+    // lang:nowarn bogus
+    return f();
+}
+`})
+	_, stderr, _ := lang(t, dir, "--emit=c", "d.lang")
+	var got []string
+	for _, line := range strings.Split(stderr, "\n") {
+		if strings.HasPrefix(line, "d.lang:") && !strings.Contains(line, "failed") {
+			got = append(got, line)
+		}
+	}
+	want := []string{
+		"d.lang:3:5: warning: self-assignment of 'x' has no effect [self-assign]",
+		"d.lang:4:5: warning: unknown warning category in lang:nowarn: bogus",
+		"d.lang:5:12: error: call to undeclared function 'f' [E0003]",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got diagnostics:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestSortDiagnostics(t *testing.T) {
+	diags := []Diagnostic{
+		{Pos: Pos{Line: 2, Col: 1}, Severity: Warning, Message: "c"},
+		{Pos: Pos{Line: 1, Col: 5}, Severity: Warning, Message: "b"},
+		{Pos: Pos{Line: 1, Col: 5}, Severity: Error, Message: "a"},
+		{Pos: Pos{Line: 1, Col: 1}, Severity: Warning, Message: "first"},
+	}
+	sortDiagnostics(diags)
+	var got []string
+	for _, d := range diags {
+		got = append(got, d.Message)
+	}
+	if want := []string{"first", "a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestEmitLib(t *testing.T) {
+	requireGCC(t)
+	if runtime.GOOS != "linux" {
+		t.Skip("reads the exported symbols as ELF")
+	}
+	dir := writeFiles(t, map[string]string{"l.lang": "int twice(int x) { return x * 2; }\nint add(int a, int b) { return a + b; }\n"})
+	if _, stderr, status := lang(t, dir, "--emit=lib", "l.lang"); status != 0 {
+		t.Fatalf("status %d\n%s", status, stderr)
+	}
+	lib, err := elf.Open(filepath.Join(dir, "l.so"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lib.Close()
+	symbols, err := lib.DynamicSymbols()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported := map[string]bool{}
+	for _, sym := range symbols {
+		if elf.ST_TYPE(sym.Info) == elf.STT_FUNC && sym.Section != elf.SHN_UNDEF {
+			exported[sym.Name] = true
+		}
+	}
+	if !exported["twice"] || !exported["add"] || exported["main"] {
+		t.Errorf("got exported functions %v, want twice and add", exported)
+	}
+	if _, err := parseArgs([]string{"--emit=lib", "--print-return", "l.lang"}, nil, ""); err == nil {
+		t.Error("--emit=lib was accepted with --print-return")
+	}
+}
+
+func TestFmt(t *testing.T) {
+	const messy = `// add two numbers
+int add(int a,int b){return a+b;}
+int main(){
+  int x=(1+2)*3;   // nine
+
+
+  if(x>5) x=x-1; else {x = 0;}
+  return add(x,(4));
+}
+`
+	const want = `// add two numbers
+int add(int a, int b) {
+    return a + b;
+}
+
+int main() {
+    int x = (1 + 2) * 3; // nine
+
+    if (x > 5) {
+        x = x - 1;
+    } else {
+        x = 0;
+    }
+    return add(x, 4);
+}
+`
+	dir := writeFiles(t, map[string]string{"m.lang": messy})
+	path := filepath.Join(dir, "m.lang")
+	if stdout, _, status := lang(t, dir, "fmt", "--check", "m.lang"); stdout != "m.lang\n" || status != 1 {
+		t.Errorf("fmt --check on an unformatted file: got %q and status %d, want %q and 1", stdout, status, "m.lang\n")
+	}
+	if src, _ := os.ReadFile(path); string(src) != messy {
+		t.Errorf("fmt --check rewrote the file:\n%s", src)
+	}
+	if _, stderr, status := lang(t, dir, "fmt", "m.lang"); status != 0 {
+		t.Fatalf("fmt: status %d\n%s", status, stderr)
+	}
+	if src, _ := os.ReadFile(path); string(src) != want {
+		t.Errorf("got formatted file:\n%s\nwant:\n%s", src, want)
+	}
+	if stdout, _, status := lang(t, dir, "fmt", "--check", "m.lang"); stdout != "" || status != 0 {
+		t.Errorf("fmt --check on a formatted file: got %q and status %d, want no output and 0", stdout, status)
+	}
+	if stdout, _, _ := lang(t, dir, "--emit=lang", "m.lang"); stdout != want {
+		t.Errorf("formatting is not idempotent, got:\n%s", stdout)
+	}
+}
+
+func TestCompilerError(t *testing.T) {
+	requireGCC(t)
+	dir := writeFiles(t, map[string]string{
+		"lex.lang":     "int main() { return @; }\n",
+		"parse.lang":   "int main() { return 1 +; }\n",
+		"sema.lang":    "int main() { return f(); }\n",
+		"codegen.lang": "int main() { return 1111111111 + 222222222; }\n",
+		"compile.lang": "extern int printf(int x);\nint main() { print_int(1); return 0; }\n",
+		"link.lang":    "int f() { return 0; }\n",
+	})
+	for _, tt := range []struct {
+		file  string
+		flags []string
+		want  string
+	}{
+		{"missing.lang", nil, "missing.lang: read failed: open missing.lang: no such file or directory"},
+		{"lex.lang", nil, "lex.lang: lex failed: 1 error"},
+		{"parse.lang", nil, "parse.lang: parse failed: 1 error"},
+		{"sema.lang", nil, "sema.lang: sema failed: 1 error"},
+		{"codegen.lang", []string{"--max-c-line=20", "--werror=line-length"}, "codegen.lang: codegen failed: 1 error"},
+		{"compile.lang", nil, "compile.lang: compile failed: gcc: exit status 1"},
+		{"link.lang", nil, "link.lang: link failed: gcc: exit status 1"},
+	} {
+		_, stderr, status := lang(t, dir, append(tt.flags, tt.file)...)
+		lines := strings.Split(strings.TrimSpace(stderr), "\n")
+		if got := lines[len(lines)-1]; got != tt.want || status != 1 {
+			t.Errorf("%s: got %q and status %d, want %q and 1", tt.file, got, status, tt.want)
+		}
+	}
+	cause := errors.New("boom")
+	err := error(&CompilerError{Phase: "link", File: "a.lang", Err: cause})
+	if err.Error() != "a.lang: link failed: boom" || !errors.Is(err, cause) {
+		t.Errorf("got %v, which does not unwrap to %v", err, cause)
+	}
+	if got := errorCount([]Diagnostic{{Severity: Error}, {Severity: Warning}, {Severity: Error}}).Error(); got != "2 errors" {
+		t.Errorf("got %q, want 2 errors", got)
+	}
+}
+
+func TestDirSingleFileModes(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"app/main.lang": "int main() { return 0; }\n"})
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"lint", "app"}, "lint takes a single file, not a directory\n"},
+		{[]string{"--ast-only", "app"}, "--ast-only takes a single file, not a directory\n"},
+		{[]string{"--dump-symbols", "app"}, "--dump-symbols takes a single file, not a directory\n"},
+		{[]string{"--cpuprofile=cpu.out", "app"}, "--cpuprofile takes a single file, not a directory\n"},
+		{[]string{"--memprofile=mem.out", "app"}, "--memprofile takes a single file, not a directory\n"},
+		{[]string{"--emit=ast", "app"}, "--emit=ast takes a single file, not a directory\n"},
+		{[]string{"--emit=c", "--sourcemap", "app"}, "--emit=c takes a single file, not a directory\n"},
+	} {
+		stdout, stderr, status := lang(t, dir, tt.args...)
+		if stderr != tt.want || stdout != "" || status != 1 {
+			t.Errorf("%q: got stdout %q, stderr %q and status %d; want stderr %q and 1", tt.args, stdout, stderr, status, tt.want)
+		}
+	}
+}
+
+func TestBuildDir(t *testing.T) {
+	requireGCC(t)
+	dir := writeFiles(t, map[string]string{
+		"app/main.lang":      "extern int twice(int x);\nint main() { print_int(twice(21)); return 0; }\n",
+		"app/util/math.lang": "int twice(int x) { return x * 2; }\n",
+		"app/main_test.lang": "int main() { return 1; }\n",
+		"app/.hidden/x.lang": "this is not lang\n",
+	})
+	files, err := findSources(filepath.Join(dir, "app"), "*_test.lang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Join(dir, "app", "main.lang"), filepath.Join(dir, "app", "util", "math.lang")}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("got sources %q, want %q", files, want)
+	}
+	stdout, stderr, status := lang(t, dir, "run", "--exclude=*_test.lang", "app")
+	if stdout != "42\n" || status != 0 {
+		t.Errorf("got stdout %q and status %d, want %q and 0\n%s", stdout, status, "42\n", stderr)
+	}
+	if _, stderr, status := lang(t, dir, "--out-dir=bin", "--exclude=*_test.lang", "app"); status != 0 {
+		t.Errorf("status %d\n%s", status, stderr)
+	} else if _, err := os.Stat(filepath.Join(dir, "bin", "app")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGCCTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the stub gcc is a shell script")
+	}
+	bin := writeFiles(t, map[string]string{"gcc": "#!/bin/sh\nexec sleep 10\n"})
+	if err := os.Chmod(filepath.Join(bin, "gcc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	opts := options(t, "--timeout=200ms")
+	start := time.Now()
+	_, err := runGCC(opts, nil)
+	if err == nil || err.Error() != "gcc timed out after 200ms" {
+		t.Errorf("got error %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("gcc was killed after %v", elapsed)
+	}
+	if _, err := parseArgs([]string{"--timeout=soon", "a.lang"}, nil, ""); err == nil {
+		t.Error("a malformed --timeout was accepted")
+	}
+}
+
+func TestWarnings(t *testing.T) {
+	for set, want := range map[string][]string{
+		"none":    {"-w"},
+		"default": nil,
+		"all":     {"-Wall"},
+		"extra":   {"-Wall", "-Wextra"},
+	} {
+		args := gccArgs(options(t, "--warnings="+set), "out", []string{"in.c"}, nil)
+		var got []string
+		for _, arg := range args {
+			if strings.HasPrefix(arg, "-W") || arg == "-w" {
+				got = append(got, arg)
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("--warnings=%s: got %q in %q, want %q", set, got, args, want)
+		}
+	}
+	if _, err := parseArgs([]string{"--warnings=pedantic", "a.lang"}, nil, ""); err == nil || err.Error() != "unknown warning set: pedantic" {
+		t.Errorf("--warnings=pedantic: got error %v", err)
+	}
+
+	requireGCC(t)
+	dir := writeFiles(t, map[string]string{"w.lang": "int main() {\n    int y = 1;\n    return 0;\n}\n"})
+	_, stderr, status := lang(t, dir, "--warnings=all", "w.lang")
+	if want := "w.lang:2:9: warning: unused variable 'y'"; status != 0 || !strings.Contains(stderr, want) {
+		t.Errorf("--warnings=all: got status %d and stderr %q, want 0 and %q", status, stderr, want)
+	}
+	if _, stderr, _ := lang(t, dir, "--warnings=none", "w.lang"); stderr != "" {
+		t.Errorf("--warnings=none: got stderr %q", stderr)
+	}
+}
+
+func TestExplain(t *testing.T) {
+	for code := range errorCodes {
+		if explanations[code] == "" {
+			t.Errorf("error code %s has no explanation", code)
+		}
+	}
+	for name := range warningCategories {
+		if explanations[name] == "" {
+			t.Errorf("warning category %s has no explanation", name)
+		}
+	}
+	for name := range lintChecks {
+		if explanations[name] == "" {
+			t.Errorf("lint check %s has no explanation", name)
+		}
+	}
+	stdout, _, status := lang(t, t.TempDir(), "--explain", "shadow")
+	if want := "shadow\n\n" + explanations["shadow"] + "\n"; stdout != want || status != 0 {
+		t.Errorf("got %q and status %d, want %q and 0", stdout, status, want)
+	}
+	// An error's code is printed with it and can be looked up.
+	dir := writeFiles(t, map[string]string{"e.lang": "int main() { return f(); }\n"})
+	_, stderr, _ := lang(t, dir, "e.lang")
+	if want := "e.lang:1:21: error: call to undeclared function 'f' [E0003]\n"; !strings.HasPrefix(stderr, want) {
+		t.Errorf("got stderr %q, want it to start with %q", stderr, want)
+	}
+	stdout, _, status = lang(t, t.TempDir(), "--explain", "E0003")
+	if want := "E0003\n\n" + explanations["E0003"] + "\n"; stdout != want || status != 0 {
+		t.Errorf("got %q and status %d, want %q and 0", stdout, status, want)
+	}
+	_, stderr, status = lang(t, t.TempDir(), "--explain", "E9999")
+	if !strings.Contains(stderr, `no explanation for "E9999"`) || status != 1 {
+		t.Errorf("got stderr %q and status %d, want no explanation and 1", stderr, status)
+	}
+	if _, err := parseArgs([]string{"--explain", "shadow", "a.lang"}, nil, ""); err == nil || err.Error() != "--explain takes no input file" {
+		t.Errorf("--explain with a file: got error %v", err)
+	}
+}
+
+func TestEmitMakefile(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.lang": "extern double sq(double x);\nint main() { print(\"%g\\n\", sq(3.0)); return 0; }\n",
+		"util.lang": "double sq(double x) { return x ** 2; }\n",
+		"bad.lang":  "int main() { return f(); }\n",
+	})
+	stdout, stderr, status := lang(t, dir, "--emit=makefile", "-O2", "main.lang", "util.lang")
+	want := "# Generated by lang --emit=makefile.\n" +
+		"LANGC = lang\n" +
+		"LANGFLAGS = -O2\n" +
+		"CC = gcc\n" +
+		"CFLAGS = -std=c99 -O2\n" +
+		"LDLIBS = -lm\n" +
+		"TARGET = main\n" +
+		"SRCS = main.c util.c\n" +
+		"\n" +
+		"all: $(TARGET)\n" +
+		"\n" +
+		"$(TARGET): $(SRCS)\n" +
+		"\t@mkdir -p $(@D)\n" +
+		"\t$(CC) $(CFLAGS) -o $@ $(SRCS) $(LDLIBS)\n" +
+		"\n" +
+		"main.c: main.lang\n" +
+		"\t$(LANGC) $(LANGFLAGS) --emit=c --out-dir $(@D) $<\n" +
+		"\n" +
+		"util.c: util.lang\n" +
+		"\t$(LANGC) $(LANGFLAGS) --emit=c --out-dir $(@D) $<\n" +
+		"\n" +
+		"clean:\n" +
+		"\trm -f $(TARGET) $(SRCS)\n" +
+		"\n" +
+		".PHONY: all clean\n"
+	if stdout != want || status != 0 {
+		t.Fatalf("got status %d and Makefile:\n%s\nwant:\n%s\n%s", status, stdout, want, stderr)
+	}
+	if _, stderr, status := lang(t, dir, "--emit=makefile", "bad.lang"); status != 1 || !strings.Contains(stderr, "call to undeclared function 'f'") {
+		t.Errorf("a file with an error: got status %d and stderr %q", status, stderr)
+	}
+
+	requireGCC(t)
+	if _, err := exec.LookPath("make"); err != nil {
+		t.Skip("make not found")
+	}
+	if err := os.WriteFile(filepath.Join(dir, "Makefile"), []byte(stdout), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// LANGC runs this test binary as the compiler.
+	langc := filepath.Join(dir, "langc")
+	script := "#!/bin/sh\nLANG_TEST_MAIN=1 LANG_FLAGS= exec " + os.Args[0] + " \"$@\"\n"
+	if err := os.WriteFile(langc, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("make", "LANGC="+langc)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("make: %v\n%s", err, out)
+	}
+	out, err := exec.Command(filepath.Join(dir, "main")).Output()
+	if err != nil || string(out) != "9\n" {
+		t.Errorf("got %q, %v; want 9", out, err)
+	}
+	cmd = exec.Command("make", "-q", "LANGC="+langc)
+	cmd.Dir = dir
+	if err := cmd.Run(); err != nil {
+		t.Errorf("make -q after a build: %v, want the target up to date", err)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// fold checks and folds src at -O1, returning the generated C without line
+// directives and the checker's diagnostics.
+func fold(t *testing.T, src string) (string, string) {
+	t.Helper()
+	opts := options(t, "-O1")
+	opts.Input = ""
+	_, checker := check(t, src, opts)
+	return compile(t, src, opts), diagnostics(checker.Diagnostics)
+}
+
+func TestFoldOverflow(t *testing.T) {
+	code, diags := fold(t, `
+int main() {
+    int64 big = 2000000000L + 2000000000L;
+    uint u = 4000000000U + 1000000000U;
+    int small = 1000 + 2000;
+    return 2000000000 + 2000000000;
+}`)
+	for _, want := range []string{
+		"int64_t big = 4000000000LL;",
+		"unsigned int u = 4000000000U + 1000000000U;",
+		"int small = 3000;",
+		"return 2000000000 + 2000000000;",
+	} {
+		if !strings.Contains(code, want) {
+			t.Errorf("generated C lacks %q:\n%s", want, code)
+		}
+	}
+	if want := "6:23: warning: integer overflow in constant expression: 2000000000 + 2000000000 does not fit in int [overflow]"; diags != want {
+		t.Errorf("got diagnostics:\n%s\nwant:\n%s", diags, want)
+	}
+}
+
+func TestFoldPropagation(t *testing.T) {
+	code, _ := fold(t, `
+int main() {
+    int a = 2;
+    int b = a * 3;
+    int c = b + 1;
+    a = 10;
+    int d = a + 1;
+    a = c;
+    a = a + b;
+    return a + d;
+}`)
+	for _, want := range []string{"int b = 6;", "int c = 7;", "int d = 11;", "a = 7;", "a = 13;", "return 24;"} {
+		if !strings.Contains(code, want) {
+			t.Errorf("generated C lacks %q:\n%s", want, code)
+		}
+	}
+}
+
+func TestFoldInvalidation(t *testing.T) {
+	code, _ := fold(t, `
+int f(int n) {
+    return n;
+}
+int main() {
+    int x = 1;
+    int y = 2;
+    int r = f(0) ? (x = 5) : x + 1;
+    int s = x;
+    if (f(1)) {
+        y = 3;
+    } else {
+        r = y;
+    }
+    int t = y;
+    while (x < 10) {
+        x = x + 1;
+    }
+    return r + s + t + x;
+}`)
+	for _, want := range []string{
+		// The else branch reads x before the then branch could assign it.
+		"int r = f(0) ? x = 5 : 2;",
+		"int s = x;",
+		"r = 2;",
+		"int t = y;",
+		"while (x < 10) {",
+		"x = x + 1;",
+		"return r + s + t + x;",
+	} {
+		if !strings.Contains(code, want) {
+			t.Errorf("generated C lacks %q:\n%s", want, code)
+		}
+	}
+}
+
+func TestFoldAST(t *testing.T) {
+	got, _ := check(t, `
+int main() {
+    int a = 2 * 3;
+    int b = a + 1;
+    return b * 0x10;
+}`, options(t, "-O1"))
+	want := parse(t, `
+int main() {
+    int a = 6;
+    int b = 7;
+    return 112;
+}`)
+	if diff := diffAST(want, got); diff != "" {
+		t.Errorf("folded tree differs:\n%s", diff)
+	}
+}
+
+func TestDiffAST(t *testing.T) {
+	want := parse(t, "int main() { int x = 1 + 2; return x; }")
+	if diff := diffAST(want, parse(t, "int main() {\n    int x = 1 + 2;\n    return x;\n}")); diff != "" {
+		t.Errorf("layout made a difference:\n%s", diff)
+	}
+	got := parse(t, "int main() { int x = 1 * 2; return x; x = 1; }")
+	wantDiff := "Program > Function main() -> int: want 2 children, got 3\n" +
+		"Program > Function main() -> int > VarDecl int x: want BinOp(+), got BinOp(*)\n"
+	if diff := diffAST(want, got); diff != wantDiff {
+		t.Errorf("got diff:\n%s\nwant:\n%s", diff, wantDiff)
+	}
+}
+
+func TestFoldPower(t *testing.T) {
+	code, diags := fold(t, `
+int main() {
+    int64 big = 3L ** 39L;
+    int n = 2 ** 3 ** 2;
+    int neg = 2 ** (0 - 1);
+    double d = 2.0 ** 10;
+    return 3 ** 40;
+}`)
+	for _, want := range []string{
+		"int64_t big = 4052555153018976267LL;",
+		"int n = 512;",
+		"int neg = lang_pow_int(2, -1);",
+		"double d = pow(2.0, 10);",
+		"return lang_pow_int(3, 40);",
+	} {
+		if !strings.Contains(code, want) {
+			t.Errorf("generated C lacks %q:\n%s", want, code)
+		}
+	}
+	if want := "7:14: warning: integer overflow in constant expression: 3 ** 40 does not fit in int [overflow]"; diags != want {
+		t.Errorf("got diagnostics:\n%s\nwant:\n%s", diags, want)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// lexCorpus returns the testdata programs concatenated n times, a source
+// of realistic size for the benchmarks.
+func lexCorpus(t testing.TB, n int) string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join("testdata", "*.lang"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sb strings.Builder
+	for i := 0; i < n; i++ {
+		for _, file := range files {
+			src, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sb.Write(src)
+		}
+	}
+	return sb.String()
+}
+
+func benchmarkLex(b *testing.B, useScanner bool) {
+	code := lexCorpus(b, 10)
+	b.SetBytes(int64(len(code)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lexer := NewLexer(code)
+		lexer.UseScanner = useScanner
+		if _, err := lexer.Tokenize(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkLexRegexp(b *testing.B)  { benchmarkLex(b, false) }
+func BenchmarkLexScanner(b *testing.B) { benchmarkLex(b, true) }
+
+// lexSamples exercise the corners of every token rule.
+var lexSamples = []string{
+	"int main() { return 0; }",
+	"1 12 1.5 1.5e3 2e10 1e 1.e5 1. 3E-2 0x1F 0X 0b101 0b2 017 5u 5UL 5lu 5Lx 0xffU 1.5u",
+	`"" "a\"b" "tab\t" "open` + "\n" + `'a' '\n' '\x41' '\u0041' '\101' '\''`,
+	"a==b!=c<=d>=e<<f>>g&&h||i**j+k-l*m/n=o<p>q~r",
+	"x ? y : z; a[1], (b);",
+	"/// doc\n// comment\n// lang:nowarn shadow\nint x;",
+	"int é = 1; string 名前 = \"x\"; _a1",
+	"int x = 1 + \\\n 2;\tint\ty;",
+	"a \\ b \\",
+	"typedef const int* p; static_assert assert const",
+	"@",
+	"a % b",
+	"'ab'",
+	"'\\q'",
+	"\xff",
+}
+
+func lexAll(code string, useScanner bool) ([]Token, []Token, error) {
+	lexer := NewLexer(code)
+	lexer.UseScanner = useScanner
+	tokens, err := lexer.Tokenize()
+	return tokens, lexer.Comments, err
+}
+
+// TestScannerMatchesRegexp checks that the hand-written scanner produces
+// exactly the tokens, comments and errors that the regular expressions
+// do, over the samples and the testdata programs.
+func TestScannerMatchesRegexp(t *testing.T) {
+	corpus := append([]string{lexCorpus(t, 1)}, lexSamples...)
+	for _, code := range corpus {
+		want, wantComments, wantErr := lexAll(code, false)
+		got, gotComments, gotErr := lexAll(code, true)
+		if fmt.Sprint(gotErr) != fmt.Sprint(wantErr) {
+			t.Errorf("%q: scanner error %v, regexp error %v", code, gotErr, wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%q:\nscanner: %v\nregexp:  %v", code, got, want)
+		}
+		if !reflect.DeepEqual(gotComments, wantComments) {
+			t.Errorf("%q: scanner comments %v, regexp comments %v", code, gotComments, wantComments)
+		}
+	}
+}
+
+func FuzzScannerMatchesRegexp(f *testing.F) {
+	for _, code := range lexSamples {
+		f.Add(code)
+	}
+	f.Fuzz(func(t *testing.T, code string) {
+		want, _, wantErr := lexAll(code, false)
+		got, _, gotErr := lexAll(code, true)
+		if fmt.Sprint(gotErr) != fmt.Sprint(wantErr) || !reflect.DeepEqual(got, want) {
+			t.Errorf("%q:\nscanner: %v %v\nregexp:  %v %v", code, got, gotErr, want, wantErr)
+		}
+	})
+}
+
+func TestLexerNext(t *testing.T) {
+	lexer := NewLexer("return x;")
+	var kinds []TokenKind
+	for i := 0; i < 5; i++ {
+		tok, err := lexer.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		kinds = append(kinds, tok.Kind)
+	}
+	want := []TokenKind{KindReturn, KindID, KindSemi, KindEOF, KindEOF}
+	if !reflect.DeepEqual(kinds, want) {
+		t.Errorf("got kinds %v, want %v", kinds, want)
+	}
+}
+
+func TestStreamParser(t *testing.T) {
+	src := lexCorpus(t, 1)
+	tokens, err := NewLexer(src).Tokenize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := diffAST(NewParser(tokens).ParseProgram(), parse(t, src)); diff != "" {
+		t.Errorf("streamed parse differs from parsing the token slice:\n%s", diff)
+	}
+
+	// The parser stops at the first syntax error, before the lexer
+	// reaches the bad character after it.
+	lexer := NewLexer("int main() { return; } @")
+	if _, err := Parse(lexer); err == nil || lexer.Err() != nil {
+		t.Errorf("got parse error %v and lexer error %v, want only a parse error", err, lexer.Err())
+	}
+}
+
+func TestTabWidth(t *testing.T) {
+	for _, tt := range []struct {
+		tabWidth int
+		code     string
+		col      int
+	}{
+		{0, "\tx", 2},
+		{4, "\tx", 5},
+		{4, "ab\tx", 5},
+		{8, "\t\tx", 17},
+		{4, "abcd\tx", 9},
+	} {
+		lexer := NewLexer(tt.code)
+		lexer.TabWidth = tt.tabWidth
+		tok, err := lexer.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for tok.Value != "x" {
+			tok, _ = lexer.Next()
+		}
+		if tok.Pos.Col != tt.col {
+			t.Errorf("tab width %d, %q: x at column %d, want %d", tt.tabWidth, tt.code, tok.Pos.Col, tt.col)
+		}
+	}
+
+	// The caret under a diagnostic keeps the tabs, so it lines up.
+	reporter := NewDiagReporter("test.lang", "\tint x = @;")
+	reporter.TabWidth = 4
+	got := reporter.format(Diagnostic{Pos: Pos{1, 13}, Severity: Error, Message: "bad"})
+	want := "test.lang:1:13: error: bad\n\tint x = @;\n\t        ^\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestCharLiterals(t *testing.T) {
+	for _, tt := range []struct {
+		lit   string
+		value int
+		c     string
+	}{
+		{`'A'`, 65, `'A'`},
+		{`'\n'`, 10, `'\n'`},
+		{`'\t'`, 9, `'\t'`},
+		{`'\\'`, 92, `'\\'`},
+		{`'\''`, 39, `'\''`},
+		{`'\0'`, 0, `'\0'`},
+		{`'\101'`, 65, `'A'`},
+		{`'\x41'`, 65, `'A'`},
+		{`'\x7f'`, 127, `'\x7f'`},
+		{`'\xff'`, -1, `'\xff'`},
+		{`'\u0041'`, 65, `'A'`},
+	} {
+		v, err := decodeChar(tt.lit, Pos{1, 1})
+		if err != nil || v != tt.value {
+			t.Errorf("%s: got %d, %v; want %d", tt.lit, v, err, tt.value)
+			continue
+		}
+		if c := cCharLit(v); c != tt.c {
+			t.Errorf("%s: got C literal %s, want %s", tt.lit, c, tt.c)
+		}
+	}
+	for _, tt := range []struct {
+		lit, want string
+	}{
+		{`''`, "1:21: empty character literal"},
+		{`'ab'`, "1:23: character literal contains more than one character"},
+		{`'\x'`, "1:22: \\x used with no following hex digits"},
+		{`'\x100'`, "1:22: hex escape sequence out of range for char"},
+		{`'é'`, "1:22: character U+00E9 does not fit in a char"},
+		{`'\q'`, "1:22: unknown escape sequence '\\q'"},
+	} {
+		if got := parseError(t, "int main() { return "+tt.lit+"; }"); got != tt.want {
+			t.Errorf("%s: got error %q, want %q", tt.lit, got, tt.want)
+		}
+	}
+}
+
+func TestUTF8(t *testing.T) {
+	for _, useScanner := range []bool{false, true} {
+		tokens, _, err := lexAll("int größe = 1;", useScanner)
+		if err != nil {
+			t.Fatalf("scanner=%v: %v", useScanner, err)
+		}
+		if tok := tokens[1]; tok.Kind != KindID || tok.Value != "größe" {
+			t.Errorf("scanner=%v: got %v %q, want an ID größe", useScanner, tok.Kind, tok.Value)
+		}
+		_, _, err = lexAll("int main() {\n  int x\xff = 1;\n}\n", useScanner)
+		if want := "2:8: invalid UTF-8 at byte 20"; err == nil || err.Error() != want {
+			t.Errorf("scanner=%v: got error %v, want %q", useScanner, err, want)
+		}
+	}
+}
+
+func TestTokenKinds(t *testing.T) {
+	src := "int x = 1.5 + 2; 'c' \"s\" ? : ( ) { } [ ] , // c\n/// d\nreturn while const assert static_assert"
+	want := []TokenKind{
+		KindInt, KindID, KindOp, KindReal, KindOp, KindNumber, KindSemi, KindCharLit, KindStr,
+		KindQuestion, KindColon, KindLParen, KindRParen, KindLBrace, KindRBrace, KindLBracket, KindRBracket, KindComma,
+		KindDoc, KindReturn, KindWhile, KindConst, KindAssert, KindStaticAssert,
+	}
+	for _, useScanner := range []bool{false, true} {
+		tokens, _, err := lexAll(src, useScanner)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var kinds []TokenKind
+		for _, tok := range tokens {
+			kinds = append(kinds, tok.Kind)
+		}
+		if !reflect.DeepEqual(kinds, want) {
+			t.Errorf("scanner=%v: got kinds %v, want %v", useScanner, kinds, want)
+		}
+	}
+	for word, kind := range keywords {
+		if got := kind.String(); got != strings.ToUpper(word) {
+			t.Errorf("%s: got kind name %s, want %s", word, got, strings.ToUpper(word))
+		}
+	}
+	if got := KindLParen.String(); got != "LPAREN" {
+		t.Errorf("got %s, want LPAREN", got)
+	}
+}
+
+func TestLineContinuation(t *testing.T) {
+	src := "int x = 1 + \\\n    2 \\\n\\\n  ;\n"
+	for _, useScanner := range []bool{false, true} {
+		tokens, _, err := lexAll(src, useScanner)
+		if err != nil {
+			t.Fatalf("scanner=%v: %v", useScanner, err)
+		}
+		var got []string
+		for _, tok := range tokens {
+			got = append(got, fmt.Sprintf("%s %s", tok.Pos, tok.Value))
+		}
+		want := []string{"1:1 int", "1:5 x", "1:7 =", "1:9 1", "1:11 +", "2:5 2", "4:3 ;"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("scanner=%v: got tokens %q, want %q", useScanner, got, want)
+		}
+		if _, _, err := lexAll("int x = 1 \\ 2;", useScanner); err == nil || err.Error() != "1:11: unexpected character: \\" {
+			t.Errorf("scanner=%v: a backslash mid-line gave error %v", useScanner, err)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// lint checks src, as the lint subcommand does first, and lints it with l,
+// returning the linter's diagnostics.
+func lint(t *testing.T, src string, l *Linter) string {
+	t.Helper()
+	prog, checker := check(t, src, options(t))
+	if checker.HasErrors() {
+		t.Fatalf("check:\n%s", diagnostics(checker.Diagnostics))
+	}
+	l.Lint(prog)
+	return diagnostics(l.Diagnostics)
+}
+
+const lintSource = `
+int main() {
+    int unused = 1;
+    int x = 2;
+    double d = 7 / 2;
+    x = x;
+    if (x) {
+        return 1;
+    }
+    while (1 == 2) {
+        x = d;
+    }
+    return x;
+    x = 3;
+}`
+
+func TestLint(t *testing.T) {
+	got := lint(t, lintSource, &Linter{})
+	want := `5:18: warning: integer division stored in double 'd' discards the fraction; make an operand floating-point, as in 1.0 / 2 [int-div]
+6:5: warning: self-assignment of 'x' has no effect [self-assign]
+10:14: warning: while condition is always false (folds to 0) [const-cond]
+14:5: warning: unreachable code after return [unreachable]
+3:5: warning: variable 'unused' is never used [unused]`
+	if got != want {
+		t.Errorf("got diagnostics:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestLintToggles(t *testing.T) {
+	all := lint(t, lintSource, &Linter{})
+	for check := range lintChecks {
+		tag := "[" + check + "]"
+		got := lint(t, lintSource, &Linter{Disabled: map[string]bool{check: true}})
+		if strings.Contains(got, tag) {
+			t.Errorf("%s still reported when disabled:\n%s", check, got)
+		}
+		if optInChecks[check] {
+			if strings.Contains(all, tag) {
+				t.Errorf("opt-in check %s reported by default:\n%s", check, all)
+			}
+			continue
+		}
+		if !strings.Contains(all, tag) {
+			t.Errorf("%s not reported:\n%s", check, all)
+		}
+	}
+	got := lint(t, lintSource, &Linter{Enabled: map[string]bool{"int-cond": true}})
+	if want := "7:9: warning: if condition 'x' is an integer, not a comparison; write 'x != 0' [int-cond]"; !strings.Contains(got, want) {
+		t.Errorf("enabled int-cond did not report %q:\n%s", want, got)
+	}
+	got = lint(t, lintSource, &Linter{ErrorCategories: map[string]bool{"unused": true}})
+	if want := "3:5: error: variable 'unused' is never used [unused]"; !strings.Contains(got, want) {
+		t.Errorf("unused not promoted to an error:\n%s", got)
+	}
+}
+
+func TestLintCommand(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"p.lang": lintSource})
+	_, stderr, status := lang(t, dir, "lint", "p.lang")
+	if status != 1 || strings.Count(stderr, ": warning: ") != 5 {
+		t.Errorf("got status %d and stderr:\n%s", status, stderr)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "p")); err == nil {
+		t.Error("lint built an executable")
+	}
+}
+
+func TestLintConstCond(t *testing.T) {
+	got := lint(t, `
+int main() {
+    int x = 0;
+    if (1 == 1) {
+        x = 1;
+    }
+    while (0) {
+        x = 2;
+    }
+    if (2 * 3 - 6) {
+        x = 3;
+    }
+    while (x < 3) {
+        x = x + 1;
+    }
+    return x;
+}`, &Linter{})
+	want := `4:11: warning: if condition is always true (folds to 1) [const-cond]
+7:12: warning: while condition is always false (folds to 0) [const-cond]
+10:15: warning: if condition is always false (folds to 0) [const-cond]`
+	if got != want {
+		t.Errorf("got diagnostics:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestLintIntDiv(t *testing.T) {
+	got := lint(t, `
+typedef double real;
+int main() {
+    int a = 7;
+    int b = 2;
+    float f = 1 / 2;
+    real r = a / b;
+    f = a / b;
+    float g = 1.0 / 2;
+    double h = a / 2.0;
+    int i = a / b;
+    return f + g + h + i + r;
+}`, &Linter{})
+	want := `6:17: warning: integer division stored in float 'f' discards the fraction; make an operand floating-point, as in 1.0 / 2 [int-div]
+7:16: warning: integer division stored in double 'r' discards the fraction; make an operand floating-point, as in 1.0 / 2 [int-div]
+8:11: warning: integer division stored in float 'f' discards the fraction; make an operand floating-point, as in 1.0 / 2 [int-div]`
+	if got != want {
+		t.Errorf("got diagnostics:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestLintIntCond(t *testing.T) {
+	const src = `
+typedef uint8 byte;
+int main() {
+    int x = 1;
+    byte b = 2;
+    double d = 0.5;
+    if (x) {
+        x = 0;
+    }
+    while (x != 0 && b) {
+        b = 0;
+    }
+    if (x = 3) {
+        x = 4;
+    }
+    if (d || x > 1) {
+        x = 5;
+    }
+    if (1) {
+        x = 6;
+    }
+    return x;
+}`
+	enabled := &Linter{Enabled: map[string]bool{"int-cond": true}, Disabled: map[string]bool{"const-cond": true}}
+	want := `7:9: warning: if condition 'x' is an integer, not a comparison; write 'x != 0' [int-cond]
+10:22: warning: while condition 'b' is an integer, not a comparison; write 'b != 0' [int-cond]
+13:9: warning: if condition 'x = 3' is an integer, not a comparison; write '(x = 3) != 0' [int-cond]`
+	if got := lint(t, src, enabled); got != want {
+		t.Errorf("got diagnostics:\n%s\nwant:\n%s", got, want)
+	}
+	if got := lint(t, src, &Linter{Disabled: map[string]bool{"const-cond": true}}); got != "" {
+		t.Errorf("int-cond reported without --enable:\n%s", got)
+	}
+	if opts := options(t, "--enable=int-cond"); !opts.LintEnable["int-cond"] {
+		t.Error("--enable=int-cond did not enable the check")
+	}
+	if _, err := parseArgs([]string{"--enable=unused", "a.lang"}, nil, ""); err == nil || !strings.Contains(err.Error(), "not an opt-in lint check: unused") {
+		t.Errorf("--enable=unused: got error %v", err)
+	}
+}
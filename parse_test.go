@@ -0,0 +1,473 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// parseError parses src, which must not parse, and returns the error.
+func parseError(t *testing.T, src string) string {
+	t.Helper()
+	_, err := Parse(NewLexer(src))
+	if err == nil {
+		t.Fatalf("%q parsed without error", src)
+	}
+	return err.Error()
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, tt := range []struct {
+		src, want string
+	}{
+		{"int main() { int x = 1; x += 2; return x; }", "1:28: expected expression, got '='"},
+		{"int main() { return 1 +; }", "1:24: expected expression, got ';'"},
+		{"int main() { return 1 }", "1:23: expected ';', got '}'"},
+		{"int main() { return 1;", "1:23: unbalanced braces: expected '}' to close function starting at 1:12"},
+	} {
+		if got := parseError(t, tt.src); got != tt.want {
+			t.Errorf("%q: got error %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+// FuzzParse checks that no input makes the front end panic: syntax errors
+// must come back from Parse as errors, and whatever parses must check and
+// generate C without crashing.
+func FuzzParse(f *testing.F) {
+	for _, seed := range lexSamples {
+		f.Add(seed)
+	}
+	for _, seed := range []string{
+		"int main() { return 0; }",
+		"int f(int a, int b,) { return f(a, b,) ? a : b; }",
+		"typedef int* ip; int main() { ip p = 0; return p[0]; }",
+		"int main() { int a[] = {1, 2,}; a[0] = a[1] = 3; return (a[0], 2 ** 3); }",
+		"int main() { outer: while (1) { while (1) { break outer; } } return ~0; }",
+		"int main( { } int g() { return 1; }",
+		"int main() { if (1) { return 1 } else return 2; }",
+		"extern int puts(string); int main() { puts(\"x\" \"y\"); return 'a'; }",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, src string) {
+		prog, err := Parse(NewLexer(src))
+		if err != nil {
+			return
+		}
+		checker := &Checker{LabeledLoops: true}
+		checker.Check(prog)
+		if checker.HasErrors() {
+			return
+		}
+		checker.Fold(prog)
+		if _, err := (&C99Generator{}).Generate(prog); err != nil {
+			t.Errorf("%q: generate: %v", src, err)
+		}
+	})
+}
+
+// dump parses src and returns the tree as --emit=ast prints it.
+func dump(t *testing.T, src string) string {
+	t.Helper()
+	return DumpAST(parse(t, src), false)
+}
+
+func TestExprStmt(t *testing.T) {
+	got := dump(t, "int main() { f(1); g(); return 0; }")
+	want := `Program
+  Function main() -> int
+    ExprStmt
+      Call f
+        Number 1
+    ExprStmt
+      Call g
+    Return
+      Number 0
+`
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	code := compile(t, "int f(int x) { return x; }\nint main() { f(1); return 0; }", options(t))
+	if !strings.Contains(code, "    f(1);\n") {
+		t.Errorf("no call statement in:\n%s", code)
+	}
+}
+
+func TestUnknownStatementError(t *testing.T) {
+	_, err := Parse(NewLexer("int main() {\n    ) \n}"))
+	var perr *ParseError
+	if !errors.As(err, &perr) {
+		t.Fatalf("got %T %v, want a *ParseError", err, err)
+	}
+	want := &ParseError{
+		Pos:   Pos{2, 5},
+		Msg:   "unexpected token ')' at start of statement",
+		Token: Token{Kind: KindRParen, Value: ")", Pos: Pos{2, 5}},
+	}
+	if *perr != *want {
+		t.Errorf("got %+v, want %+v", perr, want)
+	}
+}
+
+func TestTrailingCommas(t *testing.T) {
+	got := compile(t, `
+int add(int a, int b,) {
+    return a + b;
+}
+int main() {
+    return add(1, 2,);
+}`, options(t))
+	for _, want := range []string{"int add(int a, int b) {", "return add(1, 2);"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("generated C lacks %q:\n%s", want, got)
+		}
+	}
+	for _, tt := range []struct {
+		src, want string
+	}{
+		{"int main() { return f(1,,); }", "1:25: expected expression, got ','"},
+	} {
+		if got := parseError(t, tt.src); got != tt.want {
+			t.Errorf("%q: got error %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestStringConcat(t *testing.T) {
+	for _, tt := range []struct {
+		src, want string
+	}{
+		{`"foo" "bar"`, "foobar"},
+		{`"a" "b" "c"`, "abc"},
+		{`"" "x"`, "x"},
+		{`"\x4" "1"`, `\x4""1`},
+		{`"\n" "1"`, `\n1`},
+	} {
+		prog := parse(t, "int main() { print_str("+tt.src+"); return 0; }")
+		var got []string
+		Walk(prog, visitFunc(func(n Node) {
+			if lit, ok := n.(*StringLit); ok {
+				got = append(got, lit.Value)
+			}
+		}))
+		if len(got) != 1 || got[0] != tt.want {
+			t.Errorf("%s: got literals %q, want [%q]", tt.src, got, tt.want)
+		}
+	}
+	stdout, _ := run(t, `int main() { print_str("con" "cat" "\x4" "1"); return 0; }`, options(t))
+	if want := "concat\x041\n"; stdout != want {
+		t.Errorf("got stdout %q, want %q", stdout, want)
+	}
+}
+
+func TestDumpAST(t *testing.T) {
+	prog := parse(t, "int main() { return (1 + 0x1f) * f(255); }")
+	want := `Program
+  Function main() -> int
+    Return
+      BinOp(*)
+        BinOp(+)
+          Number 1
+          Number 31 (0x1f)
+        Call f
+          Number 255
+`
+	if got := DumpAST(prog, false); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	got := DumpAST(prog, true)
+	for _, want := range []string{"Number 1 (0x1)", "Number 31 (0x1f)", "Number 255 (0xff)"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("hex dump lacks %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestNodePositions(t *testing.T) {
+	prog := parse(t, `int main() {
+    int x = 1 +  2;
+    x = x * 3;
+    return x;
+}`)
+	var got []string
+	Walk(prog, visitFunc(func(n Node) {
+		switch n := n.(type) {
+		case *BinOp:
+			got = append(got, n.Op+" "+n.Pos.String())
+		case *Function, *VarDecl, *Assign, *Return:
+			got = append(got, strings.TrimPrefix(fmt.Sprintf("%T", n), "*main.")+" "+nodePos(n).String())
+		}
+	}))
+	want := []string{"Function 1:1", "VarDecl 2:5", "+ 2:15", "Assign 3:5", "* 3:11", "Return 4:5"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got positions %q, want %q", got, want)
+	}
+}
+
+func TestHeaderRecovery(t *testing.T) {
+	for _, tt := range []struct {
+		src, want string
+	}{
+		// The valid function after the broken header parses cleanly.
+		{"int f(int a { return a; }\nint main() { return 0; }\n",
+			"1:13: malformed function signature: expected ')', got '{'"},
+		// Errors in later functions are still found.
+		{"int 5() { }\nint main() { return 0 }\n",
+			"1:5: malformed function signature: expected identifier, got '5'\n2:23: expected ';', got '}'"},
+	} {
+		if got := parseError(t, tt.src); got != tt.want {
+			t.Errorf("%q: got errors:\n%s\nwant:\n%s", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestUnbalancedBraces(t *testing.T) {
+	for _, tt := range []struct {
+		src, want string
+	}{
+		{"int f() {\n    return 1;\n", "3:1: unbalanced braces: expected '}' to close function starting at 1:9"},
+		{"int f() {\n    if (1) {\n        return 1;\n    }\n", "5:1: unbalanced braces: expected '}' to close function starting at 1:9"},
+		{"int f() {\n    while (1) {\n        return 1;\n}\n", "5:1: unbalanced braces: expected '}' to close function starting at 1:9"},
+		{"int f() {\n    return 1;\n}\nint main() {\n", "5:1: unbalanced braces: expected '}' to close function starting at 4:12"},
+	} {
+		if got := parseError(t, tt.src); got != tt.want {
+			t.Errorf("%q: got error %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+// sexpr renders an expression tree fully parenthesized, Lisp style, so
+// that tests can state the grouping the parser chose.
+func sexpr(n Node) string {
+	switch n := n.(type) {
+	case *BinOp:
+		return "(" + n.Op + " " + sexpr(n.Left) + " " + sexpr(n.Right) + ")"
+	case *Unary:
+		return "(" + n.Op + " " + sexpr(n.Expr) + ")"
+	case *Ternary:
+		return "(? " + sexpr(n.Cond) + " " + sexpr(n.Then) + " " + sexpr(n.Else) + ")"
+	case *Assign:
+		return "(= " + sexpr(n.Target) + " " + sexpr(n.Expr) + ")"
+	case *Comma:
+		var exprs []string
+		for _, e := range n.Exprs {
+			exprs = append(exprs, sexpr(e))
+		}
+		return "(, " + strings.Join(exprs, " ") + ")"
+	case *Ident:
+		return n.Name
+	case *Number:
+		return fmt.Sprint(n.Value)
+	}
+	return fmt.Sprintf("%T", n)
+}
+
+func TestPrecedence(t *testing.T) {
+	for _, tt := range []struct {
+		expr, want string
+	}{
+		{"a ? b : c + d", "(? a b (+ c d))"},
+		{"a || b && c", "(|| a (&& b c))"},
+		{"a && b || c", "(|| (&& a b) c)"},
+		{"a ? b : c ? d : e", "(? a b (? c d e))"},
+		{"a ? b ? c : d : e", "(? a (? b c d) e)"},
+		{"a || b ? c : d", "(? (|| a b) c d)"},
+		{"a < b == c > d", "(== (< a b) (> c d))"},
+		{"a + b < c * d", "(< (+ a b) (* c d))"},
+		{"a << b + c", "(<< a (+ b c))"},
+		{"a < b << c", "(< a (<< b c))"},
+		{"a - b - c", "(- (- a b) c)"},
+		{"a * b / c", "(/ (* a b) c)"},
+		{"a ** b ** c", "(** a (** b c))"},
+		{"~a ** b", "(** (~ a) b)"},
+		{"a && ~b == c", "(&& a (== (~ b) c))"},
+		{"a = b = c ? d : e", "(= a (= b (? c d e)))"},
+		{"(a = 1, a + 2)", "(, (= a 1) (+ a 2))"},
+	} {
+		prog := parse(t, "int main() { return "+tt.expr+"; }")
+		ret := prog.Decls[0].(*Function).Body[0].(*Return)
+		if got := sexpr(ret.Expr); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestEmptyStatements(t *testing.T) {
+	const src = `
+int main() {
+    int x = 1;;
+    ;
+    {
+        ;
+    }
+    while (x < 3) {
+        ;;
+        x = x + 1;
+    }
+    return x;
+}`
+	if want := "EmptyStmt"; !strings.Contains(dump(t, src), want) {
+		t.Errorf("no %s in:\n%s", want, dump(t, src))
+	}
+	opts := options(t)
+	opts.Input = ""
+	got := compile(t, src, opts)
+	if strings.Contains(got, ";;") {
+		t.Errorf("stray semicolons in:\n%s", got)
+	}
+	if _, status := run(t, src, options(t)); status != 3 {
+		t.Errorf("got status %d, want 3", status)
+	}
+}
+
+// counter is a Visitor counting nodes, which skips the children of nodes
+// of the type named by skip.
+type counter struct {
+	enter, leave int
+	skip         string
+	order        []string
+}
+
+func (c *counter) Enter(n Node) bool {
+	c.enter++
+	name := strings.TrimPrefix(fmt.Sprintf("%T", n), "*main.")
+	c.order = append(c.order, name)
+	return name != c.skip
+}
+
+func (c *counter) Leave(n Node) { c.leave++ }
+
+func TestWalk(t *testing.T) {
+	prog := parse(t, `
+int f(int n) {
+    return n * 2;
+}
+int main() {
+    int x = f(1) + 3;
+    if (x > 4) {
+        x = 0;
+    }
+    return x;
+}`)
+	c := &counter{}
+	Walk(prog, c)
+	// Program; f, Return, BinOp, Ident, Number; main, VarDecl, BinOp,
+	// Call, Number, Number, If, BinOp, Ident, Number, Block, ExprStmt,
+	// Assign, Ident, Number, Return, Ident.
+	if c.enter != 23 || c.leave != 23 {
+		t.Errorf("entered %d and left %d nodes, want 23 each", c.enter, c.leave)
+	}
+	if want := []string{"Program", "Function", "Return", "BinOp", "Ident", "Number", "Function", "VarDecl"}; !reflect.DeepEqual(c.order[:len(want)], want) {
+		t.Errorf("got order %q, want it to start %q", c.order, want)
+	}
+	c = &counter{skip: "If"}
+	Walk(prog, c)
+	if c.enter != 15 || c.leave != 14 {
+		t.Errorf("skipping If: entered %d and left %d nodes, want 15 and 14", c.enter, c.leave)
+	}
+}
+
+func TestReturnParens(t *testing.T) {
+	prog := parse(t, "int main() { int a = 1; int b = 2; return (a, b); }")
+	ret := prog.Decls[0].(*Function).Body[2].(*Return)
+	if got := sexpr(ret.Expr); got != "(, a b)" {
+		t.Errorf("return (a, b): got %s", got)
+	}
+	prog = parse(t, "int main() { int x = 1; return ((x)); }")
+	ret = prog.Decls[0].(*Function).Body[1].(*Return)
+	if got := sexpr(ret.Expr); got != "x" {
+		t.Errorf("return ((x)): got %s", got)
+	}
+	for _, tt := range []struct {
+		expr, want string
+	}{
+		{"(a, b)", "(a, b)"},
+		{"(a)", "a"},
+		{"((a, b), c)", "((a, b), c)"},
+		{"(a, (b, c))", "(a, (b, c))"},
+	} {
+		if got := genExpr(t, tt.expr, options(t)); got != tt.want {
+			t.Errorf("return %s: got %s, want %s", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestLiteralBases(t *testing.T) {
+	prog := parse(t, "int main() { return 0x1F + 017 + 0b101 + 9 + 0XffUL; }")
+	var got []Number
+	Walk(prog, visitFunc(func(n Node) {
+		if num, ok := n.(*Number); ok {
+			got = append(got, Number{Value: num.Value, Base: num.Base, Raw: num.Raw, Suffix: num.Suffix})
+		}
+	}))
+	want := []Number{
+		{Value: 31, Base: 16, Raw: "0x1F"},
+		{Value: 15, Base: 8, Raw: "017"},
+		{Value: 5, Base: 2, Raw: "0b101"},
+		{Value: 9},
+		{Value: 255, Base: 16, Raw: "0Xff", Suffix: "UL"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got literals %+v, want %+v", got, want)
+	}
+	data, err := json.Marshal(got[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := string(data); !strings.Contains(s, `"Base":16`) || !strings.Contains(s, `"Raw":"0x1F"`) {
+		t.Errorf("JSON lacks the base and raw text: %s", s)
+	}
+	if got := Format(prog, nil); !strings.Contains(got, "return 0x1F + 017 + 0b101 + 9 + 0XffUL;") {
+		t.Errorf("formatter lost the literals' spelling:\n%s", got)
+	}
+}
+
+func TestExpectedExpression(t *testing.T) {
+	for _, tt := range []struct {
+		src, want string
+	}{
+		{"int main() { int x = ; return x; }", "1:22: expected expression, got ';'"},
+		{"int main() { return ) }", "1:21: expected expression, got ')'"},
+		{"int main() { return }", "1:21: expected expression, got '}'"},
+		{"int main() { return 1 + }", "1:25: expected expression, got '}'"},
+		{"int main() { return int; }", "1:21: expected expression, got 'int'"},
+		{"int main() { return", "1:20: expected expression, got end of file"},
+	} {
+		if got := parseError(t, tt.src); !strings.HasPrefix(got, tt.want) {
+			t.Errorf("%q: got error %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestConstTypes(t *testing.T) {
+	got := dump(t, "int main() { const int* p = 0; int*const q = 0; const int*const r = 0; char** argv = 0; return 0; }")
+	for _, want := range []string{"VarDecl const int* p", "VarDecl int*const q", "VarDecl const int*const r", "VarDecl char** argv"} {
+		if !strings.Contains(got, want+"\n") {
+			t.Errorf("ast dump lacks %q:\n%s", want, got)
+		}
+	}
+	lexer := NewLexer("int main() { const int*const r = 0; return 0; }")
+	prog, err := Parse(lexer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := Format(prog, lexer.Comments); !strings.Contains(got, "const int* const r = 0;") {
+		t.Errorf("formatted source lacks const int* const r:\n%s", got)
+	}
+	for _, tt := range []struct {
+		src, want string
+	}{
+		{"int f(,) { return 0; }", "1:7: malformed function signature: expected type, got ','"},
+		{"int main() { const x = 1; return 0; }", "1:20: expected type, got 'x'"},
+		{"extern int g(int, 5);", "1:19: expected type, got '5'"},
+		{"int main() { int*const const p; return 0; }", "1:24: expected identifier, got 'const'"},
+	} {
+		if got := parseError(t, tt.src); got != tt.want {
+			t.Errorf("%s: got error %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,673 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// requireGCC skips the test when gcc is not installed.
+func requireGCC(t testing.TB) {
+	t.Helper()
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("gcc not found")
+	}
+}
+
+// build compiles src with opts into an executable in a temporary
+// directory, linking it as the driver would, and returns its path.
+func build(t testing.TB, src string, opts *Options) string {
+	t.Helper()
+	requireGCC(t)
+	code, gen := generate(t, src, opts)
+	dir := t.TempDir()
+	c, exe := filepath.Join(dir, "test.c"), filepath.Join(dir, "test")
+	if err := os.WriteFile(c, []byte(code), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := runGCC(opts, gccArgs(opts, exe, []string{c}, gen.Libs)); err != nil {
+		t.Fatalf("%v\n%s\n%s", err, out, code)
+	}
+	return exe
+}
+
+// run builds src with opts and runs it with args, returning what it
+// printed and its exit status.
+func run(t testing.TB, src string, opts *Options, args ...string) (string, int) {
+	t.Helper()
+	out, err := exec.Command(build(t, src, opts), args...).Output()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return string(out), exitErr.ExitCode()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out), 0
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		stdout string
+		status int
+	}{
+		{"exit status", `int main() { return 42; }`, "", 42},
+		{"hello", `
+int main() {
+    print_str("hello, world");
+    return 0;
+}`, "hello, world\n", 0},
+		{"recursion", `
+int fact(int n) {
+    if (n < 2) {
+        return 1;
+    }
+    return n * fact(n - 1);
+}
+
+int main() {
+    print_int(fact(10));
+    return fact(5);
+}`, "3628800\n", 120},
+		{"loop", `
+int main() {
+    int a = 0;
+    int b = 1;
+    int i = 0;
+    while (i < 10) {
+        print_int(a);
+        b = a + b;
+        a = b - a;
+        i = i + 1;
+    }
+    return a;
+}`, "0\n1\n1\n2\n3\n5\n8\n13\n21\n34\n", 55},
+		{"negative status", `int main() { return 0 - 1; }`, "", 255},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, status := run(t, tt.src, options(t))
+			if stdout != tt.stdout || status != tt.status {
+				t.Errorf("got stdout %q and status %d, want %q and %d", stdout, status, tt.stdout, tt.status)
+			}
+		})
+	}
+}
+
+// TestRunTestdata runs the golden-file programs, so that the C they are
+// compared against is known to behave.
+func TestRunTestdata(t *testing.T) {
+	tests := []struct {
+		file   string
+		stdout string
+		status int
+	}{
+		{"hello.lang", "hello, world\n42\n", 0},
+		{"control.lang", "67\n", 0},
+		{"power.lang", "12.5664\n", 1},
+		{"precedence.lang", "", 255},
+		{"types.lang", "const string\n", 0},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.file, func(t *testing.T) {
+			src, err := os.ReadFile(filepath.Join("testdata", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			stdout, status := run(t, string(src), options(t))
+			if stdout != tt.stdout || status != tt.status {
+				t.Errorf("got stdout %q and status %d, want %q and %d", stdout, status, tt.stdout, tt.status)
+			}
+		})
+	}
+}
+
+func TestRunExtern(t *testing.T) {
+	const src = `
+extern int abs(int);
+extern int puts(string s);
+
+int main() {
+    puts("from libc");
+    return abs(0 - 7);
+}`
+	if got := compile(t, src, options(t)); !strings.Contains(got, "extern int abs(int);") {
+		t.Errorf("no extern declaration in:\n%s", got)
+	}
+	stdout, status := run(t, src, options(t))
+	if stdout != "from libc\n" || status != 7 {
+		t.Errorf("got stdout %q and status %d, want %q and 7", stdout, status, "from libc\n")
+	}
+}
+
+func TestRunPrelude(t *testing.T) {
+	const src = `
+int main() {
+    print_int(42);
+    print_str("forty-two");
+    return 0;
+}`
+	if stdout, _ := run(t, src, options(t)); stdout != "42\nforty-two\n" {
+		t.Errorf("got stdout %q", stdout)
+	}
+}
+
+func TestRunIntWidths(t *testing.T) {
+	_, status := run(t, `
+int main() {
+    int64 big = 1L << 40;
+    int8 small = 100;
+    int16 medium = small * 100;
+    return big >> 38 == 4 && medium == 10000;
+}`, options(t))
+	if status != 1 {
+		t.Errorf("got status %d, want 1", status)
+	}
+}
+
+func TestRunUnsigned(t *testing.T) {
+	const src = `
+int main() {
+    uint u = 0 - 1;
+    uint8 b = 255;
+    b = b + 1;
+    return u > 5 && b == 0;
+}`
+	if got := compile(t, src, options(t)); !strings.Contains(got, "unsigned int u = ") {
+		t.Errorf("uint not declared unsigned int:\n%s", got)
+	}
+	if _, status := run(t, src, options(t)); status != 1 {
+		t.Errorf("got status %d, want 1", status)
+	}
+}
+
+func TestRunStrings(t *testing.T) {
+	const src = `
+string greeting(int formal) {
+    if (formal) {
+        return "good day";
+    }
+    return "hi";
+}
+
+int main() {
+    string s = greeting(0);
+    print_str(s);
+    print_str(greeting(1));
+    return s[1];
+}`
+	got := compile(t, src, options(t))
+	for _, want := range []string{"const char *greeting(int formal) {", `const char *s = greeting(0);`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("generated C lacks %q:\n%s", want, got)
+		}
+	}
+	stdout, status := run(t, src, options(t))
+	if stdout != "hi\ngood day\n" || status != 'i' {
+		t.Errorf("got stdout %q and status %d, want %q and %d", stdout, status, "hi\ngood day\n", 'i')
+	}
+}
+
+func TestRunShifts(t *testing.T) {
+	const src = `
+int main() {
+    int s = 0 - 16;
+    uint u = 0 - 16;
+    print_int(s >> 2);
+    print("%u\n", u >> 28);
+    print_int(1 << 4);
+    return 0;
+}`
+	prog, _ := check(t, src, options(t))
+	var types []string
+	Walk(prog, visitFunc(func(n Node) {
+		if bin, ok := n.(*BinOp); ok && bin.Op == ">>" {
+			types = append(types, bin.Type)
+		}
+	}))
+	if want := []string{"int", "uint"}; !reflect.DeepEqual(types, want) {
+		t.Errorf("got shift types %q, want %q", types, want)
+	}
+	if stdout, _ := run(t, src, options(t)); stdout != "-4\n15\n16\n" {
+		t.Errorf("got stdout %q", stdout)
+	}
+}
+
+// visitFunc is a Visitor calling itself on every node.
+type visitFunc func(n Node)
+
+func (f visitFunc) Enter(n Node) bool { f(n); return true }
+func (f visitFunc) Leave(n Node)      {}
+
+func TestRunBlockScopes(t *testing.T) {
+	const src = `
+int main() {
+    int x = 1;
+    {
+        int x = 2;
+        print_int(x);
+        {
+            int y = x + 10;
+            print_int(y);
+        }
+    }
+    print_int(x);
+    return x;
+}`
+	opts := options(t)
+	opts.Input = ""
+	got := compile(t, src, opts)
+	if want := "    {\n        int x = 2;\n"; !strings.Contains(got, want) {
+		t.Errorf("inner x not declared in its own block:\n%s", got)
+	}
+	stdout, status := run(t, src, options(t))
+	if stdout != "2\n12\n1\n" || status != 1 {
+		t.Errorf("got stdout %q and status %d, want %q and 1", stdout, status, "2\n12\n1\n")
+	}
+}
+
+func TestRunNestedCalls(t *testing.T) {
+	const src = `
+int f(int a, int b) {
+    return a * 10 + b;
+}
+int g(int n) {
+    return n + 1;
+}
+int main() {
+    print_int(f(1, 0) + 2 * g(3));
+    return f(g(1), g(g(0)) * 3);
+}`
+	got := compile(t, src, options(t))
+	for _, want := range []string{"f(1, 0) + 2 * g(3)", "return f(g(1), g(g(0)) * 3);"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("generated C lacks %q:\n%s", want, got)
+		}
+	}
+	stdout, status := run(t, src, options(t))
+	if stdout != "18\n" || status != 26 {
+		t.Errorf("got stdout %q and status %d, want %q and 26", stdout, status, "18\n")
+	}
+}
+
+func TestRunComma(t *testing.T) {
+	const src = `
+int next(int n) {
+    print_int(n);
+    return n;
+}
+int main() {
+    int a = 0;
+    int b = (a = 1, a + 2);
+    return (next(1), next(2), next(b));
+}`
+	got := compile(t, src, options(t))
+	for _, want := range []string{"int b = (a = 1, a + 2);", "return (next(1), next(2), next(b));"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("generated C lacks %q:\n%s", want, got)
+		}
+	}
+	stdout, status := run(t, src, options(t))
+	if stdout != "1\n2\n3\n" || status != 3 {
+		t.Errorf("got stdout %q and status %d, want %q and 3", stdout, status, "1\n2\n3\n")
+	}
+}
+
+func TestRunTypedef(t *testing.T) {
+	const src = `
+typedef int myint;
+typedef myint count;
+typedef uint8 byte;
+
+count twice(myint n) {
+    return n * 2;
+}
+
+int main() {
+    count c = twice(21);
+    byte b = 255;
+    b = b + 1;
+    return c + b;
+}`
+	got := compile(t, src, options(t))
+	for _, want := range []string{"typedef int myint;", "typedef myint count;", "typedef uint8_t byte;", "count twice(myint n) {", "count c = twice(21);"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("generated C lacks %q:\n%s", want, got)
+		}
+	}
+	if _, status := run(t, src, options(t)); status != 42 {
+		t.Errorf("got status %d, want 42", status)
+	}
+	checkDiagnostics(t, `
+typedef int8 small;
+typedef small tiny;
+int main() {
+    tiny t = 300;
+    return t;
+}`, `5:5: error: constant 300 overflows int8 (range -128 to 127) [E0013]`)
+}
+
+func TestRunArrayLit(t *testing.T) {
+	const src = `
+int main() {
+    int one[1] = {7};
+    int three[3] = {1, 2, 3};
+    int open[] = {10, 20, 30, 40,};
+    int hex[0x4] = {1, 2};
+    int sized[8U];
+    sized[7] = 5;
+    return one[0] + three[2] + open[3] + hex[1] + hex[3] + sized[7];
+}`
+	got := compile(t, src, options(t))
+	for _, want := range []string{"int one[1] = {7};", "int three[3] = {1, 2, 3};", "int open[] = {10, 20, 30, 40};", "int hex[4] = {1, 2};", "int sized[8];"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("generated C lacks %q:\n%s", want, got)
+		}
+	}
+	if _, status := run(t, src, options(t)); status != 57 {
+		t.Errorf("got status %d, want 57", status)
+	}
+	checkDiagnostics(t, `
+int main() {
+    int a[2] = {1, 2, 3};
+    return a[0];
+}`, "3:23: error: too many initializers for 'a[2]': got 3 [E0011]")
+	for _, tt := range []struct {
+		src, want string
+	}{
+		{"int main() { int a[0]; return 0; }", "1:20: array size must be a positive integer, got 0"},
+		{"int main() { int a[0x0UL]; return 0; }", "1:20: array size must be a positive integer, got 0x0UL"},
+		{"int main() { int a[99999999999999999999]; return 0; }", "1:20: array size must be a positive integer, got 99999999999999999999"},
+	} {
+		if got := parseError(t, tt.src); got != tt.want {
+			t.Errorf("%q: got error %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestRunComplement(t *testing.T) {
+	const src = `
+int main() {
+    int x = ~0;
+    int y = ~x + 5;
+    print_int(x);
+    print_int(y);
+    print_int(~(y - 1));
+    return ~~7;
+}`
+	if got := dump(t, src); !strings.Contains(got, "Unary(~)\n        Number 0\n") {
+		t.Errorf("~0 not parsed as a unary operation:\n%s", got)
+	}
+	if got := genExpr(t, "~(a + b) * ~c", options(t)); got != "~(a + b) * ~c" {
+		t.Errorf("got %s", got)
+	}
+	stdout, status := run(t, src, options(t))
+	if stdout != "-1\n5\n-5\n" || status != 7 {
+		t.Errorf("got stdout %q and status %d, want %q and 7", stdout, status, "-1\n5\n-5\n")
+	}
+	if code := compile(t, src, options(t, "-O1")); !strings.Contains(code, "int x = -1;") {
+		t.Errorf("-O1 did not fold ~0:\n%s", code)
+	}
+}
+
+func TestRunArgs(t *testing.T) {
+	const src = `
+int main(int argc, char** argv) {
+    print_str(argv[argc - 1]);
+    return argc;
+}`
+	if got := compile(t, src, options(t)); !strings.Contains(got, "int main(int argc, char **argv) {") {
+		t.Errorf("main's parameters not declared:\n%s", got)
+	}
+	stdout, status := run(t, src, options(t), "a", "last")
+	if stdout != "last\n" || status != 3 {
+		t.Errorf("got stdout %q and status %d, want %q and 3", stdout, status, "last\n")
+	}
+	checkDiagnostics(t, `
+int main(int argc) {
+    return argc;
+}`, "2:10: error: main must take no parameters or (int argc, char** argv) [E0010]")
+	checkDiagnostics(t, `
+int main(int argc, char* *argv, int extra) {
+    return argc;
+}`, "2:10: error: main must take no parameters or (int argc, char** argv) [E0010]")
+}
+
+func TestRunLabeledLoops(t *testing.T) {
+	const src = `
+int main() {
+    int i = 0;
+    int found = 0;
+    outer: while (i < 10) {
+        int j = 0;
+        i = i + 1;
+        inner: while (j < 10) {
+            j = j + 1;
+            if (j > i) {
+                continue outer;
+            }
+            if (i * j == 12) {
+                found = i * 10 + j;
+                break outer;
+            }
+            if (j == 8) {
+                break inner;
+            }
+        }
+    }
+    print_int(found);
+    return i;
+}`
+	opts := options(t, "--enable-labeled-loops")
+	opts.Input = ""
+	got := compile(t, src, opts)
+	for _, want := range []string{"goto outer_break;", "goto outer_continue;", "goto inner_break;", "outer_continue:;", "outer_break:;", "inner_break:;"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("generated C lacks %q:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "inner_continue") {
+		t.Errorf("unused label emitted:\n%s", got)
+	}
+	stdout, status := run(t, src, options(t, "--enable-labeled-loops"))
+	if stdout != "43\n" || status != 4 {
+		t.Errorf("got stdout %q and status %d, want %q and 4", stdout, status, "43\n")
+	}
+
+	_, checker := check(t, src, options(t))
+	if want := "5:12: error: labeled loops are a language extension; enable them with --enable-labeled-loops"; !strings.HasPrefix(diagnostics(checker.Diagnostics), want) {
+		t.Errorf("without the flag got:\n%s", diagnostics(checker.Diagnostics))
+	}
+	_, checker = check(t, `
+int main() {
+    a: while (1) {
+        a: while (1) {
+            break b;
+        }
+    }
+    continue a;
+}`, opts)
+	want := `4:12: error: duplicate loop label 'a' [E0008]
+5:13: error: break label 'b' does not name an enclosing loop [E0008]
+8:5: error: continue statement not within a loop [E0008]`
+	if got := diagnostics(checker.Diagnostics); got != want {
+		t.Errorf("got diagnostics:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestRunAssignExpr(t *testing.T) {
+	const src = `
+int next(int n) {
+    return n + 1;
+}
+int main() {
+    int a = 1;
+    int b = 2;
+    int x = 0;
+    a = b = 7;
+    if ((x = next(a)) > 5) {
+        print_int(x);
+    }
+    int c = (b = 3) + 1;
+    return a + b + c;
+}`
+	prog := parse(t, src)
+	var sexprs []string
+	Walk(prog, visitFunc(func(n Node) {
+		if stmt, ok := n.(*ExprStmt); ok {
+			sexprs = append(sexprs, sexpr(stmt.Expr))
+		}
+	}))
+	if len(sexprs) == 0 || sexprs[0] != "(= a (= b 7))" {
+		t.Errorf("got statements %q, want the first to be (= a (= b 7))", sexprs)
+	}
+	stdout, status := run(t, src, options(t))
+	if stdout != "8\n" || status != 14 {
+		t.Errorf("got stdout %q and status %d, want %q and 14", stdout, status, "8\n")
+	}
+	checkDiagnostics(t, `
+int main() {
+    int a = 1;
+    a + 1 = 2;
+    return (a = 2) = 3;
+}`, `4:7: error: expression is not assignable [E0007]
+5:13: error: expression is not assignable [E0007]`)
+}
+
+func TestRunUnicodeIdent(t *testing.T) {
+	stdout, status := run(t, `
+int größe(int π) { return π * 2; }
+int main() { print_int(größe(21)); return 0; }`, options(t))
+	if stdout != "42\n" || status != 0 {
+		t.Errorf("got %q and status %d, want %q and 0", stdout, status, "42\n")
+	}
+}
+
+func TestRunAssert(t *testing.T) {
+	const src = `
+int main() {
+    int x = 3;
+    assert(x == 3);
+    print_int(x);
+    assert(x > 5);
+    print_int(x + 1);
+    return 0;
+}`
+	exe := build(t, src, options(t))
+	cmd := exec.Command(exe)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	// Output printed before the abort is lost with stdio's buffer.
+	if err := cmd.Run(); err == nil || !strings.Contains(stderr.String(), "test.lang:6: main: Assertion `x > 5' failed") {
+		t.Errorf("got %v and stderr %q, want an abort at the second assertion", err, stderr.String())
+	}
+	if stdout, status := run(t, src, options(t, "--no-assert")); stdout != "3\n4\n" || status != 0 {
+		t.Errorf("--no-assert: got %q and status %d, want %q and 0", stdout, status, "3\n4\n")
+	}
+}
+
+func TestRunDebugPrint(t *testing.T) {
+	const src = `
+int main() {
+    int x = 2;
+    debug_print("x is %d\n", x);
+    print_int(x);
+    return 0;
+}`
+	if code := compile(t, src, options(t)); strings.Contains(code, "x is") {
+		t.Errorf("debug_print was kept without --debug:\n%s", code)
+	}
+	if stdout, _ := run(t, src, options(t)); stdout != "2\n" {
+		t.Errorf("got %q, want %q", stdout, "2\n")
+	}
+	if stdout, _ := run(t, src, options(t, "--debug")); stdout != "x is 2\n2\n" {
+		t.Errorf("--debug: got %q, want %q", stdout, "x is 2\n2\n")
+	}
+}
+
+func TestRunDivision(t *testing.T) {
+	const src = `
+int main() {
+    int a = 7;
+    double d = 7.0;
+    print_int(a / 2);
+    print("%g\n", d / 2);
+    print("%g\n", a / 2.0);
+    return 0;
+}`
+	for _, level := range []string{"-O0", "-O2"} {
+		if stdout, _ := run(t, src, options(t, level)); stdout != "3\n3.5\n3.5\n" {
+			t.Errorf("%s: got %q, want %q", level, stdout, "3\n3.5\n3.5\n")
+		}
+	}
+	prog, _ := check(t, src, options(t, "-O0"))
+	dump := DumpAST(prog, false)
+	for _, label := range []string{"BinOp(/) int", "BinOp(/) double"} {
+		if !strings.Contains(dump, label) {
+			t.Errorf("ast dump lacks %q:\n%s", label, dump)
+		}
+	}
+}
+
+func TestRunPower(t *testing.T) {
+	const src = `
+int main() {
+    int b = 3;
+    uint8 small = 2;
+    print_int(2 ** 10);
+    print_int(b ** 4 / 2);
+    print_int(~(small ** 3));
+    print("%g\n", 2.0 ** 0.5 * 2.0 ** 0.5);
+    return 0;
+}`
+	want := "1024\n40\n-9\n2\n"
+	for _, level := range []string{"-O0", "-O1"} {
+		if stdout, _ := run(t, src, options(t, level)); stdout != want {
+			t.Errorf("%s: got %q, want %q", level, stdout, want)
+		}
+	}
+}
+
+func TestRunPowerExact(t *testing.T) {
+	// 3 ** 39 is above 2^53, where pow's double result would be off.
+	const src = `
+int main() {
+    int64 b = 3L;
+    uint64 u = 3UL;
+    print("%ld\n", 3L ** 39L);
+    print("%ld\n", b ** 39L);
+    print("%lu\n", u ** 40UL);
+    print_int((0 - 1) ** 5);
+    print_int(2 ** (0 - 1));
+    return 0;
+}`
+	want := "4052555153018976267\n4052555153018976267\n12157665459056928801\n-1\n0\n"
+	for _, level := range []string{"-O0", "-O1"} {
+		if stdout, _ := run(t, src, options(t, level)); stdout != want {
+			t.Errorf("%s: got %q, want %q", level, stdout, want)
+		}
+	}
+}
+
+func TestRunUnsignedLiteralCompare(t *testing.T) {
+	// x converts to a huge unsigned value, so folding the comparison as
+	// signed integers would get it wrong.
+	const src = `
+int main() {
+    int x = 0 - 1;
+    print_int(x < 5U);
+    print_int(4000000000U + 1000000000U > 0U);
+    return 0;
+}`
+	for _, level := range []string{"-O0", "-O2"} {
+		if stdout, _ := run(t, src, options(t, level)); stdout != "0\n1\n" {
+			t.Errorf("%s: got %q, want %q", level, stdout, "0\n1\n")
+		}
+	}
+}